@@ -8,29 +8,37 @@ import (
 
 // Buffered File
 
-const BufferSize = 1024 * 32 // Buffer size for values written to the BFile
+const BufferSize = 1024 * 32 // Default buffer size for values written to the BFile
 
 var nilKey [32]byte
 
 // Block BFile
 // Holds the buffers and ID stuff needed to build DBBlocks (Database Blocks)
 type BFile struct {
-	File     *os.File         // The file being buffered. It doesn't have to be kept open
-	Filename string           // Fully qualified file name for the BFle
-	Buffer   [BufferSize]byte // The current BFBuffer under construction
-	EOB      uint64           // End within the buffer
-	EOD      uint64           // Current EOD
+	File     storageFile // The file being buffered. It doesn't have to be kept open
+	Filename string      // Fully qualified file name for the BFle
+	Buffer   []byte      // The current BFBuffer under construction
+	EOB      uint64      // End within the buffer
+	EOD      uint64      // Current EOD
+	Sync     SyncPolicy  // When to force writes to disk
+	ReadOnly bool        // The file is opened O_RDONLY, and writes fail with ErrReadOnly
+	crypt    *crypter    // Encrypts the file by blocks; nil if it is not encrypted
 }
 
 // Open
 // Open an existing BFile given a fully qualified filename
-func OpenBFile(filename string) (bFile *BFile, err error) {
+func OpenBFile(filename string, opts *Options) (bFile *BFile, err error) {
+	opts = opts.withDefaults()
 	bFile = new(BFile)
 	bFile.Filename = filename
-	if bFile.File, err = os.OpenFile(filename, os.O_RDWR, os.ModePerm); err != nil {
+	bFile.Buffer = make([]byte, opts.BufferSize)
+	bFile.Sync = opts.Sync
+	bFile.ReadOnly = opts.readOnly
+	bFile.crypt = opts.crypt
+	if bFile.File, err = openStorage(filename, bFile.flag(), os.ModePerm, bFile.crypt); err != nil {
 		return nil, err
 	}
-	if fileInfo, err := os.Stat(filename); err != nil {
+	if fileInfo, err := bFile.File.Stat(); err != nil {
 		return nil, err
 	} else {
 		bFile.EOD = uint64(fileInfo.Size())
@@ -41,11 +49,15 @@ func OpenBFile(filename string) (bFile *BFile, err error) {
 
 // NewBFile
 // Create a new BFile.  An existing one will be overwritten
-func NewBFile(filename string) (file *BFile, err error) {
+func NewBFile(filename string, opts *Options) (file *BFile, err error) {
+	opts = opts.withDefaults()
 	file = new(BFile)
 	file.Filename = filename
-	file.File, err = os.Create(file.Filename) // Create the file
-	return file, err                          //
+	file.Buffer = make([]byte, opts.BufferSize)
+	file.Sync = opts.Sync
+	file.crypt = opts.crypt
+	file.File, err = openStorage(file.Filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, file.crypt) // Create the file
+	return file, err
 }
 
 // Open
@@ -57,7 +69,7 @@ func (b *BFile) Open() (err error) {
 		return nil
 	}
 
-	if b.File, err = os.OpenFile(b.Filename, os.O_RDWR, os.ModePerm); err != nil {
+	if b.File, err = openStorage(b.Filename, b.flag(), os.ModePerm, b.crypt); err != nil {
 		return err
 	}
 	if eod, err := b.File.Seek(0, io.SeekEnd); err != nil {
@@ -68,9 +80,21 @@ func (b *BFile) Open() (err error) {
 	return nil
 }
 
+// flag
+// The flag used to open the underlying file
+func (b *BFile) flag() int {
+	if b.ReadOnly {
+		return os.O_RDONLY
+	}
+	return os.O_RDWR
+}
+
 // Flush
-// Write out the buffer, and reset the EOB
+// Write out the buffer, and reset the EOB.  A read-only BFile has nothing to flush.
 func (b *BFile) Flush() (err error) {
+	if b.ReadOnly {
+		return nil
+	}
 	err = b.Open()
 	if err != nil {
 		return err
@@ -86,6 +110,9 @@ func (b *BFile) Flush() (err error) {
 	}
 	b.EOB = 0
 	b.EOD += uint64(delta)
+	if b.Sync == SyncAlways {
+		return b.File.Sync()
+	}
 	return err
 }
 
@@ -95,6 +122,14 @@ func (b *BFile) Close() (err error) {
 	if err = b.Flush(); err != nil {
 		return err
 	}
+	if b.File == nil {
+		return nil
+	}
+	if b.Sync == SyncOnClose && !b.ReadOnly {
+		if err = b.File.Sync(); err != nil {
+			return err
+		}
+	}
 	err = b.File.Close()
 	b.File = nil
 	return err
@@ -118,8 +153,11 @@ func (b *BFile) Offset() (offset uint64, err error) {
 // update -- true if a actual file update occurs
 // err    -- nil on no error, the error if an error occurs
 func (b *BFile) Write(Data []byte) (update bool, err error) {
+	if b.ReadOnly {
+		return false, fmt.Errorf("%w: %s", ErrReadOnly, b.Filename)
+	}
 
-	space := uint64(BufferSize - b.EOB)
+	space := uint64(len(b.Buffer)) - b.EOB
 
 	// Write to the current buffer
 	dLen := len(Data)
@@ -136,7 +174,7 @@ func (b *BFile) Write(Data []byte) (update bool, err error) {
 
 	if space > 0 {
 		n := copy(b.Buffer[b.EOB:], Data) // Copy what fits into the current buffer
-		b.EOB += uint64(n)                // Update b.EOB (should be equal to BufferSize)
+		b.EOB += uint64(n)                // Update b.EOB (should be equal to len(b.Buffer))
 		Data = Data[n:]
 	}
 
@@ -152,6 +190,11 @@ func (b *BFile) Write(Data []byte) (update bool, err error) {
 	} else {
 		b.EOD += uint64(written)
 	}
+	if b.Sync == SyncAlways {
+		if err = b.File.Sync(); err != nil {
+			return false, err
+		}
+	}
 
 	b.EOB = 0          //         Start at the beginning of the buffer
 	if len(Data) > 0 { //         If more data to write, recurse
@@ -170,6 +213,9 @@ func (b *BFile) Write(Data []byte) (update bool, err error) {
 func (b *BFile) WriteAt(offset int64, data []byte) (err error) {
 	// Question: This is only ever used by WriteHeader - is there a reason to
 	// preserve this as a separate function?
+	if b.ReadOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, b.Filename)
+	}
 	if err = b.Open(); err != nil {
 		return err
 	}
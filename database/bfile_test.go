@@ -46,7 +46,7 @@ func TestNewBFile(t *testing.T) {
 	ne := humanize.Comma(numEntries)
 	fmt.Printf("Write %s records\n", ne)
 	fr := NewFastRandom(nil)
-	bFile, err := NewBFile(filename)
+	bFile, err := NewBFile(filename, nil)
 	assert.NoError(t, err, "failed to create BFile")
 	cnt := 0
 	dataCnt := 0
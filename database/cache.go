@@ -0,0 +1,104 @@
+package blockchainDB
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Value cache
+//
+// KFile.Cache keeps the DBBKeys of recent keys, but every KV.Get still reads
+// the value from the values file.  With Options.CacheSize set, the values read
+// are kept in an LRU cache, bounded in bytes and shared by every KV opened
+// with the same Options.
+//
+// Values are cached by where they are: the KV, offset and length.  A values
+// file is only appended to, so a value never changes where it is, while a
+// Put, a Delete, a rollback or a purge points the key somewhere else.  The
+// cache never holds a stale value and never has to be told about writes.
+// Writes held back for views stay in the KVView, above the cache.
+
+const cacheEntrySize = 64 // Bytes of bookkeeping counted against the cache for each value
+
+var kvIDs atomic.Uint64 // Source of KV ids, which keep the values of each KV apart in the cache
+
+// cacheKey
+// Where a value is: the id of its KV, and its offset and length in the values file
+type cacheKey struct {
+	kv     uint64
+	offset uint64
+	length uint64
+}
+
+// cacheEntry
+// A value in the LRU list
+type cacheEntry struct {
+	key   cacheKey
+	value []byte
+}
+
+// valueCache
+// An LRU cache of values, bounded in bytes.  It is safe for concurrent use.
+type valueCache struct {
+	mutex    sync.Mutex
+	maxBytes int64                      // Most bytes the values (and their bookkeeping) may take
+	bytes    int64                      // Bytes the values take now
+	lru      *list.List                 // Entries, the most recently used first
+	entries  map[cacheKey]*list.Element // Entries by where their values are
+	metrics  *Metrics                   // Where hits and misses are counted
+}
+
+// newValueCache
+// Returns an empty cache that holds up to maxBytes
+func newValueCache(maxBytes int64, metrics *Metrics) *valueCache {
+	return &valueCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[cacheKey]*list.Element),
+		metrics:  metrics,
+	}
+}
+
+// get
+// Returns a copy of the cached value, and true if there is one.  A nil cache
+// has nothing.
+func (c *valueCache) get(key cacheKey) (value []byte, ok bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.metrics.CacheMisses.Add(1)
+		return nil, false
+	}
+	c.metrics.CacheHits.Add(1)
+	c.lru.MoveToFront(element)
+	return append([]byte(nil), element.Value.(*cacheEntry).value...), true // The caller is free to change it
+}
+
+// add
+// Cache a copy of the value, dropping the least recently used values to make
+// room.  A value bigger than the whole cache is not cached.
+func (c *valueCache) add(key cacheKey, value []byte) {
+	size := int64(len(value)) + cacheEntrySize
+	if c == nil || size > c.maxBytes {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(element)
+		return
+	}
+	for c.bytes+size > c.maxBytes {
+		oldest := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, oldest.key)
+		c.bytes -= int64(len(oldest.value)) + cacheEntrySize
+	}
+	entry := &cacheEntry{key: key, value: append([]byte(nil), value...)}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.bytes += size
+}
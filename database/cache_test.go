@@ -0,0 +1,137 @@
+package blockchainDB
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueCache(t *testing.T) {
+	metrics := new(Metrics)
+	cache := newValueCache(3*(100+cacheEntrySize), metrics)
+	value := make([]byte, 100)
+	for i := uint64(0); i < 4; i++ {
+		value[0] = byte(i)
+		cache.add(cacheKey{kv: 1, offset: i * 100, length: 100}, value)
+		if i == 2 {
+			_, ok := cache.get(cacheKey{kv: 1, offset: 0, length: 100}) // Now the most recently used
+			assert.True(t, ok, "cached")
+		}
+	}
+	assert.Equal(t, int64(3*(100+cacheEntrySize)), cache.bytes, "full")
+
+	_, ok := cache.get(cacheKey{kv: 1, offset: 100, length: 100})
+	assert.False(t, ok, "the least recently used value was dropped")
+	got, ok := cache.get(cacheKey{kv: 1, offset: 0, length: 100})
+	assert.True(t, ok, "kept")
+	assert.Equal(t, byte(0), got[0], "value")
+	got[0] = 99
+	got, _ = cache.get(cacheKey{kv: 1, offset: 0, length: 100})
+	assert.Equal(t, byte(0), got[0], "callers get copies")
+	_, ok = cache.get(cacheKey{kv: 2, offset: 0, length: 100})
+	assert.False(t, ok, "another KV")
+	assert.Equal(t, uint64(3), metrics.CacheHits.Load(), "hits")
+	assert.Equal(t, uint64(2), metrics.CacheMisses.Load(), "misses")
+
+	cache.add(cacheKey{kv: 1, offset: 1000, length: 1000}, make([]byte, 1000))
+	assert.Equal(t, 3, cache.lru.Len(), "too big to cache")
+
+	var none *valueCache
+	none.add(cacheKey{}, value)
+	_, ok = none.get(cacheKey{})
+	assert.False(t, ok, "no cache")
+}
+
+func TestKVShardCache(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{CacheSize: 1 << 20, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+
+	state := make(map[[32]byte]string)
+	fr := NewFastRandom([]byte{3})
+	for i := 0; i < 100; i++ {
+		key := fr.NextHash()
+		state[key] = fmt.Sprintf("value %d", i)
+		assert.NoError(t, kvs.Put(key, []byte(state[key])), "put")
+	}
+	assert.NoError(t, kvs.Commit(1), "commit")
+	committed := make(map[[32]byte]string)
+	for key, value := range state {
+		committed[key] = value
+	}
+
+	checkKeys(t, kvs, state, "first read")
+	assert.Equal(t, uint64(0), opts.Metrics.CacheHits.Load(), "nothing cached yet")
+	reads := opts.Metrics.Gets.Load()
+	checkKeys(t, kvs, state, "cached")
+	assert.Equal(t, uint64(100), opts.Metrics.CacheHits.Load(), "every value cached")
+	assert.Equal(t, reads, opts.Metrics.Gets.Load(), "no value read from disk")
+
+	i := 0
+	for key := range state {
+		switch i % 3 {
+		case 0:
+			state[key] = "changed"
+			assert.NoError(t, kvs.Put(key, []byte(state[key])), "put")
+		case 1:
+			assert.NoError(t, kvs.Delete(key), "delete")
+			state[key] = ""
+		}
+		i++
+	}
+	checkKeys(t, kvs, state, "after writes")
+	keys := make([][32]byte, 0, len(state))
+	for key := range state {
+		keys = append(keys, key)
+	}
+	values, errs := kvs.MultiGet(keys)
+	for j, key := range keys {
+		if state[key] == "" {
+			assert.Error(t, errs[j], "multi get")
+		} else if assert.NoError(t, errs[j], "multi get") {
+			assert.Equal(t, state[key], string(values[j]), "multi get")
+		}
+	}
+
+	assert.NoError(t, kvs.RollbackTo(1), "rollback")
+	checkKeys(t, kvs, committed, "rolled back")
+	assert.NoError(t, kvs.Close(), "close")
+}
+
+func TestKVViewCache(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{CacheSize: 1 << 20, ViewTimeout: time.Hour, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+	sdbv, err := NewKVView(dir, opts)
+	assert.NoError(t, err, "create KVView")
+
+	key := [32]byte{1}
+	assert.NoError(t, sdbv.Put(key, []byte("old")), "put")
+	for i := 0; i < 2; i++ {
+		value, err := sdbv.Get(key)
+		assert.NoError(t, err, "get")
+		assert.Equal(t, "old", string(value), "get")
+	}
+	assert.Equal(t, uint64(1), opts.Metrics.CacheHits.Load(), "cached")
+
+	view := sdbv.NewView()
+	assert.NoError(t, sdbv.Put(key, []byte("new")), "put")
+	value, err := view.Get(key)
+	assert.NoError(t, err, "view get")
+	assert.Equal(t, "old", string(value), "the view still sees the old value")
+	value, err = sdbv.Get(key)
+	assert.NoError(t, err, "get")
+	assert.Equal(t, "new", string(value), "the database sees the new value")
+	assert.NoError(t, view.Close(), "close view")
+
+	value, err = sdbv.Get(key)
+	assert.NoError(t, err, "get")
+	assert.Equal(t, "new", string(value), "after the view is closed")
+	assert.NoError(t, sdbv.Close(), "close")
+}
@@ -0,0 +1,171 @@
+package blockchainDB
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Checkpoint
+// Write a consistent copy of the KVShard to dir, which must not exist.  The
+// copy is a KVShard that can be opened with OpenKVShard.  Every shard, and
+// the shared PermKV, is locked while the checkpoint is taken, so writes made
+// alongside wait for it, and land either wholly before it or wholly after.
+//
+// Values files are only ever appended to, so they are hard linked into the
+// checkpoint rather than copied, which keeps a checkpoint of even a very large
+// database fast.  The length of each linked file is kept in the checkpoint's
+// manifest; anything the KVShard appends afterwards is past that length, and
+// is ignored.  The kfiles and HistoryFiles are rewritten in place, so they
+// are copied.  If dir is on another file system, values files are copied too.
+// A Prune still running is waited for.
+func (k *KVShard) Checkpoint(dir string) (err error) {
+	if err = k.checkOpen(); err != nil {
+		return err
+	}
+	if _, err = os.Stat(dir); err == nil {
+		return fmt.Errorf("%w: %s", ErrExists, dir)
+	}
+	k.waitPrune()
+	k.segMutex.Lock() // Before the shards, as PutPermIn takes them
+	defer k.segMutex.Unlock()
+	k.lockAll()
+	defer k.unlockAll()
+	for _, kv2 := range k.Shards {
+		if err = kv2.Open(); err != nil {
+			return err
+		}
+		if err = kv2.Flush(); err != nil {
+			return err
+		}
+	}
+	if err = k.syncSegments(); err != nil {
+		return err
+	}
+	if k.Perm != nil {
+		if err = k.Perm.Open(); err != nil {
+			return err
+		}
+		if err = k.Perm.Flush(); err != nil {
+			return err
+		}
+	}
+	manifest, err := ReadManifest(k.Directory)
+	if err != nil {
+		return err
+	}
+	manifest.Links = make(map[string]int64)
+
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir) // Leave no partial checkpoint behind
+		}
+	}()
+	err = filepath.WalkDir(k.Directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(k.Directory, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, rel)
+		switch name := d.Name(); {
+		case d.IsDir():
+			return os.MkdirAll(target, os.ModePerm)
+		case name == lockFilename, name == manifestFilename, name == manifestTmpFilename,
+			name == kTmpFileName, name == valueTmpFilename, name == undoTmpFilename:
+			return nil // Each open takes its own lock, and the manifest is written last
+		case strings.HasSuffix(name, cryptJournalExt):
+			return nil // Only of use to the open file it journals
+		case name == valueFilename:
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if err = os.Link(path, target); err == nil {
+				manifest.Links[filepath.ToSlash(rel)] = info.Size()
+				return nil
+			}
+			return copyFile(path, target, info.Size(), k.opts.Sync) // No link across file systems
+		default:
+			return copyFile(path, target, -1, k.opts.Sync)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	k.opts.logf("checkpoint of %s written to %s", k.Directory, dir)
+	return manifest.Write(dir, k.opts.Sync)
+}
+
+// unshareLinks
+// Give a checkpoint its own copy of each values file it shares with the
+// database it was taken of, so that writes to one never land in the other.
+// Only the part of the file that belongs to the checkpoint is copied.  A file
+// that is no longer shared is just truncated to that length.  Done on the
+// first writable open of a checkpoint; until then, readers use the links.
+//
+// So the first writable open of a checkpoint still shared with its source
+// reads and writes every values file in full, which on a large database takes
+// as long as copying it; open the checkpoint read-only to avoid that, or open
+// it writable once the source is gone, when the files are only truncated.
+func (m *Manifest) unshareLinks(directory string, sync SyncPolicy) (err error) {
+	if len(m.Links) == 0 {
+		return nil
+	}
+	for rel, length := range m.Links {
+		filename := filepath.Join(directory, filepath.FromSlash(rel))
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		if linkCount(info) == 1 {
+			if err = os.Truncate(filename, length); err != nil {
+				return err
+			}
+			continue
+		}
+		tmpName := filepath.Join(filepath.Dir(filename), valueTmpFilename)
+		os.Remove(tmpName) // Left by a crash in an earlier open
+		if err = copyFile(filename, tmpName, length, sync); err != nil {
+			return err
+		}
+		if err = os.Rename(tmpName, filename); err != nil {
+			return err
+		}
+	}
+	m.Links = nil
+	return m.Write(directory, sync)
+}
+
+// copyFile
+// Copy the first length bytes of the file src to a new file dst, or all of
+// src if length is negative
+func copyFile(src, dst string, length int64, sync SyncPolicy) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if length < 0 {
+		_, err = io.Copy(out, in)
+	} else if _, err = io.CopyN(out, in, length); errors.Is(err, io.EOF) {
+		err = fmt.Errorf("%w: %s is shorter than %d bytes", ErrCorrupt, src, length)
+	}
+	if err == nil && sync != SyncNever {
+		err = out.Sync()
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+package blockchainDB
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+	source, checkpoint := filepath.Join(dir, "source"), filepath.Join(dir, "checkpoint")
+
+	opts := &Options{ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1}
+	kvs, err := NewKVShard(source, opts)
+	assert.NoError(t, err, "create KVShard")
+
+	fr := NewFastRandom([]byte{3})
+	keys := make([][32]byte, 1000)
+	for i := range keys {
+		keys[i] = fr.NextHash()
+		if i%2 == 0 {
+			assert.NoError(t, kvs.PutPerm(keys[i], keys[i][:]), "put perm")
+		} else {
+			assert.NoError(t, kvs.Put(keys[i], keys[i][:]), "put")
+		}
+	}
+	assert.NoError(t, kvs.Delete(keys[1]), "delete")
+
+	assert.NoError(t, kvs.Checkpoint(checkpoint), "checkpoint")
+	assert.True(t, errors.Is(kvs.Checkpoint(checkpoint), ErrExists), "a checkpoint needs a new directory")
+
+	manifest, err := ReadManifest(checkpoint)
+	assert.NoError(t, err, "read manifest")
+	assert.Len(t, manifest.Links, 2*opts.ShardCnt, "a perm and a dyna values file per shard")
+	shared := filepath.Join(checkpoint, "Shard0000", DynaDirName, valueFilename)
+	info, err := os.Stat(shared)
+	assert.NoError(t, err, "stat")
+	assert.Equal(t, uint64(2), linkCount(info), "the values file is linked")
+
+	// Later writes to the source are not in the checkpoint
+	for i := range keys[:100] {
+		assert.NoError(t, kvs.Put(keys[i], []byte("changed")), "put")
+	}
+	assert.NoError(t, kvs.Delete(keys[3]), "delete")
+	assert.NoError(t, kvs.Close(), "close")
+
+	check := func(kvs *KVShard) {
+		_, err := kvs.Get(keys[1])
+		assert.Error(t, err, "keys[1] was deleted before the checkpoint")
+		for i, key := range keys {
+			if i == 1 {
+				continue
+			}
+			value, err := kvs.Get(key)
+			assert.NoError(t, err, "get")
+			assert.Equal(t, key[:], value)
+		}
+	}
+
+	reader, err := OpenKVShardReadOnly(checkpoint, opts)
+	assert.NoError(t, err, "open checkpoint read-only")
+	check(reader)
+	assert.NoError(t, reader.Close(), "close")
+	info, err = os.Stat(shared)
+	assert.NoError(t, err, "stat")
+	assert.Equal(t, uint64(2), linkCount(info), "readers use the links")
+
+	// The first writable open gives the checkpoint its own values files
+	cp, err := OpenKVShard(checkpoint, opts)
+	assert.NoError(t, err, "open checkpoint")
+	info, err = os.Stat(shared)
+	assert.NoError(t, err, "stat")
+	assert.Equal(t, uint64(1), linkCount(info), "the values file is no longer shared")
+	assert.Equal(t, manifest.Links["Shard0000/"+DynaDirName+"/"+valueFilename], info.Size(), "only the checkpoint's values are copied")
+	manifest, err = ReadManifest(checkpoint)
+	assert.NoError(t, err, "read manifest")
+	assert.Empty(t, manifest.Links)
+	check(cp)
+	assert.NoError(t, cp.Put(keys[0], []byte("checkpoint")), "put")
+	assert.NoError(t, cp.Close(), "close")
+
+	kvs, err = OpenKVShard(source, opts)
+	assert.NoError(t, err, "open source")
+	value, err := kvs.Get(keys[0])
+	assert.NoError(t, err, "get")
+	assert.Equal(t, []byte("changed"), value, "writes to the checkpoint do not reach the source")
+	_, err = kvs.Get(keys[3])
+	assert.Error(t, err, "keys[3] was deleted in the source")
+
+	// Once the source is gone, a linked file is just cut back to its length
+	checkpoint2 := filepath.Join(dir, "checkpoint2")
+	assert.NoError(t, kvs.Checkpoint(checkpoint2), "checkpoint")
+	assert.NoError(t, kvs.Put(keys[5], []byte("after the checkpoint")), "put")
+	assert.NoError(t, kvs.Close(), "close")
+	manifest, err = ReadManifest(checkpoint2)
+	assert.NoError(t, err, "read manifest")
+	assert.NoError(t, os.RemoveAll(source), "remove source")
+
+	cp, err = OpenKVShard(checkpoint2, opts)
+	assert.NoError(t, err, "open checkpoint")
+	for rel, length := range manifest.Links {
+		info, err = os.Stat(filepath.Join(checkpoint2, rel))
+		assert.NoError(t, err, "stat")
+		assert.Equal(t, length, info.Size(), "values appended after the checkpoint are cut off")
+	}
+	value, err = cp.Get(keys[5])
+	assert.NoError(t, err, "get")
+	assert.Equal(t, []byte("changed"), value)
+	assert.NoError(t, cp.Close(), "close")
+}
+
+func TestCheckpointWhileWriting(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+	source, checkpoint := filepath.Join(dir, "source"), filepath.Join(dir, "checkpoint")
+
+	opts := &Options{SharedPerm: true, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1}
+	kvs, err := NewKVShard(source, opts)
+	assert.NoError(t, err, "create KVShard")
+
+	fr := NewFastRandom([]byte{4})
+	keys := make([][32]byte, 2000)
+	for i := range keys {
+		keys[i] = fr.NextHash()
+	}
+	written := make(chan int)
+	go func() { // Writes keys in order while the checkpoint is taken
+		i := 0
+		for ; i < len(keys); i++ {
+			var err error
+			if i%2 == 0 {
+				err = kvs.PutPerm(keys[i], keys[i][:])
+			} else {
+				err = kvs.Put(keys[i], keys[i][:])
+			}
+			if err != nil {
+				break
+			}
+		}
+		written <- i
+	}()
+	assert.NoError(t, kvs.Checkpoint(checkpoint), "checkpoint")
+	assert.Equal(t, len(keys), <-written, "every write succeeds")
+	assert.NoError(t, kvs.Close(), "close")
+
+	// The checkpoint holds the keys written before it, and none after
+	cp, err := OpenKVShardReadOnly(checkpoint, opts)
+	assert.NoError(t, err, "open checkpoint")
+	missing := -1
+	for i, key := range keys {
+		value, err := cp.Get(key)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			if missing < 0 {
+				missing = i
+			}
+		case assert.NoError(t, err, "get %d", i):
+			assert.Equal(t, key[:], value, "get %d", i)
+			assert.True(t, missing < 0, "key %d is after key %d, which is missing", i, missing)
+		}
+	}
+	assert.NoError(t, cp.Close(), "close")
+}
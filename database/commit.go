@@ -0,0 +1,413 @@
+package blockchainDB
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Block height commits
+//
+// Every KV2 keeps an undo log.  Before a write changes a key, the DynaKV
+// entry of the key (a DBBKey, a tombstone, or cleared if the DynaKV has no
+// entry) is appended to the log.  Values files are only appended to, so the
+// values an old DBBKey points to are still there.  Commit appends a commit
+// marker for the height to the log of every shard, and records the height in
+// the manifest.  RollbackTo reads the log backwards to the marker of the
+// height, putting back each key's old DynaKV entry, and then truncates the
+// log after the marker.
+//
+// PermKV values are immutable and may have been pushed to the HistoryFile, so
+// a key added to the PermKV after the height cannot be removed.  It is hidden
+// by a tombstone in the DynaKV instead, unless the DynaKV already had an entry
+// for the key, which hides it anyway.  The key is also recorded in the revoked
+// file of the KV2, so the blocks rolled back can be replayed: GetPerm of a
+// revoked key reads the layers as Get does, and PutPerm of a new value for it
+// writes the value to the DynaKV.  PutPerm of the value the PermKV holds clears
+// the tombstone.  A key Demote moved to the PermKV after the height is revoked
+// too, and gets its DynaKV entry back; see demote.go.
+
+const (
+	undoFilename    = "undo.dat"        // Undo log in the directory of every KV2
+	revokedFilename = "revoked.dat"     // PermKV keys removed by a rollback, in the directory of a KV2
+	undoRecordSize  = DBKeyFullSize + 1 // A DBBKey with its key, and the kind of record
+
+	undoDyna   byte = 0 // The DynaKV entry of the key before a write to the DynaKV
+	undoPerm   byte = 1 // The DynaKV entry of a key before it was added to the PermKV
+	undoCommit byte = 2 // Commit marker; the Offset is the height
+	undoDemote byte = 3 // The DynaKV entry of a key Demote added to the PermKV
+)
+
+// LastCommittedHeight
+// Returns the height of the last Commit, or 0 if nothing has been committed
+func (k *KVShard) LastCommittedHeight() uint64 {
+	return k.height
+}
+
+// Commit
+// Durably mark the current state of the KVShard as the state at the given
+// block height.  Heights start at 1, and each Commit must be at a height
+// above the last.  Every file of every shard is synced to disk, whatever the
+// Sync policy.
+func (k *KVShard) Commit(height uint64) (err error) {
+	if err = k.checkOpen(); err != nil {
+		return err
+	}
+	if k.opts.readOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	if height <= k.height {
+		return fmt.Errorf("%w: %d is not above the last committed height %d", ErrHeight, height, k.height)
+	}
+	for _, kv2 := range k.Shards {
+		if err = k.commitShard(kv2, height); err != nil {
+			return err
+		}
+	}
+	if err = k.syncPerm(); err != nil {
+		return err
+	}
+	k.segMutex.Lock() // PutPermIn reads the height
+	defer k.segMutex.Unlock()
+	if err = k.syncSegments(); err != nil {
+		return err
+	}
+	if err = k.writeHeight(height); err != nil {
+		return err
+	}
+	k.opts.Metrics.Commits.Add(1)
+	return nil
+}
+
+// commitShard
+// Commit one shard, holding its lock so a Prune can run alongside
+func (k *KVShard) commitShard(kv2 *KV2, height uint64) error {
+	k.lockShard(kv2)
+	defer k.unlockShard(kv2)
+	if err := kv2.Open(); err != nil {
+		return err
+	}
+	return kv2.commit(height)
+}
+
+// syncPerm
+// Sync the shared PermKV, if there is one, to disk
+func (k *KVShard) syncPerm() error {
+	if k.Perm == nil {
+		return nil
+	}
+	k.permMutex.Lock()
+	defer k.permMutex.Unlock()
+	if err := k.Perm.Open(); err != nil {
+		return err
+	}
+	return k.Perm.sync()
+}
+
+// RollbackTo
+// Discard everything written to the KVShard after the Commit at the given
+// height, in both layers of every shard, including writes not yet committed.
+// The height must have been committed, and not pruned; after a RollbackTo, it
+// is the last committed height.  A Prune still running is waited for.
+//
+// The undo log only holds what was flushed to disk, so after a crash, writes
+// made since the last Commit may not all be undone.
+func (k *KVShard) RollbackTo(height uint64) (err error) {
+	if err = k.checkOpen(); err != nil {
+		return err
+	}
+	if k.opts.readOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	if height > k.height {
+		return fmt.Errorf("%w: %d is above the last committed height %d", ErrHeight, height, k.height)
+	}
+	if height < k.prunedBelow() {
+		return fmt.Errorf("%w: %d", ErrPruned, height)
+	}
+	k.waitPrune()
+	k.segMutex.Lock() // PutPermIn reads the height
+	defer k.segMutex.Unlock()
+	k.lockAll() // No Put may land between the undo marks and the rollback
+	defer k.unlockAll()
+	if err = k.checkSealed(height); err != nil {
+		return err
+	}
+	marks := make([]int64, len(k.Shards))
+	for i, kv2 := range k.Shards { // Check every shard can roll back before changing any of them
+		if err = kv2.Open(); err != nil {
+			return err
+		}
+		if marks[i], err = kv2.undoMark(height); err != nil {
+			return err
+		}
+	}
+	for i, kv2 := range k.Shards {
+		if err = kv2.rollback(marks[i], height); err != nil {
+			return err
+		}
+	}
+	if err = k.rollbackSegments(height); err != nil {
+		return err
+	}
+	if err = k.writeHeight(height); err != nil {
+		return err
+	}
+	k.opts.logf("rolled %s back to height %d", k.Directory, height)
+	return nil
+}
+
+// writeHeight
+// Record the last committed height in the manifest, synced to disk
+func (k *KVShard) writeHeight(height uint64) error {
+	manifest, err := ReadManifest(k.Directory)
+	if err != nil {
+		return err
+	}
+	manifest.Height = height
+	if err = manifest.Write(k.Directory, SyncAlways); err != nil {
+		return err
+	}
+	k.height = height
+	return nil
+}
+
+// openUndo
+// Open the undo log of a KV2, creating it if the KV2 was written before undo
+// logs existed.  A partial record at the end, left by a crash, is dropped.  A
+// read-only KV2 writes nothing, and gets no undo log.
+func openUndo(directory string, opts *Options) (undo *BFile, err error) {
+	if opts.readOnly {
+		return nil, nil
+	}
+	filename := filepath.Join(directory, undoFilename)
+	os.Remove(filepath.Join(directory, undoTmpFilename)) // Left by a crash in a Prune
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return NewBFile(filename, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if extra := info.Size() % undoRecordSize; extra != 0 {
+		if err = os.Truncate(filename, info.Size()-extra); err != nil {
+			return nil, err
+		}
+	}
+	return OpenBFile(filename, opts)
+}
+
+// logUndo
+// Append a record of the given kind to the undo log, holding the DynaKV entry
+// the key has before the write that is about to be made
+func (k *KV2) logUndo(kind byte, key [32]byte) error {
+	if k.undo == nil {
+		return nil
+	}
+	prior, err := k.dynaEntry(key)
+	if err != nil {
+		return err
+	}
+	_, err = k.undo.Write(append(prior.Bytes(key), kind))
+	return err
+}
+
+// dynaEntry
+// Returns the DynaKV entry of the key; cleared if the DynaKV has none
+func (k *KV2) dynaEntry(key [32]byte) (dbbKey *DBBKey, err error) {
+	if dbbKey, err = k.DynaKV.kFile.Get(key); err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		return &DBBKey{Offset: clearedOffset}, nil
+	}
+	return dbbKey, nil
+}
+
+// commit
+// Append a commit marker for the height to the undo log, and sync every file
+// of the KV2 to disk
+func (k *KV2) commit(height uint64) (err error) {
+	marker := &DBBKey{Offset: height}
+	if _, err = k.undo.Write(append(marker.Bytes(nilKey), undoCommit)); err != nil {
+		return err
+	}
+	if err = k.sync(); err != nil {
+		return err
+	}
+	k.height = height
+	return nil
+}
+
+// sync
+// Write everything buffered to disk, and sync every file of the KV2
+func (k *KV2) sync() (err error) {
+	if err = k.Flush(); err != nil {
+		return err
+	}
+	if err = k.undo.File.Sync(); err != nil {
+		return err
+	}
+	if !k.sharedPerm { // The owner of a shared PermKV syncs it
+		if err = k.PermKV.sync(); err != nil {
+			return err
+		}
+	}
+	if k.VersKV != nil {
+		if err = k.VersKV.sync(); err != nil {
+			return err
+		}
+	}
+	return k.DynaKV.sync()
+}
+
+// undoMark
+// Returns the offset in the undo log of the commit marker for the height
+func (k *KV2) undoMark(height uint64) (mark int64, err error) {
+	if err = k.undo.Flush(); err != nil {
+		return 0, err
+	}
+	mark = -1
+	err = k.undoRecords(0, func(offset int64, key [32]byte, dbbKey *DBBKey, kind byte) (bool, error) {
+		if kind == undoCommit && dbbKey.Offset == height {
+			mark = offset
+			return true, nil
+		}
+		return false, nil
+	})
+	if err == nil && mark < 0 {
+		err = fmt.Errorf("%w: %d is not in the undo log of %s", ErrHeight, height, k.Directory)
+	}
+	return mark, err
+}
+
+// rollback
+// Undo the writes logged after the commit marker at mark, the marker of the
+// given height, newest first.  Then drop the versions above the height of the
+// keys undone, and drop the writes from the undo log.
+func (k *KV2) rollback(mark int64, height uint64) (err error) {
+	undone := make(map[[32]byte]struct{})
+	var revoked, demoted [][32]byte
+	err = k.undoRecords(mark+undoRecordSize, func(offset int64, key [32]byte, dbbKey *DBBKey, kind byte) (bool, error) {
+		if kind != undoCommit {
+			undone[key] = struct{}{}
+		}
+		switch {
+		case kind == undoCommit: // A later commit is undone along with its writes
+		case kind == undoPerm && dbbKey.IsCleared():
+			revoked = append(revoked, key)
+			return false, k.DynaKV.kFile.Put(key, &DBBKey{Offset: tombstoneOffset}) // Hide the PermKV key
+		case kind == undoDemote:
+			revoked = append(revoked, key)
+			demoted = append(demoted, key)
+			return false, k.DynaKV.kFile.Put(key, dbbKey)
+		default:
+			return false, k.DynaKV.kFile.Put(key, dbbKey)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range demoted { // Hide the PermKV key if the rollback reached its first write
+		if dbbKey, err := k.dynaEntry(key); err != nil {
+			return err
+		} else if dbbKey.IsCleared() {
+			if err = k.DynaKV.kFile.Put(key, &DBBKey{Offset: tombstoneOffset}); err != nil {
+				return err
+			}
+		}
+	}
+	if k.VersKV != nil {
+		for key := range undone {
+			if err = k.trimVersions(key, height); err != nil {
+				return err
+			}
+		}
+	}
+	if err = k.revoke(revoked); err != nil {
+		return err
+	}
+	k.height = height
+	if err = k.sync(); err != nil { // The undone state has to be on disk before the log is cut
+		return err
+	}
+	end := mark + undoRecordSize
+	if err = k.undo.File.Truncate(end); err != nil {
+		return err
+	}
+	k.undo.EOD = uint64(end)
+	return k.undo.File.Sync()
+}
+
+// revoke
+// Record the PermKV keys a rollback removed, synced to disk
+func (k *KV2) revoke(keys [][32]byte) (err error) {
+	if len(keys) == 0 {
+		return nil
+	}
+	file, err := os.OpenFile(filepath.Join(k.Directory, revokedFilename), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	buff := make([]byte, 0, len(keys)*32)
+	for _, key := range keys {
+		buff = append(buff, key[:]...)
+		if k.revoked == nil {
+			k.revoked = make(map[[32]byte]bool)
+		}
+		k.revoked[key] = true
+	}
+	if _, err = file.Write(buff); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// loadRevoked
+// Returns the PermKV keys rollbacks removed from the KV2 in the directory.  A
+// partial key at the end, left by a crash, is ignored; the rollback is redone.
+func loadRevoked(directory string) (revoked map[[32]byte]bool, err error) {
+	data, err := os.ReadFile(filepath.Join(directory, revokedFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	revoked = make(map[[32]byte]bool)
+	for i := 0; i+32 <= len(data); i += 32 {
+		revoked[[32]byte(data[i:])] = true
+	}
+	return revoked, nil
+}
+
+// undoRecords
+// Call fn for each record in the undo log at or after offset from, newest
+// first, until fn returns true or an error
+func (k *KV2) undoRecords(from int64, fn func(offset int64, key [32]byte, dbbKey *DBBKey, kind byte) (stop bool, err error)) error {
+	const chunk = 1024 * undoRecordSize // Records read at a time
+	buff := make([]byte, chunk)
+	for end := int64(k.undo.EOD); end > from; {
+		start := max(end-chunk, from)
+		records := buff[:end-start]
+		if _, err := k.undo.File.ReadAt(records, start); err != nil {
+			return err
+		}
+		for i := len(records) - undoRecordSize; i >= 0; i -= undoRecordSize {
+			key, dbbKey, err := GetDBBKey(records[i:])
+			if err != nil {
+				return err
+			}
+			if stop, err := fn(start+int64(i), key, dbbKey, records[i+DBKeyFullSize]); stop || err != nil {
+				return err
+			}
+		}
+		end = start
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package blockchainDB
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommitRollback(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BufferSize: 4096, MaxCachedBlocks: 1, BloomSize: .1} // Rebins and pushes to history often
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+	assert.Equal(t, uint64(0), kvs.LastCommittedHeight())
+
+	// The oracle holds what Get should return for every key, "" if not found
+	oracle := make(map[[32]byte]string)
+	snapshots := make(map[uint64]map[[32]byte]string)
+	var keys [][32]byte
+	check := func(kvs *KVShard, state map[[32]byte]string, what string) {
+		for _, key := range keys {
+			value, err := kvs.Get(key)
+			if state[key] == "" {
+				assert.Error(t, err, what)
+			} else if assert.NoError(t, err, what) {
+				assert.Equal(t, state[key], string(value), what)
+			}
+		}
+	}
+
+	fr := NewFastRandom([]byte{4})
+	block := func(height uint64) {
+		for i := 0; i < 400; i++ {
+			var key [32]byte
+			switch r := fr.UintN(10); {
+			case r < 4 || len(keys) == 0: // A new key, perm or not
+				key = fr.NextHash()
+				keys = append(keys, key)
+				value := fmt.Sprintf("new %x at %d", key[:4], height)
+				if r%2 == 0 {
+					assert.NoError(t, kvs.PutPerm(key, []byte(value)), "put perm")
+				} else {
+					assert.NoError(t, kvs.Put(key, []byte(value)), "put")
+				}
+				oracle[key] = value
+			case r < 8: // Change a key
+				key = keys[fr.UintN(uint(len(keys)))]
+				value := fmt.Sprintf("%x at %d/%d", key[:4], height, i)
+				assert.NoError(t, kvs.Put(key, []byte(value)), "put")
+				oracle[key] = value
+			default: // Delete a key
+				key = keys[fr.UintN(uint(len(keys)))]
+				assert.NoError(t, kvs.Delete(key), "delete")
+				oracle[key] = ""
+			}
+		}
+	}
+	snapshot := func() map[[32]byte]string {
+		state := make(map[[32]byte]string, len(oracle))
+		for key, value := range oracle {
+			state[key] = value
+		}
+		return state
+	}
+
+	for height := uint64(1); height <= 5; height++ {
+		block(height)
+		assert.NoError(t, kvs.Commit(height), "commit")
+		snapshots[height] = snapshot()
+	}
+	assert.ErrorIs(t, kvs.Commit(5), ErrHeight, "heights must go up")
+	assert.Equal(t, uint64(5), kvs.LastCommittedHeight())
+
+	// Uncommitted writes are discarded by a rollback to the last height
+	block(6)
+	assert.NoError(t, kvs.RollbackTo(5), "rollback")
+	check(kvs, snapshots[5], "rollback to the last height")
+
+	// Roll back past two heights, then build a different chain from there
+	assert.NoError(t, kvs.RollbackTo(3), "rollback")
+	assert.Equal(t, uint64(3), kvs.LastCommittedHeight())
+	check(kvs, snapshots[3], "rollback to height 3")
+	assert.ErrorIs(t, kvs.RollbackTo(4), ErrHeight, "height 4 was rolled back")
+	assert.ErrorIs(t, kvs.RollbackTo(0), ErrHeight, "height 0 was never committed")
+
+	oracle = snapshots[3] // Keys added after height 3 are not in it, so are not found
+	snapshots[3] = snapshot()
+	block(4)
+	assert.NoError(t, kvs.Commit(4), "commit")
+	snapshots[4] = snapshot()
+
+	// A key added to the PermKV after a height is hidden by a rollback, and
+	// can be put again
+	key := fr.NextHash()
+	keys = append(keys, key)
+	assert.NoError(t, kvs.PutPerm(key, []byte("perm")), "put perm")
+	assert.NoError(t, kvs.RollbackTo(4), "rollback")
+	_, err = kvs.Get(key)
+	assert.Error(t, err, "the perm key is hidden")
+	assert.NoError(t, kvs.PutPerm(key, []byte("perm")), "put perm")
+	value, err := kvs.Get(key)
+	assert.NoError(t, err, "get")
+	assert.Equal(t, []byte("perm"), value, "PutPerm makes the key visible again")
+	assert.NoError(t, kvs.RollbackTo(4), "rollback")
+	check(kvs, snapshots[4], "rollback to height 4")
+	assert.NoError(t, kvs.Close(), "close")
+
+	// The height and the undo log survive a reopen
+	kvs, err = OpenKVShard(dir, opts)
+	assert.NoError(t, err, "open")
+	assert.Equal(t, uint64(4), kvs.LastCommittedHeight())
+	check(kvs, snapshots[4], "reopen")
+	assert.NoError(t, kvs.RollbackTo(2), "rollback")
+	check(kvs, snapshots[2], "rollback after reopen")
+	assert.NoError(t, kvs.Close(), "close")
+
+	reader, err := OpenKVShardReadOnly(dir, opts)
+	assert.NoError(t, err, "open read-only")
+	assert.Equal(t, uint64(2), reader.LastCommittedHeight())
+	assert.Error(t, reader.Commit(3), "a reader cannot commit")
+	assert.NoError(t, reader.Close(), "close")
+}
+
+func TestRollbackReplay(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+	fr := NewFastRandom([]byte{12})
+	same, changed := fr.NextHash(), fr.NextHash()
+	assert.NoError(t, kvs.Commit(1), "commit")
+	assert.NoError(t, kvs.PutPerm(same, []byte("same")), "put perm")
+	assert.NoError(t, kvs.PutPerm(changed, []byte("bad")), "put perm")
+	assert.NoError(t, kvs.Commit(2), "commit")
+	assert.NoError(t, kvs.RollbackTo(1), "rollback")
+
+	check := func(key [32]byte, want string, what string) {
+		value, err := kvs.Get(key)
+		perm, errPerm := kvs.GetPerm(key)
+		_, ok, errHas := kvs.Has(key)
+		assert.NoError(t, errHas, what)
+		if want == "" {
+			assert.ErrorIs(t, err, ErrNotFound, what)
+			assert.ErrorIs(t, errPerm, ErrNotFound, "%s: GetPerm", what)
+			assert.False(t, ok, what)
+			return
+		}
+		assert.NoError(t, err, what)
+		assert.Equal(t, want, string(value), what)
+		assert.NoError(t, errPerm, what)
+		assert.Equal(t, want, string(perm), "%s: GetPerm", what)
+		assert.True(t, ok, what)
+	}
+	check(same, "", "rolled back")
+	check(changed, "", "rolled back")
+
+	// The block is replayed, with a different value for one of the keys
+	assert.NoError(t, kvs.PutPerm(same, []byte("same")), "replay")
+	assert.NoError(t, kvs.PutPerm(changed, []byte("good")), "replay with a new value")
+	assert.NoError(t, kvs.PutPerm(changed, []byte("good")), "replayed twice")
+	check(same, "same", "replayed")
+	check(changed, "good", "replayed")
+	assert.NoError(t, kvs.Commit(2), "commit")
+	assert.NoError(t, kvs.Close(), "close")
+
+	kvs, err = OpenKVShard(dir, opts)
+	assert.NoError(t, err, "open")
+	check(same, "same", "reopened")
+	check(changed, "good", "reopened")
+	assert.NoError(t, kvs.RollbackTo(1), "rollback the replay")
+	check(same, "", "replay rolled back")
+	check(changed, "", "replay rolled back")
+	assert.NoError(t, kvs.Close(), "close")
+}
+
+func TestRollbackConcurrent(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	kvs, err := NewKVShard(dir, &Options{ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1})
+	assert.NoError(t, err, "create KVShard")
+	committed := make(map[[32]byte]string)
+	fr := NewFastRandom([]byte{11})
+	for i := 0; i < 100; i++ {
+		key := fr.NextHash()
+		committed[key] = fmt.Sprintf("committed %d", i)
+		assert.NoError(t, kvs.PutDyna(key, []byte(committed[key])), "put")
+	}
+	assert.NoError(t, kvs.Commit(1), "commit")
+
+	// Writers keep going while the KVShard is rolled back
+	var written [][32]byte
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fr := NewFastRandom([]byte{12})
+		for i := 0; i < 500; i++ {
+			key := fr.NextHash()
+			written = append(written, key)
+			assert.NoError(t, kvs.PutDyna(key, []byte(fmt.Sprintf("written %d", i))), "put")
+		}
+	}()
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	for rolling := true; rolling; {
+		assert.NoError(t, kvs.RollbackTo(1), "rollback")
+		select {
+		case <-done:
+			rolling = false
+		default:
+		}
+	}
+	assert.NoError(t, kvs.RollbackTo(1), "rollback what is left")
+	checkKeys(t, kvs, committed, "committed")
+	for _, key := range written {
+		_, err := kvs.Get(key)
+		assert.ErrorIs(t, err, ErrNotFound, "written after the commit")
+	}
+	assert.NoError(t, kvs.Close(), "close")
+}
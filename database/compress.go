@@ -0,0 +1,338 @@
+package blockchainDB
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Value compression
+//
+// Transaction and state values compress well.  With Options.Compression set,
+// KV.Put compresses each value with flate, and keeps the compressed bytes if
+// they are smaller.  The DBBKey of the value records that it is compressed,
+// with both lengths (see keys.go), so compressed and raw values sit side by
+// side in a values file and Has still reports the length of the value.  Get
+// decompresses the values it reads.  An encrypted KV compresses a value
+// before sealing it; see crypt.go.
+//
+// Each KV has its own setting.  The PermKV of a KV2 takes PermCompression, so
+// the PermKV and the DynaKV can choose differently.
+//
+// Values written before compression was turned on stay as they are.  The
+// PermKV is compressed as PurgePerm rebuilds it.  A values file is only
+// appended to, and the undo log and the versions point into it, so nothing
+// rewrites the values of a DynaKV in place.  AppendReencoded appends the
+// compressed values and points the keys at them, leaving the raw copies for
+// the undo log and the versions: the file only grows, so it is never run by
+// Compress, only when asked for.
+
+// Compression
+// How a KV compresses the values it writes
+type Compression int
+
+const (
+	CompressNone  Compression = iota // Values are written as they are (default)
+	CompressFlate                    // Values are compressed with flate when it makes them smaller
+)
+
+const (
+	compressMin = 64      // Values shorter than this are not worth compressing
+	compressMax = 1 << 30 // Values this long or longer are never compressed; see compressedFlag
+)
+
+var flateWriters = sync.Pool{New: func() any { // Writers are big; reuse them
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+var flateReaders = sync.Pool{New: func() any {
+	return flate.NewReader(nil)
+}}
+
+// compress
+// Returns the value compressed, and true, if compressing makes it smaller
+func compress(value []byte) (compressed []byte, ok bool) {
+	if len(value) < compressMin || len(value) >= compressMax {
+		return value, false
+	}
+	var buffer bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buffer)
+	if _, err := w.Write(value); err != nil { // Writes to a bytes.Buffer never fail
+		return value, false
+	}
+	if err := w.Close(); err != nil || buffer.Len() >= len(value) {
+		return value, false
+	}
+	return buffer.Bytes(), true
+}
+
+// decompress
+// Returns the value of the given length that compress returned
+func decompress(compressed []byte, length uint64) (value []byte, err error) {
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	if err = r.(flate.Resetter).Reset(bytes.NewReader(compressed), nil); err != nil {
+		return nil, err
+	}
+	value = make([]byte, length)
+	if _, err = io.ReadFull(r, value); err != nil {
+		return nil, fmt.Errorf("%w: decompressing a value of %d bytes: %v", ErrCorrupt, length, err)
+	}
+	return value, nil
+}
+
+// valueAAD
+// Additional data of an encrypted value, which binds it to its offset
+func valueAAD(offset uint64) []byte {
+	var aad [8]byte
+	binary.BigEndian.PutUint64(aad[:], offset)
+	return aad[:]
+}
+
+// encodeValue
+// Returns the bytes to write at the offset of the values file for the value,
+// compressed and sealed as the KV says, and the Length of its DBBKey
+func (k *KV) encodeValue(offset uint64, value []byte) (stored []byte, length uint64, err error) {
+	stored = value
+	compressed := false
+	if k.opts.Compression != CompressNone {
+		stored, compressed = compress(value)
+	}
+	if k.crypt != nil {
+		if stored, err = k.crypt.seal(valueAAD(offset), stored); err != nil {
+			return nil, 0, err
+		}
+		length |= encryptedFlag
+	}
+	length |= uint64(len(stored))
+	if compressed {
+		length |= compressedFlag | uint64(len(value))<<32
+	}
+	return stored, length, nil
+}
+
+// decodeValue
+// Returns the value from the bytes the DBBKey points to in the values file
+func (k *KV) decodeValue(dbbKey *DBBKey, stored []byte) (value []byte, err error) {
+	if dbbKey.IsEncrypted() {
+		if k.crypt == nil {
+			return nil, fmt.Errorf("%w: %s is not encrypted, but holds an encrypted value", ErrCorrupt, k.Directory)
+		}
+		if stored, err = k.crypt.open(valueAAD(dbbKey.Offset), stored); err != nil {
+			return nil, err
+		}
+	}
+	if !dbbKey.IsCompressed() {
+		return stored, nil
+	}
+	return decompress(stored, dbbKey.ValueLength())
+}
+
+// AppendReencoded
+// Append a copy of each value the KV holds in another form than Put would now
+// write: raw values that would be compressed, and values sealed with a key
+// that is no longer current.  The keys then point to the copies, and the
+// kfile is rebinned under the current key.  The old bytes stay, so the values
+// file grows by the size of the copies.  Returns the number of values copied.
+// A KV with history keeps its values as they are.
+func (k *KV) AppendReencoded() (rewritten int, err error) {
+	if k.opts.readOnly {
+		return 0, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	if k.UseHistory {
+		return 0, nil
+	}
+	stale, err := k.staleKeys()
+	if err != nil {
+		return 0, err
+	}
+	if k.opts.Compression == CompressNone && !stale {
+		return 0, nil
+	}
+	if err = k.Flush(); err != nil {
+		return 0, err
+	}
+	keyValues, keyList, err := k.kFile.GetKeyList()
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keyList {
+		dbbKey := keyValues[key]
+		if dbbKey.IsDeleted() || dbbKey.IsCleared() {
+			continue
+		}
+		length := dbbKey.ValueLength()
+		compressible := k.opts.Compression != CompressNone && !dbbKey.IsCompressed() &&
+			length >= compressMin && length < compressMax
+		if !compressible && !stale {
+			continue
+		}
+		stored := make([]byte, dbbKey.Size())
+		if err = k.vFile.ReadAt(dbbKey.Offset, stored); err != nil {
+			return rewritten, err
+		}
+		rekey := false
+		if stale && dbbKey.IsEncrypted() {
+			current, _, err := k.crypt.keys.Current()
+			if err != nil {
+				return rewritten, err
+			}
+			rekey = sealedWith(stored) != current
+		}
+		if !compressible && !rekey {
+			continue
+		}
+		value, err := k.decodeValue(dbbKey, stored)
+		if err != nil {
+			return rewritten, err
+		}
+		offset, err := k.vFile.Offset()
+		if err != nil {
+			return rewritten, err
+		}
+		stored, newLength, err := k.encodeValue(offset, value)
+		if err != nil {
+			return rewritten, err
+		}
+		recompressed := newLength&compressedFlag != 0 && !dbbKey.IsCompressed()
+		if !recompressed && !rekey { // Compressing does not make it smaller
+			continue
+		}
+		if _, err = k.vFile.Write(stored); err != nil {
+			return rewritten, err
+		}
+		k.opts.Metrics.BytesWritten.Add(uint64(len(stored)))
+		if err = k.kFile.Put(key, &DBBKey{Offset: offset, Length: newLength}); err != nil {
+			return rewritten, err
+		}
+		if recompressed {
+			k.opts.Metrics.Recompressed.Add(1)
+		}
+		if rekey {
+			k.opts.Metrics.Reencrypted.Add(1)
+		}
+		rewritten++
+	}
+	if err = k.Flush(); err != nil {
+		return rewritten, err
+	}
+	if !stale {
+		return rewritten, nil
+	}
+	if err = k.kFile.Rebin(); err != nil { // The new kfile is sealed with the current key
+		return rewritten, err
+	}
+	if err = k.sync(); err != nil { // All of it, before crypt.dat says so
+		return rewritten, err
+	}
+	return rewritten, k.crypt.writeCheck(k.Directory, k.opts.Sync)
+}
+
+// staleKeys
+// Returns true if the KV is encrypted, and may hold data sealed with a key
+// that is no longer current
+func (k *KV) staleKeys() (bool, error) {
+	if k.crypt == nil {
+		return false, nil
+	}
+	return k.crypt.stale()
+}
+
+// keepEncryption
+// Returns the options for a KV that replaces this one: encrypted only if this
+// one is
+func (k *KV) keepEncryption(opts *Options) *Options {
+	if k.crypt == nil {
+		opts.Keys = nil
+	}
+	return opts
+}
+
+// AppendReencoded
+// Append reencoded copies of the values of the DynaKV and the VersKV; see
+// KV.AppendReencoded
+func (k *KV2) AppendReencoded() (rewritten int, err error) {
+	if err = k.Flush(); err != nil {
+		return 0, err
+	}
+	if rewritten, err = k.DynaKV.AppendReencoded(); err != nil || k.VersKV == nil {
+		return rewritten, err
+	}
+	n, err := k.rekeyChunks()
+	if err != nil {
+		return rewritten, err
+	}
+	rewritten += n
+	n, err = k.VersKV.AppendReencoded()
+	return rewritten + n, err
+}
+
+// rekeyChunks
+// Rewrite under the current key the versions of each key that has older
+// chunks, which KV.AppendReencoded does not see; see versions.go
+func (k *KV2) rekeyChunks() (rewritten int, err error) {
+	if stale, err := k.VersKV.staleKeys(); err != nil || !stale {
+		return 0, err
+	}
+	keyValues, keyList, err := k.VersKV.kFile.GetKeyList()
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keyList {
+		if dbbKey := keyValues[key]; dbbKey.IsDeleted() || dbbKey.IsCleared() {
+			continue
+		}
+		head, err := k.headChunk(key)
+		if err != nil {
+			return rewritten, err
+		}
+		if head.prev == nil {
+			continue
+		}
+		if err = k.rewriteChunks(key, 0, k.VersKV); err != nil {
+			return rewritten, err
+		}
+		k.opts.Metrics.Reencrypted.Add(1)
+		rewritten++
+	}
+	return rewritten, k.VersKV.Flush()
+}
+
+// AppendReencoded
+// Append reencoded copies of the values of the DynaKV and VersKV of every
+// shard; see KV.AppendReencoded.  Returns the number of values copied.
+func (k *KVShard) AppendReencoded() (rewritten int, err error) {
+	if err = k.checkOpen(); err != nil {
+		return 0, err
+	}
+	if k.opts.readOnly {
+		return 0, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	k.waitPrune()
+	for _, kv2 := range k.Shards {
+		n, err := k.appendReencodedShard(kv2)
+		rewritten += n
+		if err != nil {
+			return rewritten, err
+		}
+	}
+	return rewritten, nil
+}
+
+// appendReencodedShard
+// Append reencoded values to the DynaKV and VersKV of one shard, holding its
+// lock
+func (k *KVShard) appendReencodedShard(kv2 *KV2) (rewritten int, err error) {
+	k.lockShard(kv2)
+	defer k.unlockShard(kv2)
+	if err = kv2.Open(); err != nil {
+		return 0, err
+	}
+	return kv2.AppendReencoded()
+}
@@ -0,0 +1,201 @@
+package blockchainDB
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// compressible
+// Returns a value of about n bytes that flate shrinks
+func compressible(i, n int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("value %d ", i)), n/8)
+}
+
+func TestCompressKV(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{Compression: CompressFlate, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+	kv, err := NewKV(dir, opts)
+	assert.NoError(t, err, "create kv")
+
+	fr := NewFastRandom([]byte{5})
+	values := map[[32]byte][]byte{
+		fr.NextHash(): compressible(1, 1000),
+		fr.NextHash(): []byte("short"),
+		fr.NextHash(): fr.RandBuff(1000, 1000), // Does not compress
+		fr.NextHash(): {},
+	}
+	for key, value := range values {
+		assert.NoError(t, kv.Put(key, value), "put")
+	}
+	assert.Less(t, opts.Metrics.BytesWritten.Load(), uint64(2000), "the compressible value was compressed")
+
+	check := func(what string) {
+		for key, value := range values {
+			got, err := kv.Get(key)
+			assert.NoError(t, err, what)
+			assert.Equal(t, value, got, what)
+			length, ok, err := kv.Has(key)
+			assert.NoError(t, err, what)
+			assert.True(t, ok, what)
+			assert.Equal(t, uint64(len(value)), length, "%s: length of the value, not of what is stored", what)
+
+			dbbKey, err := kv.kFile.Get(key)
+			assert.NoError(t, err, what)
+			assert.Equal(t, len(value) == 1000 && value[0] == 'v', dbbKey.IsCompressed(), what)
+		}
+		keys := make([][32]byte, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		got, errs := kv.MultiGet(keys)
+		for i, key := range keys {
+			assert.NoError(t, errs[i], what)
+			assert.Equal(t, values[key], got[i], what)
+		}
+	}
+	check("compressed")
+	assert.NoError(t, kv.Close(), "close")
+
+	// Raw and compressed values live side by side
+	kv, err = OpenKV(dir, &Options{Metrics: new(Metrics)})
+	assert.NoError(t, err, "open kv")
+	check("reopened without compression")
+	key := fr.NextHash()
+	values[key] = compressible(2, 1000)
+	assert.NoError(t, kv.Put(key, values[key]), "put")
+	dbbKey, err := kv.kFile.Get(key)
+	assert.NoError(t, err, "get key")
+	assert.False(t, dbbKey.IsCompressed(), "written raw")
+	assert.NoError(t, kv.Close(), "close")
+
+	kv, err = OpenKV(dir, opts)
+	assert.NoError(t, err, "open kv")
+	n, err := kv.AppendReencoded()
+	assert.NoError(t, err, "append reencoded")
+	assert.Equal(t, 1, n, "only the raw value that compresses")
+	assert.Equal(t, uint64(1), opts.Metrics.Recompressed.Load(), "metrics")
+	check("recompressed")
+	assert.NoError(t, kv.Close(), "close")
+}
+
+func TestCompressLayers(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{PermCompression: CompressFlate, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+
+	state := make(map[[32]byte]string)
+	fr := NewFastRandom([]byte{6})
+	for i := 0; i < 100; i++ {
+		key := fr.NextHash()
+		state[key] = string(compressible(i, 200))
+		assert.NoError(t, kvs.PutPerm(key, []byte(state[key])), "put perm")
+		if i%2 == 0 {
+			state[key] = string(compressible(-i, 200))
+			assert.NoError(t, kvs.PutDyna(key, []byte(state[key])), "put dyna")
+		}
+	}
+	assert.NoError(t, kvs.Commit(1), "commit")
+	committed := make(map[[32]byte]string)
+	for key, value := range state {
+		committed[key] = value
+	}
+	layers := func(perm, dyna bool) {
+		for key := range state {
+			kv2, err := kvs.shard(key)
+			assert.NoError(t, err, "shard")
+			if dbbKey, err := kv2.PermKV.kFile.Get(key); assert.NoError(t, err, "perm key") {
+				assert.Equal(t, perm, dbbKey.IsCompressed(), "PermKV")
+			}
+			if dbbKey, err := kv2.dynaEntry(key); err == nil && !dbbKey.IsCleared() {
+				assert.Equal(t, dyna, dbbKey.IsCompressed(), "DynaKV")
+			}
+			kvs.unlockShard(kv2)
+		}
+	}
+	layers(true, false)
+	checkKeys(t, kvs, state, "written")
+	assert.NoError(t, kvs.Close(), "close")
+
+	// Compress leaves the DynaKV values alone; AppendReencoded copies them compressed
+	opts.Compression = CompressFlate
+	kvs, err = OpenKVShard(dir, opts)
+	assert.NoError(t, err, "open")
+	assert.NoError(t, kvs.Compress(), "compress")
+	assert.Equal(t, uint64(0), opts.Metrics.Recompressed.Load(), "compress appends nothing")
+	layers(true, false)
+	n, err := kvs.AppendReencoded()
+	assert.NoError(t, err, "append reencoded")
+	assert.Equal(t, 50, n, "the DynaKV values")
+	assert.Equal(t, uint64(50), opts.Metrics.Recompressed.Load(), "the DynaKV values")
+	layers(true, true)
+	checkKeys(t, kvs, state, "recompressed")
+
+	for key := range state {
+		state[key] = "changed"
+		assert.NoError(t, kvs.Put(key, []byte(state[key])), "put")
+	}
+	checkKeys(t, kvs, state, "changed")
+	assert.NoError(t, kvs.RollbackTo(1), "rollback")
+	checkKeys(t, kvs, committed, "rolled back")
+	assert.NoError(t, kvs.Close(), "close")
+}
+
+func TestCompressPerm(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+	state := make(map[[32]byte]string)
+	fr := NewFastRandom([]byte{7})
+	for i := 0; i < 100; i++ {
+		key := fr.NextHash()
+		state[key] = string(compressible(i, 200))
+		assert.NoError(t, kvs.PutPerm(key, []byte(state[key])), "put perm")
+	}
+	assert.NoError(t, kvs.Close(), "close")
+
+	// Compress rebuilds the PermKVs compressed, as PurgePerm does
+	opts.PermCompression = CompressFlate
+	kvs, err = OpenKVShard(dir, opts)
+	assert.NoError(t, err, "open")
+	assert.NoError(t, kvs.Compress(), "compress")
+	for key := range state {
+		kv2, err := kvs.shard(key)
+		assert.NoError(t, err, "shard")
+		if dbbKey, err := kv2.PermKV.kFile.Get(key); assert.NoError(t, err, "perm key") {
+			assert.True(t, dbbKey.IsCompressed(), "PermKV")
+		}
+		kvs.unlockShard(kv2)
+	}
+	checkKeys(t, kvs, state, "compressed")
+	assert.NoError(t, kvs.Close(), "close")
+}
+
+func TestDBBKeyCompressed(t *testing.T) {
+	raw := &DBBKey{Offset: 10, Length: 300}
+	assert.False(t, raw.IsCompressed(), "raw")
+	assert.Equal(t, uint64(300), raw.Size(), "size")
+	assert.Equal(t, uint64(300), raw.ValueLength(), "length")
+
+	compressed := &DBBKey{Offset: 10, Length: compressedFlag | 300<<32 | 40}
+	assert.True(t, compressed.IsCompressed(), "compressed")
+	assert.Equal(t, uint64(40), compressed.Size(), "size")
+	assert.Equal(t, uint64(300), compressed.ValueLength(), "length")
+
+	_, got, err := GetDBBKey(compressed.Bytes([32]byte{1}))
+	assert.NoError(t, err, "unmarshal")
+	assert.Equal(t, compressed, got, "round trip")
+
+	_, err = decompress([]byte("not flate"), 300)
+	assert.ErrorIs(t, err, ErrCorrupt, "corrupt")
+}
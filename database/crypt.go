@@ -0,0 +1,756 @@
+package blockchainDB
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Encryption at rest
+//
+// With Options.Keys set, a new KV is encrypted with AES-GCM.  Each value in
+// the values file is sealed on its own, with its offset as additional data,
+// so a value cannot be moved or cut short without failing authentication.
+// The kfile and the HistoryFile are sealed in blocks of cryptBlockSize bytes,
+// each with the id of the file and its position in the file as additional
+// data, which authenticates the offsets and lengths of the keys.  A journal
+// keeps a crash in the middle of resealing a block from losing what was
+// synced; see cryptFile.  The keys stay 32-byte hashes, so the
+// bins and Bloom filters work as before.  The undo log is not encrypted: it
+// holds keys and offsets only, and any offset it restores is checked when the
+// value is read.  Segments are made to be shared, so an encrypted KVShard
+// keeps none; see segments.go.
+//
+// Everything sealed starts with the id of the key that sealed it.  The
+// KeyProvider gives the current key, which seals new data, and any older key
+// by id.  To rotate, make a new key current; KVShard.Compress rebuilds the
+// PermKVs under it, and KVShard.AppendReencoded re-encrypts the DynaKVs and
+// VersKVs (see KV.AppendReencoded).
+// Undo records and versions still point to values sealed with old keys, so
+// keep a retired key until Prune has dropped the heights written with it.
+//
+// A KV is encrypted if it was created with Keys set; its directory then holds
+// crypt.dat, which is sealed with the key the KV was last re-encrypted with.
+// Opening an encrypted KV without Keys fails with ErrNoKey, and with the
+// wrong keys with ErrCorrupt.  A KV created without Keys stays plain.
+
+const (
+	keyCheckFilename    = "crypt.dat"     // Marks an encrypted KV, and checks its keys
+	keyCheckTmpFilename = "crypt_tmp.dat" // crypt.dat under construction
+	cryptBlockSize      = 4096            // Bytes of plaintext in each block of an encrypted file
+	sealOverhead        = 4 + 12 + 16     // The key id, nonce and tag added to what is sealed
+	cryptPhysicalBlock  = cryptBlockSize + sealOverhead
+	cryptFileHeader     = 16               // The random id at the start of an encrypted file
+	cryptJournalExt     = ".journal"       // Added to the name of an encrypted file for its journal
+	journalHeaderSize   = 8 + sealOverhead // The sealed size at the last Sync
+	journalEntryHeader  = 8 + 4            // The index and length of a saved block
+)
+
+var keyCheckAAD = []byte("BlockchainDB key check") // Additional data of crypt.dat
+
+// KeyProvider
+// Supplies the AES keys (16, 24 or 32 bytes) that encrypt a database.  Current
+// is called for everything sealed, so it should be cheap.
+type KeyProvider interface {
+	Current() (id uint32, key []byte, err error) // The key new data is sealed with
+	Key(id uint32) (key []byte, err error)       // The key with the id, current or retired
+}
+
+// KeyRing
+// A KeyProvider that holds its keys in memory.  It is safe for concurrent use.
+type KeyRing struct {
+	mutex   sync.RWMutex
+	current uint32
+	keys    map[uint32][]byte
+}
+
+// NewKeyRing
+// Returns a KeyRing with one key, which is current
+func NewKeyRing(id uint32, key []byte) (ring *KeyRing, err error) {
+	ring = &KeyRing{keys: make(map[uint32][]byte)}
+	if err = ring.Rotate(id, key); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// Rotate
+// Add the key and make it current.  The keys it replaces are kept.
+func (r *KeyRing) Rotate(id uint32, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if old, ok := r.keys[id]; ok && string(old) != string(key) {
+		return fmt.Errorf("%w: key %d is already in the ring", ErrExists, id)
+	}
+	r.keys[id] = append([]byte(nil), key...)
+	r.current = id
+	return nil
+}
+
+// Current
+// Returns the current key
+func (r *KeyRing) Current() (id uint32, key []byte, err error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.current, r.keys[r.current], nil
+}
+
+// Key
+// Returns the key with the id
+func (r *KeyRing) Key(id uint32) (key []byte, err error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if key, ok := r.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: key %d", ErrNoKey, id)
+}
+
+// crypter
+// Seals and opens data for one KV with the keys of a KeyProvider
+type crypter struct {
+	keys    KeyProvider
+	mutex   sync.Mutex
+	aeads   map[uint32]cipher.AEAD // Ciphers by key id
+	checked uint32                 // The key crypt.dat is sealed with
+}
+
+// newCrypter
+// Returns a crypter using the keys
+func newCrypter(keys KeyProvider) *crypter {
+	return &crypter{keys: keys, aeads: make(map[uint32]cipher.AEAD)}
+}
+
+// aead
+// Returns the cipher of the key with the id; key is the key if the caller has it
+func (c *crypter) aead(id uint32, key []byte) (aead cipher.AEAD, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if aead, ok := c.aeads[id]; ok {
+		return aead, nil
+	}
+	if key == nil {
+		if key, err = c.keys.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %d: %w", id, err)
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	c.aeads[id] = aead
+	return aead, nil
+}
+
+// seal
+// Returns the plaintext encrypted with the current key: the key id, the
+// nonce, and the ciphertext with its tag
+func (c *crypter) seal(aad, plaintext []byte) (sealed []byte, err error) {
+	id, key, err := c.keys.Current()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	sealed = make([]byte, 16, len(plaintext)+sealOverhead)
+	binary.BigEndian.PutUint32(sealed, id)
+	if _, err = rand.Read(sealed[4:16]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, sealed[4:16], plaintext, aad), nil
+}
+
+// open
+// Returns the plaintext of what seal returned, if it is authentic
+func (c *crypter) open(aad, sealed []byte) (plaintext []byte, err error) {
+	if len(sealed) < sealOverhead {
+		return nil, fmt.Errorf("%w: sealed data of %d bytes is short", ErrCorrupt, len(sealed))
+	}
+	id := binary.BigEndian.Uint32(sealed)
+	aead, err := c.aead(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	if plaintext, err = aead.Open(nil, sealed[4:16], sealed[16:], aad); err != nil {
+		return nil, fmt.Errorf("%w: sealed with key %d: %v", ErrCorrupt, id, err)
+	}
+	return plaintext, nil
+}
+
+// sealedWith
+// Returns the id of the key that sealed the data
+func sealedWith(sealed []byte) uint32 {
+	return binary.BigEndian.Uint32(sealed)
+}
+
+// stale
+// Returns true if the current key is not the one the KV was last encrypted
+// with, so some of it may be sealed with an older key
+func (c *crypter) stale() (bool, error) {
+	id, _, err := c.keys.Current()
+	return id != c.checked, err
+}
+
+// writeCheck
+// Write crypt.dat into the directory, sealed with the current key.  It is
+// written to a tmp file and renamed, as the manifest is.
+func (c *crypter) writeCheck(directory string, sync SyncPolicy) (err error) {
+	sealed, err := c.seal(keyCheckAAD, nil)
+	if err != nil {
+		return err
+	}
+	tmpName := filepath.Join(directory, keyCheckTmpFilename)
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(sealed); err != nil {
+		file.Close()
+		return err
+	}
+	if sync != SyncNever {
+		if err = file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, filepath.Join(directory, keyCheckFilename)); err != nil {
+		return err
+	}
+	c.checked = sealedWith(sealed)
+	return nil
+}
+
+// readCheck
+// Returns a crypter for the KV in the directory, checked against its
+// crypt.dat; nil if the KV is not encrypted
+func readCheck(directory string, keys KeyProvider) (c *crypter, err error) {
+	sealed, err := os.ReadFile(filepath.Join(directory, keyCheckFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("%w: %s is encrypted", ErrNoKey, directory)
+	}
+	c = newCrypter(keys)
+	if _, err = c.open(keyCheckAAD, sealed); err != nil {
+		return nil, fmt.Errorf("checking the keys of %s: %w", directory, err)
+	}
+	c.checked = sealedWith(sealed)
+	return c, nil
+}
+
+// storageFile
+// The file under a BFile or a HistoryFile: an *os.File, or a cryptFile
+type storageFile interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.ReaderAt
+	io.WriterAt
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// openStorage
+// Open the named file, encrypted by blocks if crypt is not nil
+func openStorage(filename string, flag int, perm os.FileMode, crypt *crypter) (storageFile, error) {
+	file, err := os.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if crypt == nil {
+		return file, nil
+	}
+	f, err := newCryptFile(file, crypt, flag&(os.O_WRONLY|os.O_RDWR) == 0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// cryptFile
+// A file sealed in blocks of cryptBlockSize bytes of plaintext.  The file
+// starts with a random id, which goes into the additional data of every
+// block, so a block cannot be moved to another file.  Block i follows at
+// cryptFileHeader + i*cryptPhysicalBlock; only the last block may be shorter.
+// Offsets, sizes and positions are those of the plaintext.
+//
+// Writing into a block reseals all of it, so a write torn by a crash could
+// lose what the block held before.  A block holding data that was synced is
+// therefore saved in a journal, and the journal synced, before the block is
+// first written after a Sync.  A writable open of a file left with a journal
+// puts the saved blocks back and cuts the file to the size it had at the
+// last Sync; so a crash loses only what was written since then.  Sync resets
+// the journal, and Close syncs the file and removes it.
+type cryptFile struct {
+	mutex      sync.Mutex
+	file       *os.File
+	crypt      *crypter
+	readOnly   bool
+	id         [cryptFileHeader]byte // Binds the blocks to the file
+	size       int64                 // Bytes of plaintext
+	pos        int64                 // Where Read and Write go
+	durable    int64                 // The size at the last Sync
+	journal    *os.File              // Created by the first write after a Sync
+	journalEnd int64                 // Bytes in the journal; 0 until the first write after a Sync
+	saved      map[int64]bool        // The blocks saved in the journal
+}
+
+// newCryptFile
+// Returns the file as a cryptFile.  An empty file opened for writing is
+// given an id; any other writable file is first recovered from its journal.
+func newCryptFile(file *os.File, crypt *crypter, readOnly bool) (f *cryptFile, err error) {
+	f = &cryptFile{file: file, crypt: crypt, readOnly: readOnly, saved: make(map[int64]bool)}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case info.Size() == 0 && readOnly:
+		return f, nil
+	case info.Size() == 0:
+		if _, err = rand.Read(f.id[:]); err != nil {
+			return nil, err
+		}
+		if _, err = file.WriteAt(f.id[:], 0); err != nil {
+			return nil, err
+		}
+		if err = os.Remove(f.journalName()); err != nil && !errors.Is(err, os.ErrNotExist) { // Left by the file this one replaces
+			return nil, err
+		}
+		return f, nil
+	case info.Size() < cryptFileHeader:
+		return nil, fmt.Errorf("%w: %s is too short for its id", ErrCorrupt, file.Name())
+	}
+	if _, err = file.ReadAt(f.id[:], 0); err != nil {
+		return nil, err
+	}
+	if !readOnly {
+		if err = f.recover(); err != nil {
+			return nil, fmt.Errorf("recovering %s: %w", file.Name(), err)
+		}
+		if info, err = file.Stat(); err != nil {
+			return nil, err
+		}
+	}
+	physical := info.Size() - cryptFileHeader
+	blocks, rest := physical/cryptPhysicalBlock, physical%cryptPhysicalBlock
+	f.size = blocks * cryptBlockSize
+	if rest > 0 {
+		if rest <= sealOverhead {
+			return nil, fmt.Errorf("%w: %s ends in a partial block", ErrCorrupt, file.Name())
+		}
+		f.size += rest - sealOverhead
+	}
+	f.durable = f.size
+	return f, nil
+}
+
+// physicalSize
+// Returns the size on disk of a cryptFile holding size bytes of plaintext
+func physicalSize(size int64) int64 {
+	physical := cryptFileHeader + size/cryptBlockSize*cryptPhysicalBlock
+	if rest := size % cryptBlockSize; rest > 0 {
+		physical += rest + sealOverhead
+	}
+	return physical
+}
+
+// offset
+// Returns where block i is in the file
+func (f *cryptFile) offset(i int64) int64 {
+	return cryptFileHeader + i*cryptPhysicalBlock
+}
+
+// blockAAD
+// Additional data of block i, which binds the block to its place in the file
+func (f *cryptFile) blockAAD(i int64) []byte {
+	aad := make([]byte, cryptFileHeader+8)
+	copy(aad, f.id[:])
+	binary.BigEndian.PutUint64(aad[cryptFileHeader:], uint64(i))
+	return aad
+}
+
+// journalAAD
+// Additional data of the journal header, which binds the journal to the file
+func (f *cryptFile) journalAAD() []byte {
+	return append(append([]byte(nil), f.id[:]...), "journal"...)
+}
+
+// journalName
+// Returns the name of the journal of the file
+func (f *cryptFile) journalName() string {
+	return f.file.Name() + cryptJournalExt
+}
+
+// recover
+// Undo what was written after the last Sync, if the file was not closed:
+// put back the blocks saved in the journal, and cut the file to the size it
+// had.  A journal header or block torn by the crash was never acted on, so
+// the rest of the journal is ignored.
+func (f *cryptFile) recover() error {
+	journal, err := os.ReadFile(f.journalName())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(journal) >= journalHeaderSize {
+		header, err := f.crypt.open(f.journalAAD(), journal[:journalHeaderSize])
+		switch {
+		case errors.Is(err, ErrCorrupt): // Torn, so no block was written after it
+		case err != nil:
+			return err
+		default:
+			if err = f.restore(journal[journalHeaderSize:]); err != nil {
+				return err
+			}
+			info, err := f.file.Stat()
+			if err != nil {
+				return err
+			}
+			if durable := physicalSize(int64(binary.BigEndian.Uint64(header))); info.Size() > durable {
+				if err = f.file.Truncate(durable); err != nil {
+					return err
+				}
+			}
+			if err = f.file.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(f.journalName())
+}
+
+// restore
+// Write back the blocks saved in the journal entries, up to the first that
+// does not open
+func (f *cryptFile) restore(entries []byte) error {
+	for len(entries) >= journalEntryHeader {
+		i := int64(binary.BigEndian.Uint64(entries))
+		length := int(binary.BigEndian.Uint32(entries[8:]))
+		if length > cryptPhysicalBlock || len(entries) < journalEntryHeader+length {
+			return nil
+		}
+		sealed := entries[journalEntryHeader : journalEntryHeader+length]
+		if _, err := f.crypt.open(f.blockAAD(i), sealed); errors.Is(err, ErrCorrupt) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := f.file.WriteAt(sealed, f.offset(i)); err != nil {
+			return err
+		}
+		entries = entries[journalEntryHeader+length:]
+	}
+	return nil
+}
+
+// saveBlock
+// Make the next write to block i undoable.  The first write after a Sync
+// starts the journal with the size at the Sync; a block holding data from
+// before the Sync is copied into the journal once.  The journal is synced
+// before the block is written.
+func (f *cryptFile) saveBlock(i int64) (err error) {
+	var entry []byte
+	if f.journalEnd == 0 {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(f.durable))
+		if entry, err = f.crypt.seal(f.journalAAD(), size[:]); err != nil {
+			return err
+		}
+	}
+	if start := i * cryptBlockSize; start < f.durable && !f.saved[i] {
+		length := min(cryptBlockSize, int(f.durable-start)) + sealOverhead
+		block := make([]byte, journalEntryHeader+length)
+		binary.BigEndian.PutUint64(block, uint64(i))
+		binary.BigEndian.PutUint32(block[8:], uint32(length))
+		if _, err = f.file.ReadAt(block[journalEntryHeader:], f.offset(i)); err != nil {
+			return err
+		}
+		entry = append(entry, block...)
+	}
+	if len(entry) == 0 {
+		return nil
+	}
+	created := f.journal == nil
+	if created {
+		if f.journal, err = os.OpenFile(f.journalName(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+			return err
+		}
+	}
+	if _, err = f.journal.WriteAt(entry, f.journalEnd); err != nil {
+		return err
+	}
+	if err = f.journal.Sync(); err != nil {
+		return err
+	}
+	if created { // The journal is no use if a crash can lose its name
+		if err = syncDir(filepath.Dir(f.file.Name())); err != nil {
+			return err
+		}
+	}
+	f.journalEnd += int64(len(entry))
+	f.saved[i] = true
+	return nil
+}
+
+// readBlock
+// Returns the plaintext of block i
+func (f *cryptFile) readBlock(i int64) (plaintext []byte, err error) {
+	length := min(cryptBlockSize, int(f.size-i*cryptBlockSize))
+	sealed := make([]byte, length+sealOverhead)
+	if _, err = f.file.ReadAt(sealed, f.offset(i)); err != nil {
+		return nil, err
+	}
+	if plaintext, err = f.crypt.open(f.blockAAD(i), sealed); err != nil {
+		return nil, fmt.Errorf("block %d of %s: %w", i, f.file.Name(), err)
+	}
+	return plaintext, nil
+}
+
+// writeBlock
+// Seal the plaintext as block i, saving the block first
+func (f *cryptFile) writeBlock(i int64, plaintext []byte) error {
+	if err := f.saveBlock(i); err != nil {
+		return err
+	}
+	sealed, err := f.crypt.seal(f.blockAAD(i), plaintext)
+	if err != nil {
+		return err
+	}
+	_, err = f.file.WriteAt(sealed, f.offset(i))
+	return err
+}
+
+// ReadAt
+// Read len(p) bytes at the offset; fewer, with io.EOF, at the end of the file
+func (f *cryptFile) ReadAt(p []byte, offset int64) (n int, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.readAt(p, offset)
+}
+
+func (f *cryptFile) readAt(p []byte, offset int64) (n int, err error) {
+	for n < len(p) && offset+int64(n) < f.size {
+		at := offset + int64(n)
+		block, err := f.readBlock(at / cryptBlockSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], block[at%cryptBlockSize:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt
+// Write p at the offset, resealing every block it touches.  Writing past the
+// end of the file fills the gap with zeros.
+func (f *cryptFile) WriteAt(p []byte, offset int64) (n int, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.writeAt(p, offset)
+}
+
+func (f *cryptFile) writeAt(p []byte, offset int64) (n int, err error) {
+	if offset > f.size {
+		if _, err = f.writeAt(make([]byte, offset-f.size), f.size); err != nil {
+			return 0, err
+		}
+	}
+	for n < len(p) {
+		at := offset + int64(n)
+		i, within := at/cryptBlockSize, int(at%cryptBlockSize)
+		var block []byte
+		if i*cryptBlockSize < f.size && (within > 0 || len(p)-n < cryptBlockSize) { // Keep what p leaves of the block
+			if block, err = f.readBlock(i); err != nil {
+				return n, err
+			}
+		}
+		if end := min(cryptBlockSize, within+len(p)-n); len(block) < end {
+			block = append(block, make([]byte, end-len(block))...)
+		}
+		copied := copy(block[within:], p[n:])
+		if err = f.writeBlock(i, block); err != nil {
+			return n, err
+		}
+		n += copied
+		f.size = max(f.size, at+int64(copied))
+	}
+	return n, nil
+}
+
+// Read
+// Read from the position, as an *os.File does
+func (f *cryptFile) Read(p []byte) (n int, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n, err = f.readAt(p, f.pos)
+	f.pos += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Write
+// Write at the position, as an *os.File does
+func (f *cryptFile) Write(p []byte) (n int, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n, err = f.writeAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Seek
+// Set the position, as an *os.File does
+func (f *cryptFile) Seek(offset int64, whence int) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return f.pos, fmt.Errorf("seek to %d in %s", offset, f.file.Name())
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Truncate
+// Change the size of the file, resealing the block it now ends in.  Cutting
+// data that was synced cannot be undone, so the file is synced at once.
+func (f *cryptFile) Truncate(size int64) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if size >= f.size {
+		_, err = f.writeAt(make([]byte, size-f.size), f.size)
+		return err
+	}
+	i, rest := size/cryptBlockSize, size%cryptBlockSize
+	var block []byte
+	if rest > 0 {
+		if block, err = f.readBlock(i); err != nil {
+			return err
+		}
+	}
+	if err = f.saveBlock(i); err != nil {
+		return err
+	}
+	if err = f.file.Truncate(f.offset(i)); err != nil {
+		return err
+	}
+	f.size = i * cryptBlockSize
+	if rest > 0 {
+		if err = f.writeBlock(i, block[:rest]); err != nil {
+			return err
+		}
+	}
+	f.size = size
+	if size < f.durable {
+		return f.sync()
+	}
+	return nil
+}
+
+// cryptFileInfo
+// The FileInfo of a cryptFile; the size is that of the plaintext
+type cryptFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i cryptFileInfo) Size() int64 { return i.size }
+
+// Stat
+// Returns the FileInfo of the file, with the size of the plaintext
+func (f *cryptFile) Stat() (os.FileInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	info, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return cryptFileInfo{info, f.size}, nil
+}
+
+// Sync
+// Sync the file to disk, then reset the journal
+func (f *cryptFile) Sync() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.sync()
+}
+
+func (f *cryptFile) sync() (err error) {
+	if err = f.file.Sync(); err != nil {
+		return err
+	}
+	if f.journalEnd > 0 { // Until the reset is on disk, a crash would undo what was just synced
+		if err = f.journal.Truncate(0); err != nil {
+			return err
+		}
+		if err = f.journal.Sync(); err != nil {
+			return err
+		}
+	}
+	f.durable = f.size
+	f.journalEnd = 0
+	f.saved = make(map[int64]bool)
+	return nil
+}
+
+// Close
+// Close the file.  If it was written, it is synced and its journal removed;
+// if that fails, the journal is left for the next open to recover from.
+func (f *cryptFile) Close() (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.journal != nil {
+		if err = f.sync(); err == nil {
+			if err = f.journal.Close(); err == nil {
+				if err = os.Remove(f.journalName()); errors.Is(err, os.ErrNotExist) {
+					err = nil
+				}
+			}
+		} else {
+			f.journal.Close()
+		}
+		f.journal = nil
+	}
+	if errClose := f.file.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
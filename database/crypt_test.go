@@ -0,0 +1,286 @@
+package blockchainDB
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestCryptFile(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	ring, err := NewKeyRing(1, testKey(1))
+	assert.NoError(t, err, "key ring")
+	crypt := newCrypter(ring)
+	filename := filepath.Join(dir, "file.dat")
+	f, err := openStorage(filename, os.O_RDWR|os.O_CREATE, 0644, crypt)
+	assert.NoError(t, err, "create")
+
+	// Every write and read is checked against a plain copy
+	var want []byte
+	write := func(data []byte, offset int) {
+		_, err := f.WriteAt(data, int64(offset))
+		assert.NoError(t, err, "write at %d", offset)
+		if end := offset + len(data); end > len(want) {
+			want = append(want, make([]byte, end-len(want))...)
+		}
+		copy(want[offset:], data)
+	}
+	check := func(what string) {
+		info, err := f.Stat()
+		assert.NoError(t, err, what)
+		assert.Equal(t, int64(len(want)), info.Size(), what)
+		got := make([]byte, len(want))
+		_, err = f.ReadAt(got, 0)
+		assert.NoError(t, err, what)
+		assert.Equal(t, want, got, what)
+	}
+	fr := NewFastRandom([]byte{1})
+	write(fr.RandBuff(100, 100), 0)
+	write(fr.RandBuff(10000, 10000), 50)            // Across blocks
+	write(fr.RandBuff(10, 10), cryptBlockSize-5)    // Across a block boundary
+	write(fr.RandBuff(20, 20), 3*cryptBlockSize+50) // Past the end, leaving a gap
+	check("written")
+
+	_, err = f.Seek(0, io.SeekEnd)
+	assert.NoError(t, err, "seek")
+	data := fr.RandBuff(5000, 5000)
+	_, err = f.Write(data)
+	assert.NoError(t, err, "write")
+	want = append(want, data...)
+	check("appended")
+
+	assert.NoError(t, f.Truncate(int64(len(want)-3000)), "truncate")
+	want = want[:len(want)-3000]
+	check("truncated")
+	_, err = f.ReadAt(make([]byte, 10), int64(len(want)-5))
+	assert.ErrorIs(t, err, io.EOF, "read past the end")
+	assert.NoError(t, f.Close(), "close")
+
+	f, err = openStorage(filename, os.O_RDWR, 0644, crypt)
+	assert.NoError(t, err, "open")
+	check("reopened")
+	assert.NoError(t, f.Close(), "close")
+
+	raw, err := os.ReadFile(filename)
+	assert.NoError(t, err, "read the file")
+	assert.False(t, bytes.Contains(raw, want[100:132]), "the file is encrypted")
+	raw[cryptPhysicalBlock+100] ^= 1
+	assert.NoError(t, os.WriteFile(filename, raw, 0644), "tamper")
+	f, err = openStorage(filename, os.O_RDWR, 0644, crypt)
+	assert.NoError(t, err, "open")
+	_, err = f.ReadAt(make([]byte, 10), cryptBlockSize+10)
+	assert.ErrorIs(t, err, ErrCorrupt, "a tampered block")
+	assert.NoError(t, f.Close(), "close")
+}
+
+func TestCryptFileCrash(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	ring, err := NewKeyRing(1, testKey(1))
+	assert.NoError(t, err, "key ring")
+	crypt := newCrypter(ring)
+	filename := filepath.Join(dir, "file.dat")
+	f, err := openStorage(filename, os.O_RDWR|os.O_CREATE, 0644, crypt)
+	assert.NoError(t, err, "create")
+	fr := NewFastRandom([]byte{4})
+	synced := fr.RandBuff(6000, 6000) // Ends part way into block 1
+	_, err = f.Write(synced)
+	assert.NoError(t, err, "write")
+	assert.NoError(t, f.Sync(), "sync")
+
+	// Append, then tear the rewrite of block 1 and crash without a Close
+	_, err = f.Write(fr.RandBuff(3000, 3000))
+	assert.NoError(t, err, "append")
+	cf := f.(*cryptFile)
+	_, err = cf.file.WriteAt(make([]byte, 100), cf.offset(1)+50)
+	assert.NoError(t, err, "tear")
+	cf.file.Close()
+	cf.journal.Close()
+
+	f, err = openStorage(filename, os.O_RDWR, 0644, crypt)
+	assert.NoError(t, err, "open after the crash")
+	info, err := f.Stat()
+	assert.NoError(t, err, "stat")
+	assert.Equal(t, int64(len(synced)), info.Size(), "back to the size at the sync")
+	got := make([]byte, len(synced))
+	_, err = f.ReadAt(got, 0)
+	assert.NoError(t, err, "read")
+	assert.Equal(t, synced, got, "what was synced survives")
+	assert.NoError(t, f.Close(), "close")
+	_, err = os.Stat(filename + cryptJournalExt)
+	assert.ErrorIs(t, err, os.ErrNotExist, "the journal is removed")
+
+	// A block from another file, even at the same place, does not open
+	other := filepath.Join(dir, "other.dat")
+	g, err := openStorage(other, os.O_RDWR|os.O_CREATE, 0644, crypt)
+	assert.NoError(t, err, "create")
+	_, err = g.Write(synced)
+	assert.NoError(t, err, "write")
+	assert.NoError(t, g.Close(), "close")
+	raw, err := os.ReadFile(other)
+	assert.NoError(t, err, "read the other file")
+	file, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	assert.NoError(t, err, "open")
+	_, err = file.WriteAt(raw[cryptFileHeader:cryptFileHeader+cryptPhysicalBlock], cryptFileHeader)
+	assert.NoError(t, err, "splice")
+	assert.NoError(t, file.Close(), "close")
+	f, err = openStorage(filename, os.O_RDWR, 0644, crypt)
+	assert.NoError(t, err, "open")
+	_, err = f.ReadAt(got[:10], 0)
+	assert.ErrorIs(t, err, ErrCorrupt, "a block spliced from another file")
+	assert.NoError(t, f.Close(), "close")
+}
+
+func TestEncryptedKV(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	ring, err := NewKeyRing(1, testKey(1))
+	assert.NoError(t, err, "key ring")
+	opts := &Options{Keys: ring, Compression: CompressFlate, History: true, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1}
+	kv, err := NewKV(dir, opts)
+	assert.NoError(t, err, "create kv")
+
+	values := make(map[[32]byte][]byte)
+	fr := NewFastRandom([]byte{2})
+	for i := 0; i < 200; i++ { // Enough to push keys to the HistoryFile
+		key := fr.NextHash()
+		values[key] = []byte(fmt.Sprintf("secret value %d", i))
+		if i%3 == 0 {
+			values[key] = compressible(i, 300)
+		}
+		assert.NoError(t, kv.Put(key, values[key]), "put")
+	}
+	check := func(kv *KV, what string) {
+		for key, value := range values {
+			got, err := kv.Get(key)
+			assert.NoError(t, err, what)
+			assert.Equal(t, value, got, what)
+			length, ok, err := kv.Has(key)
+			assert.NoError(t, err, what)
+			assert.True(t, ok, what)
+			assert.Equal(t, uint64(len(value)), length, what)
+		}
+	}
+	check(kv, "written")
+	assert.NoError(t, kv.Close(), "close")
+
+	for _, name := range []string{valueFilename, kFileName, historyFilename} {
+		raw, err := os.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err, "read %s", name)
+		assert.False(t, bytes.Contains(raw, []byte("secret value")), "%s holds no values in the clear", name)
+		for key := range values {
+			assert.False(t, bytes.Contains(raw, key[:]), "%s holds no keys in the clear", name)
+			break
+		}
+	}
+
+	_, err = OpenKV(dir, &Options{})
+	assert.ErrorIs(t, err, ErrNoKey, "no keys")
+	wrong, err := NewKeyRing(1, testKey(2))
+	assert.NoError(t, err, "key ring")
+	_, err = OpenKV(dir, &Options{Keys: wrong})
+	assert.ErrorIs(t, err, ErrCorrupt, "the wrong key")
+
+	kv, err = OpenKVReadOnly(dir, opts)
+	assert.NoError(t, err, "open read-only")
+	check(kv, "read-only")
+	assert.NoError(t, kv.Close(), "close")
+
+	// A value moved, or cut short, fails authentication
+	kv, err = OpenKV(dir, opts)
+	assert.NoError(t, err, "open kv")
+	check(kv, "reopened")
+	var dbbKeys []*DBBKey
+	for key := range values {
+		dbbKey, err := kv.kFile.Get(key)
+		assert.NoError(t, err, "get key")
+		if len(dbbKeys) == 0 || dbbKey.Size() != dbbKeys[0].Size() {
+			if dbbKeys = append(dbbKeys, dbbKey); len(dbbKeys) == 2 {
+				break
+			}
+		}
+	}
+	moved := &DBBKey{Offset: dbbKeys[1].Offset, Length: dbbKeys[0].Length} // Another value's bytes
+	_, err = kv.getValue(moved)
+	assert.ErrorIs(t, err, ErrCorrupt, "moved")
+	short := &DBBKey{Offset: dbbKeys[0].Offset, Length: encryptedFlag | sealOverhead + 1}
+	_, err = kv.getValue(short)
+	assert.ErrorIs(t, err, ErrCorrupt, "cut short")
+	assert.NoError(t, kv.Close(), "close")
+}
+
+func TestKeyRotation(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SharedPerm=%v", shared), func(t *testing.T) {
+			dir, rm := MakeDir()
+			defer rm()
+
+			ring, err := NewKeyRing(1, testKey(1))
+			assert.NoError(t, err, "key ring")
+			opts := &Options{Keys: ring, Versioned: true, SharedPerm: shared, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+			kvs, err := NewKVShard(dir, opts)
+			assert.NoError(t, err, "create KVShard")
+
+			state := make(map[[32]byte]string)
+			fr := NewFastRandom([]byte{3})
+			for i := 0; i < 200; i++ {
+				key := fr.NextHash()
+				state[key] = fmt.Sprintf("perm %d", i)
+				assert.NoError(t, kvs.PutPerm(key, []byte(state[key])), "put perm")
+				if i%2 == 0 {
+					state[key] = fmt.Sprintf("dyna %d", i)
+					assert.NoError(t, kvs.PutDyna(key, []byte(state[key])), "put dyna")
+				}
+			}
+			assert.NoError(t, kvs.Commit(1), "commit")
+			committed := make(map[[32]byte]string)
+			for key, value := range state {
+				committed[key] = value
+			}
+			checkKeys(t, kvs, state, "written")
+
+			// Rotate, and compact everything under the new key
+			assert.NoError(t, ring.Rotate(2, testKey(2)), "rotate")
+			assert.NoError(t, kvs.Compress(), "compress")
+			_, err = kvs.AppendReencoded()
+			assert.NoError(t, err, "append reencoded")
+			assert.Equal(t, uint64(300), opts.Metrics.Reencrypted.Load(), "the DynaKV values, and a version list per key")
+			checkKeys(t, kvs, state, "compressed")
+			assert.NoError(t, kvs.RollbackTo(1), "rollback")
+			checkKeys(t, kvs, committed, "rolled back")
+			assert.NoError(t, kvs.Close(), "close")
+
+			err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && info.Name() == keyCheckFilename {
+					sealed, err := os.ReadFile(path)
+					assert.NoError(t, err, "read %s", path)
+					assert.Equal(t, uint32(2), sealedWith(sealed), "%s is re-encrypted", path)
+				}
+				return err
+			})
+			assert.NoError(t, err, "walk")
+
+			// Only the current key is needed to read what is live
+			only, err := NewKeyRing(2, testKey(2))
+			assert.NoError(t, err, "key ring")
+			opts.Keys = only
+			kvs, err = OpenKVShard(dir, opts)
+			assert.NoError(t, err, "open with the new key")
+			checkKeys(t, kvs, state, "new key only")
+			assert.NoError(t, kvs.Close(), "close")
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package blockchainDB
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Value deduplication
+//
+// Content addressed data often stores the same value under many keys.  With
+// Options.Dedup set, a KV with history keeps an index from the sha256 hash of
+// each value to the entry of the one copy in its values file.  KV.Put of a
+// value the index has points the key's DBBKey at that copy, and writes nothing
+// to the values file.  Values are immutable, and a values file is only ever
+// appended to, so a copy shared by many keys is never overwritten.  The PermKV
+// of a KV2 takes PermDedup.
+//
+// The index is a KFile without history in the dedup directory of the KV, so
+// it is flushed, synced, encrypted and checkpointed with the KV.  A KV opened
+// with Dedup that has no index starts one; the values it already holds are
+// deduplicated when the PermKV is next rebuilt.
+//
+// Compaction counts references.  PurgePerm rebuilds the PermKV from the keys
+// it keeps, and copies each value once however many of them point to it; the
+// copy is dropped only when every key that points to it is purged.  The
+// rebuilt PermKV dedups as PermDedup says, which also merges the copies
+// written before Dedup was set.
+
+const dedupDirName = "dedup" // Holds the value index of a KV that dedups its values
+
+// openDedup
+// Open the value index of the KV, or start one if it has none
+func (k *KV) openDedup() (err error) {
+	directory := filepath.Join(k.Directory, dedupDirName)
+	opts := k.kFileOptions()
+	opts.History = false
+	if _, err = os.Stat(filepath.Join(directory, kFileName)); err == nil {
+		k.dedup, err = OpenKFile(directory, opts)
+		return err
+	}
+	if err = os.MkdirAll(directory, os.ModePerm); err != nil {
+		return err
+	}
+	opts.Overwrite = true // Replace a partial index left by a crash
+	k.dedup, err = NewKFile(directory, opts)
+	return err
+}
+
+// findValue
+// Returns the hash of the value, and the entry of the copy the KV already
+// holds, or nil if it holds none
+func (k *KV) findValue(value []byte) (hash [32]byte, dbbKey *DBBKey, err error) {
+	hash = sha256.Sum256(value)
+	shared, err := k.dedup.Get(hash)
+	if errors.Is(err, ErrNotFound) {
+		return hash, nil, nil
+	} else if err != nil {
+		return hash, nil, err
+	}
+	dbbKey = new(DBBKey) // The entry is the index's; the key gets its own
+	*dbbKey = *shared
+	return hash, dbbKey, nil
+}
@@ -0,0 +1,179 @@
+package blockchainDB
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupKV(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Encrypted=%v", encrypted), func(t *testing.T) {
+			dir, rm := MakeDir()
+			defer rm()
+
+			opts := &Options{Dedup: true, History: true, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+			if encrypted {
+				ring, err := NewKeyRing(1, testKey(1))
+				assert.NoError(t, err, "key ring")
+				opts.Keys = ring
+			}
+			kv, err := NewKV(dir, opts)
+			assert.NoError(t, err, "create kv")
+
+			distinct := make([][]byte, 10)
+			for i := range distinct {
+				distinct[i] = bytes.Repeat([]byte{byte(i)}, 100)
+			}
+			values := make(map[[32]byte][]byte)
+			fr := NewFastRandom([]byte{4})
+			put := func(kv *KV, n int) {
+				for i := 0; i < n; i++ { // Enough to push keys to the HistoryFile
+					key := fr.NextHash()
+					values[key] = distinct[i%len(distinct)]
+					assert.NoError(t, kv.Put(key, values[key]), "put")
+				}
+			}
+			check := func(kv *KV, what string) {
+				keys := make([][32]byte, 0, len(values))
+				for key, value := range values {
+					got, err := kv.Get(key)
+					assert.NoError(t, err, what)
+					assert.Equal(t, value, got, what)
+					length, ok, err := kv.Has(key)
+					assert.NoError(t, err, what)
+					assert.True(t, ok, what)
+					assert.Equal(t, uint64(len(value)), length, what)
+					keys = append(keys, key)
+				}
+				got, errs := kv.MultiGet(keys)
+				for i, key := range keys {
+					assert.NoError(t, errs[i], what)
+					assert.Equal(t, values[key], got[i], what)
+				}
+			}
+			put(kv, 200)
+			check(kv, "written")
+			assert.Equal(t, uint64(10), opts.Metrics.Puts.Load(), "each distinct value is written once")
+			assert.Equal(t, uint64(190), opts.Metrics.Deduped.Load(), "deduped")
+			assert.NoError(t, kv.Close(), "close")
+
+			kv, err = OpenKV(dir, opts)
+			assert.NoError(t, err, "open kv")
+			check(kv, "reopened")
+			put(kv, 20)
+			assert.Equal(t, uint64(10), opts.Metrics.Puts.Load(), "the index is kept on disk")
+			check(kv, "deduped after reopen")
+			assert.NoError(t, kv.Close(), "close")
+
+			// Without Dedup, values are written again, and the index is left alone
+			kv, err = OpenKV(dir, &Options{Keys: opts.Keys, Metrics: opts.Metrics})
+			assert.NoError(t, err, "open kv")
+			put(kv, 10)
+			assert.Equal(t, uint64(20), opts.Metrics.Puts.Load(), "not deduped")
+			check(kv, "without dedup")
+			assert.NoError(t, kv.Close(), "close")
+
+			kv, err = OpenKVReadOnly(dir, opts)
+			assert.NoError(t, err, "open read-only")
+			check(kv, "read-only")
+			assert.NoError(t, kv.Close(), "close")
+		})
+	}
+}
+
+func TestDedupPurge(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{PermDedup: true, SharedPerm: true, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+
+	distinct := [][]byte{
+		bytes.Repeat([]byte("a"), 100), // Every key is changed, so it is dropped
+		bytes.Repeat([]byte("b"), 100), // Some keys are changed, so it is kept
+		bytes.Repeat([]byte("c"), 100), // No key is changed
+	}
+	state := make(map[[32]byte]string)
+	fr := NewFastRandom([]byte{5})
+	for i := 0; i < 90; i++ {
+		key := fr.NextHash()
+		state[key] = string(distinct[i%3])
+		assert.NoError(t, kvs.PutPerm(key, distinct[i%3]), "put perm")
+		if i%3 == 0 || i%3 == 1 && i < 30 {
+			state[key] = fmt.Sprintf("changed %d", i)
+			assert.NoError(t, kvs.Put(key, []byte(state[key])), "put")
+		}
+	}
+	assert.Equal(t, uint64(87), opts.Metrics.Deduped.Load(), "deduped")
+	permSize := func() uint64 {
+		size, err := kvs.Perm.vFile.Offset()
+		assert.NoError(t, err, "size")
+		return size
+	}
+	assert.Equal(t, uint64(300), permSize(), "one copy of each value")
+	assert.NoError(t, kvs.Commit(1), "commit")
+	pruning, err := kvs.Prune(1)
+	assert.NoError(t, err, "prune")
+	_, err = pruning.Wait()
+	assert.NoError(t, err, "pruning")
+
+	purged, err := kvs.PurgePerm()
+	assert.NoError(t, err, "purge")
+	assert.Equal(t, 40, purged, "the changed keys")
+	assert.Equal(t, uint64(200), permSize(), "the value no key points to is dropped")
+	checkKeys(t, kvs, state, "purged")
+
+	// The rebuilt PermKV has an index of the values it kept
+	key := fr.NextHash()
+	state[key] = string(distinct[2])
+	assert.NoError(t, kvs.PutPerm(key, distinct[2]), "put perm")
+	assert.Equal(t, uint64(200), permSize(), "deduped")
+	key = fr.NextHash()
+	state[key] = string(distinct[0])
+	assert.NoError(t, kvs.PutPerm(key, distinct[0]), "put perm")
+	assert.Equal(t, uint64(300), permSize(), "written again")
+	checkKeys(t, kvs, state, "written after the purge")
+	assert.NoError(t, kvs.Close(), "close")
+
+	kvs, err = OpenKVShard(dir, opts)
+	assert.NoError(t, err, "open")
+	checkKeys(t, kvs, state, "reopened")
+	assert.NoError(t, kvs.Close(), "close")
+}
+
+func TestDedupLater(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{SharedPerm: true, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+	state := make(map[[32]byte]string)
+	fr := NewFastRandom([]byte{6})
+	for i := 0; i < 100; i++ {
+		key := fr.NextHash()
+		state[key] = fmt.Sprintf("value %d", i%5)
+		assert.NoError(t, kvs.PutPerm(key, []byte(state[key])), "put perm")
+	}
+	assert.NoError(t, kvs.Close(), "close")
+	assert.NoDirExists(t, filepath.Join(dir, PermDirName, dedupDirName), "no index without Dedup")
+
+	// Compress rebuilds the PermKV with one copy of each value
+	opts.PermDedup = true
+	kvs, err = OpenKVShard(dir, opts)
+	assert.NoError(t, err, "open")
+	assert.NoError(t, kvs.Compress(), "compress")
+	size, err := kvs.Perm.vFile.Offset()
+	assert.NoError(t, err, "size")
+	assert.Equal(t, uint64(5*len("value 0")), size, "deduped")
+	checkKeys(t, kvs, state, "compressed")
+	assert.NoError(t, kvs.Close(), "close")
+	_, err = os.Stat(filepath.Join(dir, PermDirName, dedupDirName, kFileName))
+	assert.NoError(t, err, "the index")
+}
@@ -0,0 +1,187 @@
+package blockchainDB
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Demoting stable DynaKV keys
+//
+// A key promoted to the DynaKV, or written there with PutDyna, stays there
+// even once it stops changing.  With DemoteAfter set, compaction moves the
+// values of DynaKV keys unchanged for that many commits to the PermKV, and
+// drops the keys from the DynaKV, so Get finds them in the PermKV.
+//
+// The height of the last write of a key is that of the first commit marker
+// after its newest record in the undo log.  A key with no records was last
+// written before the oldest marker left, which bounds the height.  Keys with
+// a cleared version, which GetAt reads from the PermKV, stay.
+//
+// Demote logs each key it moves, so a rollback undoes the move: it restores
+// the DynaKV entry, and revokes the key in the PermKV (see commit.go), hiding
+// it if the rollback also undoes the first write of the key.
+//
+// The values are synced to the PermKV before the keys leave the DynaKV.  A
+// crash in between leaves the same value in both layers; the next compaction
+// purges the PermKV copy (see PurgePerm) and demotes the key again.
+
+// Demote
+// Move the DynaKV keys unchanged for Options.DemoteAfter commits to the
+// PermKV.  Returns the number of keys moved; none if DemoteAfter is 0.
+func (k *KV2) Demote() (demoted int, err error) {
+	if k.opts.readOnly {
+		return 0, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	if k.opts.DemoteAfter == 0 {
+		return 0, nil
+	}
+	if err = k.Flush(); err != nil {
+		return 0, err
+	}
+	written, oldest, err := k.lastWrites()
+	if err != nil {
+		return 0, err
+	}
+
+	keyValues, keyList, err := k.DynaKV.kFile.GetKeyList()
+	if err != nil {
+		return 0, err
+	}
+	moved := make(map[[32]byte]struct{})
+	for _, key := range keyList {
+		dbbKey := keyValues[key]
+		if dbbKey.IsCleared() || dbbKey.IsDeleted() {
+			continue
+		}
+		height, ok := written[key]
+		if !ok {
+			height = oldest
+		}
+		if height+k.opts.DemoteAfter > k.height {
+			continue
+		}
+		if stable, err := k.stableVersions(key); err != nil || !stable {
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		value, err := k.DynaKV.getValue(dbbKey)
+		if err != nil {
+			return 0, err
+		}
+		if permValue, err := k.permGet(key); err == nil {
+			if !bytes.Equal(value, permValue) { // Still shadowing an old PermKV value; see PurgePerm
+				continue
+			}
+			if err = k.logUndo(undoDyna, key); err != nil {
+				return 0, err
+			}
+		} else if !errors.Is(err, ErrNotFound) {
+			return 0, err
+		} else if err = k.logUndo(undoDemote, key); err != nil {
+			return 0, err
+		} else if err = k.permPut(key, value); err != nil {
+			return 0, err
+		}
+		moved[key] = struct{}{}
+	}
+	if len(moved) == 0 {
+		return 0, nil
+	}
+
+	if err = k.undo.Flush(); err != nil {
+		return 0, err
+	}
+	if err = k.undo.File.Sync(); err != nil { // The moves can be undone before they are made
+		return 0, err
+	}
+	k.lockPerm()
+	err = k.PermKV.sync() // On disk before the DynaKV lets go, even if the PermKV is shared
+	k.unlockPerm()
+	if err != nil {
+		return 0, err
+	}
+	if demoted, err = k.DynaKV.kFile.Purge(func(key [32]byte, dbbKey *DBBKey) bool {
+		_, ok := moved[key]
+		return ok
+	}); err != nil {
+		return 0, err
+	}
+	if err = k.DynaKV.sync(); err != nil {
+		return 0, err
+	}
+	k.opts.Metrics.Demotions.Add(uint64(demoted))
+	return demoted, nil
+}
+
+// lastWrites
+// Returns the height of the last write of each key with records in the undo
+// log, and the height of the oldest commit marker in it; 0 if it has none.
+// Writes since the last Commit are at the height after it.
+func (k *KV2) lastWrites() (written map[[32]byte]uint64, oldest uint64, err error) {
+	written = make(map[[32]byte]uint64)
+	height := k.height + 1
+	err = k.undoRecords(0, func(offset int64, key [32]byte, dbbKey *DBBKey, kind byte) (bool, error) {
+		if kind == undoCommit {
+			oldest, height = dbbKey.Offset, dbbKey.Offset
+		} else if _, ok := written[key]; !ok { // Newest first, so the first record is the last write
+			written[key] = height
+		}
+		return false, nil
+	})
+	return written, oldest, err
+}
+
+// stableVersions
+// Returns true unless a version of the key is cleared, so GetAt of its height
+// reads the PermKV
+func (k *KV2) stableVersions(key [32]byte) (bool, error) {
+	if k.VersKV == nil {
+		return true, nil
+	}
+	stable := true
+	err := k.chunks(key, func(chunk versionChunk) (bool, error) {
+		for i := 0; i < chunk.list.len() && stable; i++ {
+			stable = !chunk.list.dbbKey(i).IsCleared()
+		}
+		return !stable, nil
+	})
+	return stable, err
+}
+
+// Demote
+// Move the stable DynaKV keys of every shard to the PermKV; see KV2.Demote.
+// Returns the number of keys moved.
+func (k *KVShard) Demote() (demoted int, err error) {
+	if err = k.checkOpen(); err != nil {
+		return 0, err
+	}
+	if k.opts.readOnly {
+		return 0, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	k.waitPrune()
+	for _, kv2 := range k.Shards {
+		n, err := k.demoteShard(kv2)
+		demoted += n
+		if err != nil {
+			return demoted, err
+		}
+	}
+	if demoted > 0 {
+		k.opts.logf("demoted %d stable DynaKV keys of %s to the PermKV", demoted, k.Directory)
+	}
+	return demoted, nil
+}
+
+// demoteShard
+// Demote the stable keys of one shard, holding its lock
+func (k *KVShard) demoteShard(kv2 *KV2) (demoted int, err error) {
+	k.lockShard(kv2)
+	defer k.unlockShard(kv2)
+	if err = kv2.Open(); err != nil {
+		return 0, err
+	}
+	return kv2.Demote()
+}
@@ -0,0 +1,159 @@
+package blockchainDB
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDemote(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SharedPerm=%v", shared), func(t *testing.T) {
+			dir, rm := MakeDir()
+			defer rm()
+
+			opts := &Options{SharedPerm: shared, Versioned: true, DemoteAfter: 2, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50,
+				BloomSize: .1, Metrics: new(Metrics)}
+			kvs, err := NewKVShard(dir, opts)
+			assert.NoError(t, err, "create KVShard")
+
+			// history[h][key] is the value of the key at height h
+			history := make(map[uint64]map[[32]byte]string)
+			state := make(map[[32]byte]string)
+			fr := NewFastRandom([]byte{10})
+			keys := make([][32]byte, 110)
+			for i := range keys {
+				keys[i] = fr.NextHash()
+			}
+			for height := uint64(1); height <= 6; height++ {
+				for i, key := range keys {
+					switch {
+					case height == 1 && i < 100:
+						state[key] = fmt.Sprintf("%d at %d", i, height)
+						assert.NoError(t, kvs.PutDyna(key, []byte(state[key])), "put dyna")
+					case height == 1: // A new key goes to the PermKV
+						state[key] = fmt.Sprintf("%d at %d", i, height)
+						assert.NoError(t, kvs.Put(key, []byte(state[key])), "put")
+					case i >= 100 && height == 2: // ... and is promoted to the DynaKV when changed
+						state[key] = fmt.Sprintf("%d at %d", i, height)
+						assert.NoError(t, kvs.Put(key, []byte(state[key])), "put")
+					case i < 100 && i%4 == 0 && height != 6:
+						state[key] = fmt.Sprintf("%d at %d", i, height)
+						assert.NoError(t, kvs.Put(key, []byte(state[key])), "put")
+					}
+				}
+				assert.NoError(t, kvs.Commit(height), "commit")
+				history[height] = make(map[[32]byte]string)
+				for key, value := range state {
+					history[height][key] = value
+				}
+			}
+
+			// The promoted keys shadow PermKV values a rollback could restore, so they stay
+			assert.NoError(t, kvs.Compress(), "compress")
+			assert.Equal(t, uint64(75), opts.Metrics.Demotions.Load(), "keys not written since height 4 are demoted")
+			for height := uint64(1); height <= 6; height++ {
+				for i, key := range keys {
+					value, err := kvs.GetAt(key, height)
+					if assert.NoError(t, err, "get at") {
+						assert.Equal(t, history[height][key], string(value), "key %d at height %d", i, height)
+					}
+				}
+			}
+
+			pruning, err := kvs.Prune(4)
+			assert.NoError(t, err, "prune")
+			_, err = pruning.Wait()
+			assert.NoError(t, err, "pruning")
+			assert.NoError(t, kvs.Compress(), "compress")
+			assert.Equal(t, uint64(10), opts.Metrics.PermPurged.Load(), "the old values of the promoted keys are purged")
+			assert.Equal(t, uint64(85), opts.Metrics.Demotions.Load(), "and then the promoted keys")
+			for i, key := range keys {
+				value, layer, err := kvs.GetWithLayer(key)
+				assert.NoError(t, err, "get with layer")
+				assert.Equal(t, state[key], string(value), "key %d", i)
+				if i < 100 && i%4 == 0 {
+					assert.Equal(t, LayerDyna, layer, "key %d was written at height 5", i)
+				} else {
+					assert.Equal(t, LayerPerm, layer, "key %d is demoted", i)
+				}
+			}
+			check := func(kvs *KVShard, height uint64, what string) {
+				for i, key := range keys {
+					value, err := kvs.GetAt(key, height)
+					if assert.NoError(t, err, what) {
+						assert.Equal(t, history[height][key], string(value), "%s: key %d at height %d", what, i, height)
+					}
+				}
+			}
+			for height := uint64(4); height <= 6; height++ {
+				check(kvs, height, "demoted")
+			}
+
+			assert.NoError(t, kvs.RollbackTo(4), "rollback")
+			checkKeys(t, kvs, history[4], "rolled back")
+			assert.NoError(t, kvs.Close(), "close")
+
+			kvs, err = OpenKVShard(dir, opts)
+			assert.NoError(t, err, "open")
+			checkKeys(t, kvs, history[4], "reopen")
+			check(kvs, 4, "reopen")
+			assert.NoError(t, kvs.Close(), "close")
+		})
+	}
+}
+
+func TestDemoteRollback(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{DemoteAfter: 2, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+	first := make(map[[32]byte]string) // Written at height 1
+	later := make(map[[32]byte]string) // Written at height 2
+	fr := NewFastRandom([]byte{11})
+	for i := 0; i < 100; i++ {
+		key := fr.NextHash()
+		first[key] = fmt.Sprintf("%d at 1", i)
+		assert.NoError(t, kvs.PutDyna(key, []byte(first[key])), "put dyna")
+	}
+	assert.NoError(t, kvs.Commit(1), "commit")
+	for i := 0; i < 50; i++ {
+		key := fr.NextHash()
+		later[key] = fmt.Sprintf("%d at 2", i)
+		assert.NoError(t, kvs.PutDyna(key, []byte(later[key])), "put dyna")
+	}
+	for height := uint64(2); height <= 4; height++ {
+		assert.NoError(t, kvs.Commit(height), "commit")
+	}
+
+	// With the default retention, the undo log holds every write
+	demoted, err := kvs.Demote()
+	assert.NoError(t, err, "demote")
+	assert.Equal(t, 150, demoted, "every key is unchanged for 2 commits")
+	checkKeys(t, kvs, first, "demoted")
+	checkKeys(t, kvs, later, "demoted")
+
+	// A rollback past the writes puts the keys back, or hides them
+	assert.NoError(t, kvs.RollbackTo(1), "rollback")
+	check := func(kvs *KVShard, what string) {
+		checkKeys(t, kvs, first, what)
+		for key := range first {
+			_, layer, err := kvs.GetWithLayer(key)
+			assert.NoError(t, err, what)
+			assert.Equal(t, LayerDyna, layer, what)
+		}
+		for key := range later {
+			_, err := kvs.Get(key)
+			assert.ErrorIs(t, err, ErrNotFound, what)
+		}
+	}
+	check(kvs, "rolled back")
+	assert.NoError(t, kvs.Close(), "close")
+	kvs, err = OpenKVShard(dir, opts)
+	assert.NoError(t, err, "open")
+	check(kvs, "reopened")
+	assert.NoError(t, kvs.Close(), "close")
+}
@@ -0,0 +1,24 @@
+package blockchainDB
+
+import "errors"
+
+// Errors returned by the database.  They are usually wrapped with more context,
+// so test for them with errors.Is.
+var (
+	ErrExists      = errors.New("database already exists") // Creating a database where one already exists
+	ErrLocked      = errors.New("database is locked")      // Another process has the database open
+	ErrReadOnly    = errors.New("database is read-only")   // Writing to a database opened read-only
+	ErrConflict    = errors.New("transaction conflict")    // A key a transaction read was written after it began
+	ErrTxnDone     = errors.New("transaction is done")     // Using a transaction after Commit or Discard
+	ErrSavepoint   = errors.New("invalid savepoint")       // The savepoint was released or rolled back past
+	ErrSealed      = errors.New("segment is sealed")       // Writing to the segment of a major block already sealed
+	ErrImmutable   = errors.New("key is immutable")        // Changing a value in a KV with history, or a PermKV key with StrictImmutable set
+	ErrNotFound    = errors.New("not found")               // The key is not in the database, or was deleted
+	ErrPruned      = errors.New("height has been pruned")  // Reading or rolling back to a height older than the history kept
+	ErrViewExpired = errors.New("view expired")            // Using a View that was closed or timed out
+	ErrCorrupt     = errors.New("data is corrupt")         // A file holds data that cannot be what was written
+	ErrClosed      = errors.New("database is closed")      // Using a KVShard or KVView after Close
+	ErrNoKey       = errors.New("no encryption key")       // Opening an encrypted KV without Keys, or data sealed with a key Keys lacks
+	ErrEncrypted   = errors.New("database is encrypted")   // Keeping plaintext segments in an encrypted KVShard
+	ErrHeight      = errors.New("invalid height")          // Committing at a height not above the last, or rolling back to one not committed
+)
@@ -0,0 +1,72 @@
+package blockchainDB
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrors(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{Versioned: true, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, ViewTimeout: time.Hour}
+	kvv, err := NewKVView(filepath.Join(dir, "view"), opts)
+	assert.NoError(t, err, "create KVView")
+	kvs := kvv.DB
+
+	// A missing key and a deleted key are both ErrNotFound
+	key := [32]byte{1}
+	_, err = kvs.Get(key)
+	assert.True(t, errors.Is(err, ErrNotFound), "missing key")
+	assert.NoError(t, kvs.Put(key, []byte("value")), "put")
+	assert.NoError(t, kvs.Commit(1), "commit")
+	assert.NoError(t, kvs.Delete(key), "delete")
+	_, err = kvs.Get(key)
+	assert.True(t, errors.Is(err, ErrNotFound), "deleted key")
+	_, err = kvs.GetAt([32]byte{2}, 1)
+	assert.True(t, errors.Is(err, ErrNotFound), "missing key at a height")
+
+	// Changing a value in a KV with history
+	kv, err := NewKV(filepath.Join(dir, "history"), &Options{History: true, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1})
+	assert.NoError(t, err, "create KV")
+	assert.NoError(t, kv.Put(key, []byte("value")), "put")
+	assert.True(t, errors.Is(kv.Put(key, []byte("changed")), ErrImmutable), "a value in a KV with history")
+	assert.True(t, errors.Is(kv.Delete(key), ErrImmutable), "a delete in a KV with history")
+	assert.NoError(t, kv.Close(), "close")
+
+	// A view that was closed has expired
+	view := kvv.NewView()
+	assert.NoError(t, view.Close(), "close view")
+	_, err = view.Get(key)
+	assert.True(t, errors.Is(err, ErrViewExpired), "closed view")
+
+	// A damaged file is ErrCorrupt
+	bad := filepath.Join(dir, "bad.seg")
+	assert.NoError(t, os.WriteFile(bad, []byte("not a segment"), 0644), "write")
+	_, err = VerifySegment(bad)
+	assert.True(t, errors.Is(err, ErrCorrupt), "damaged segment")
+	hf, err := NewHistoryFile(64, filepath.Join(dir, "hf"))
+	assert.NoError(t, err, "create HistoryFile")
+	err = hf.AddKeys(make([]byte, DBKeyFullSize+1))
+	assert.True(t, errors.Is(err, ErrCorrupt), "a partial key in a key list")
+	unsorted := append((&DBBKey{}).Bytes([32]byte{0, 0, 0, 5}), (&DBBKey{}).Bytes([32]byte{0, 0, 0, 1})...)
+	err = hf.AddKeys(unsorted)
+	assert.True(t, errors.Is(err, ErrCorrupt), "a key list not sorted into bins")
+	assert.NoError(t, hf.File.Close(), "close")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, manifestFilename), []byte("{"), 0644), "write")
+	_, err = ReadManifest(dir)
+	assert.True(t, errors.Is(err, ErrCorrupt), "a damaged manifest")
+
+	// Nothing works after Close
+	assert.NoError(t, kvv.Close(), "close")
+	_, err = kvs.Get(key)
+	assert.True(t, errors.Is(err, ErrClosed), "get after close")
+	assert.True(t, errors.Is(kvv.Put(key, []byte("value")), ErrClosed), "put after close")
+	assert.True(t, errors.Is(kvs.Commit(2), ErrClosed), "commit after close")
+	assert.NoError(t, kvs.Close(), "a second close does nothing")
+}
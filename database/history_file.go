@@ -54,21 +54,29 @@ func (ks *KeySet) Unmarshal(buff []byte) {
 
 type HistoryFile struct {
 	// Not marshaled
-	Mutex        sync.Mutex // Stops access to History during a reorg
-	Directory    string     // Path to the file
-	Filename     string     // Computed; directory + filename
-	HeaderSize   uint64     // Computed based of IndexCnt
-	File         *os.File   // Path to the History File
-	KeySetOffset []*KeySet  // Offsets around key sets, in file offset order
+	Mutex        sync.Mutex  // Stops access to History during a reorg
+	Directory    string      // Path to the file
+	Filename     string      // Computed; directory + filename
+	HeaderSize   uint64      // Computed based of IndexCnt
+	File         storageFile // Path to the History File
+	KeySetOffset []*KeySet   // Offsets around key sets, in file offset order
+	flag         int         // How File is opened: os.O_RDWR or os.O_RDONLY
+	crypt        *crypter    // Encrypts File by blocks; nil if it is not encrypted
 	// Marshaled
 	OffsetCnt int32     // Count of offsets to key sets
 	KeySets   []*KeySet // Offsets around key sets, in key index order
 }
 
 // NewHistoryFile
-// Creates and initializes a HistoryFile.  If one already exists, it is replaced with
-// a fresh, new, empty HistoryFile
+// Creates and initializes a new, empty HistoryFile.  Fails with ErrExists if
+// a HistoryFile already exists in the directory.
 func NewHistoryFile(OffsetCnt uint64, Directory string) (historyFile *HistoryFile, err error) {
+	return newHistoryFile(OffsetCnt, Directory, nil)
+}
+
+// newHistoryFile
+// Create a new HistoryFile, encrypted by blocks if crypt is not nil
+func newHistoryFile(OffsetCnt uint64, Directory string, crypt *crypter) (historyFile *HistoryFile, err error) {
 	if OffsetCnt < 0 || OffsetCnt > 102400 {
 		return nil, fmt.Errorf("index must be less than or equal to 10240, received %d", OffsetCnt)
 	}
@@ -77,7 +85,11 @@ func NewHistoryFile(OffsetCnt uint64, Directory string) (historyFile *HistoryFil
 	os.Mkdir(Directory, os.ModePerm)
 
 	hf.Filename = filepath.Join(Directory, historyFilename)
-	if hf.File, err = os.Create(hf.Filename); err != nil {
+	hf.flag, hf.crypt = os.O_RDWR, crypt
+	if hf.File, err = openStorage(hf.Filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644, crypt); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("%w: %s", ErrExists, hf.Filename)
+		}
 		return nil, err
 	}
 	hf.OffsetCnt = int32(OffsetCnt)
@@ -103,6 +115,61 @@ func NewHistoryFile(OffsetCnt uint64, Directory string) (historyFile *HistoryFil
 	return hf, nil
 }
 
+// OpenHistoryFile
+// Open an existing HistoryFile in the given directory and load its header
+func OpenHistoryFile(Directory string) (historyFile *HistoryFile, err error) {
+	return openHistoryFile(Directory, os.O_RDWR, nil)
+}
+
+// openHistoryFile
+// Open an existing HistoryFile with the given flag (os.O_RDWR or os.O_RDONLY),
+// encrypted by blocks if crypt is not nil
+func openHistoryFile(Directory string, flag int, crypt *crypter) (historyFile *HistoryFile, err error) {
+	hf := new(HistoryFile)
+	hf.Directory = Directory
+	hf.Filename = filepath.Join(Directory, historyFilename)
+	hf.flag, hf.crypt = flag, crypt
+	if hf.File, err = openStorage(hf.Filename, flag, os.ModePerm, crypt); err != nil {
+		return nil, err
+	}
+
+	var cnt [4]byte // The header starts with the count of KeySets
+	if _, err = hf.File.ReadAt(cnt[:], 0); err != nil {
+		return nil, err
+	}
+	hf.OffsetCnt = int32(binary.BigEndian.Uint32(cnt[:]))
+	hf.HeaderSize = 4 + KeySetSize*uint64(hf.OffsetCnt)
+	hf.KeySets = make([]*KeySet, hf.OffsetCnt)
+	hf.KeySetOffset = make([]*KeySet, hf.OffsetCnt)
+
+	header := make([]byte, hf.HeaderSize)
+	if _, err = hf.File.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	hf.Unmarshal(header)
+	return hf, nil
+}
+
+// Open
+// Reopen the HistoryFile after a Close
+func (hf *HistoryFile) Open() (err error) {
+	if hf.File == nil {
+		hf.File, err = openStorage(hf.Filename, hf.flag, os.ModePerm, hf.crypt)
+	}
+	return err
+}
+
+// Close
+// Close the HistoryFile; Open reopens it
+func (hf *HistoryFile) Close() (err error) {
+	if hf.File == nil {
+		return nil
+	}
+	err = hf.File.Close()
+	hf.File = nil
+	return err
+}
+
 // EOF
 // Return the last offset in the HistoryFile
 func (hf *HistoryFile) EOF() uint64 {
@@ -141,7 +208,8 @@ func (hf *HistoryFile) Unmarshal(data []byte) {
 	for i := uint64(0); i < uint64(hf.OffsetCnt); i++ {
 		ks := new(KeySet)
 		ks.OffsetIndex = i
-		ks.Unmarshal(data)
+		ks.KeySetIndex = i
+		ks.Unmarshal(data[i*KeySetSize:])
 		hf.KeySets[i] = ks
 		hf.KeySetOffset[i] = ks
 	}
@@ -163,7 +231,7 @@ func (hf *HistoryFile) AddKeys(keyList []byte) (err error) {
 	}
 
 	if len(keyList)%DBKeyFullSize != 0 {
-		return fmt.Errorf("keyList is the wrong length")
+		return fmt.Errorf("%w: %s: a keyList of %d bytes is not whole keys", ErrCorrupt, hf.Filename, len(keyList))
 	}
 
 	// Bloom filter is now managed by KFile, not HistoryFile
@@ -178,7 +246,7 @@ func (hf *HistoryFile) AddKeys(keyList []byte) (err error) {
 		case kIndex == index: // Key is part of this KeySet (of index)
 			endOff += DBKeyFullSize //Guess the end to avoid an end case
 		case kIndex < index:
-			return errors.New("keyList is not sorted")
+			return fmt.Errorf("%w: %s: keyList is not sorted into bins", ErrCorrupt, hf.Filename)
 		default:
 			if err := hf.UpdateKeySet(index, keyList[startOff:endOff]); err != nil {
 				return err
@@ -276,34 +344,58 @@ func (hf *HistoryFile) UpdateKeySet(index int, keyList []byte) (err error) {
 // is free for the user to use (i.e. not part of a buffer used
 // by the BFile)
 func (hf *HistoryFile) Get(Key [32]byte) (dbBKey *DBBKey, err error) {
+	buffer, err := hf.bin(hf.Index(Key)) // Read the section the key belongs to
+	if err != nil {
+		return nil, err
+	}
+	if dbBKey, err = findKey(buffer, Key); err == nil && dbBKey == nil {
+		err = ErrNotFound
+	}
+	return dbBKey, err
+}
+
+// bin
+// Read the section of the file holding the keys of the bin with the given
+// index; nil if it is empty
+func (hf *HistoryFile) bin(index int) (buffer []byte, err error) {
 
 	// The header reflects what is on disk.  Points keys to the section where it is.
-	index := hf.Index(Key)
 	start := hf.KeySets[index].Start // The index is where the section starts
 	end := hf.KeySets[index].End
 	keysLen := end - start
 
 	if keysLen == 0 { //                     If the start is the end, the section is empty
-		return nil, errors.New("not found") // TODO use buffer...
+		return nil, nil
 	}
 
 	// Use a local buffer instead of growing the shared buffer
 	// This prevents memory growth over time
-	buffer := make([]byte, keysLen)
+	buffer = make([]byte, keysLen)
 
 	if _, err = hf.File.ReadAt(buffer, int64(start)); err != nil { // Read the section
 		return nil, err
 	}
+	return buffer, nil
+}
 
-	var dbKey DBBKey                    //          Search the keys by unmarshaling each key as we search
-	for len(buffer) >= DBKeyFullSize { //          Search all DBBKey entries, note they are not sorted.
-		if [32]byte(buffer) == Key {
-			if _, err := dbKey.Unmarshal(buffer[:DBKeyFullSize]); err != nil {
-				return nil, err
+// ForEach
+// Call fn with every key in the HistoryFile and its DBBKey, one KeySet at a
+// time, until fn returns an error
+func (hf *HistoryFile) ForEach(fn func(key [32]byte, dbbKey *DBBKey) error) error {
+	for _, keySet := range hf.KeySets {
+		buffer := make([]byte, keySet.End-keySet.Start)
+		if _, err := hf.File.ReadAt(buffer, int64(keySet.Start)); err != nil {
+			return err
+		}
+		for ; len(buffer) >= DBKeyFullSize; buffer = buffer[DBKeyFullSize:] {
+			key, dbbKey, err := GetDBBKey(buffer)
+			if err != nil {
+				return err
+			}
+			if err = fn(key, dbbKey); err != nil {
+				return err
 			}
-			return &dbKey, nil
 		}
-		buffer = buffer[DBKeyFullSize:] //       Move to the next DBBKey
 	}
-	return nil, errors.New("not found")
+	return nil
 }
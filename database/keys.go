@@ -7,6 +7,18 @@ import (
 
 const DBKeyFullSize = 48
 
+const tombstoneOffset = ^uint64(0)   // Offset of a DBBKey that marks a deleted key
+const clearedOffset = ^uint64(0) - 1 // Offset of a DBBKey that marks a key as never written
+
+// The Length of a DBBKey of a compressed value has the top bit set, the length
+// of the value in bits 32-61, and the bytes stored in the values file in bits
+// 0-31; see compress.go.  Bit 62 is set if the value is encrypted, in which
+// case the bytes stored include sealOverhead; see crypt.go.
+const (
+	compressedFlag = uint64(1) << 63
+	encryptedFlag  = uint64(1) << 62
+)
+
 type DBBKey struct {
 	Offset uint64
 	Length uint64
@@ -27,6 +39,52 @@ func (d *DBBKey) Bytes(address [32]byte) []byte {
 	return b[:]
 }
 
+// IsDeleted
+// Returns true if the DBBKey is a tombstone, marking a deleted key
+func (d *DBBKey) IsDeleted() bool {
+	return d.Offset == tombstoneOffset
+}
+
+// IsCleared
+// Returns true if the DBBKey marks a key as never written.  Unlike a
+// tombstone, a cleared key in the DynaKV does not hide the key in the PermKV.
+func (d *DBBKey) IsCleared() bool {
+	return d.Offset == clearedOffset
+}
+
+// IsCompressed
+// Returns true if the value the DBBKey points to is stored compressed
+func (d *DBBKey) IsCompressed() bool {
+	return d.Length&compressedFlag != 0
+}
+
+// IsEncrypted
+// Returns true if the value the DBBKey points to is stored encrypted
+func (d *DBBKey) IsEncrypted() bool {
+	return d.Length&encryptedFlag != 0
+}
+
+// Size
+// Returns the number of bytes the value takes in the values file
+func (d *DBBKey) Size() uint64 {
+	if d.IsCompressed() {
+		return d.Length & 0xFFFFFFFF
+	}
+	return d.Length &^ encryptedFlag
+}
+
+// ValueLength
+// Returns the length of the value, once decrypted and decompressed
+func (d *DBBKey) ValueLength() uint64 {
+	switch {
+	case d.IsCompressed():
+		return (d.Length &^ (compressedFlag | encryptedFlag)) >> 32
+	case d.IsEncrypted():
+		return d.Size() - sealOverhead
+	}
+	return d.Length
+}
+
 // GetDBBKey
 // Converts a byte slice into an Address and a DBBKey
 func GetDBBKey(data []byte) (address [32]byte, dBBKey *DBBKey, err error) {
@@ -39,7 +97,7 @@ func GetDBBKey(data []byte) (address [32]byte, dBBKey *DBBKey, err error) {
 // Returns the address and the DBBKey from a slice of bytes
 func (d *DBBKey) Unmarshal(data []byte) (address [32]byte, err error) {
 	if len(data) < DBKeyFullSize {
-		return address, fmt.Errorf("data source is short %d", len(data))
+		return address, fmt.Errorf("%w: data source is short %d", ErrCorrupt, len(data))
 	}
 	copy(address[:], data[:32])
 	d.Offset = binary.BigEndian.Uint64(data[32:])
@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"sort"
@@ -15,6 +14,7 @@ import (
 const (
 	kFileName    string = "kfile.dat"     // Name of Key File
 	kTmpFileName string = "kfile_tmp.dat" // Name of the tmp file
+	maxTailKeys  uint64 = 1 << 16         // Most keys the tail holds before a Rebin, however big the base
 )
 
 // Block File
@@ -23,16 +23,28 @@ const (
 // KFile can operate in two modes based on whether history is enabled or disabled:
 //
 // 1. With History Enabled (used in PermKV):
-//    - Values are immutable - once a key is associated with a value, it cannot be changed
-//    - Attempting to overwrite a key with a different value will result in an error
-//    - Overwriting a key with the same value is allowed (no-op)
-//    - Suitable for content-addressed storage where keys are derived from values (e.g., hash of value)
-//    - Uses a Bloom filter to optimize key lookups and avoid unnecessary disk I/O
+//   - Values are immutable - once a key is associated with a value, it cannot be changed
+//   - Attempting to overwrite a key with a different value will result in an error
+//   - Overwriting a key with the same value is allowed (no-op)
+//   - Suitable for content-addressed storage where keys are derived from values (e.g., hash of value)
+//   - Uses a Bloom filter to optimize key lookups and avoid unnecessary disk I/O
 //
 // 2. With History Disabled (used in DynaKV):
-//    - Values are mutable - keys can be freely associated with different values over time
-//    - Overwriting a key with a different value is allowed
-//    - Suitable for state storage where keys have an arbitrary relationship to values
+//   - Values are mutable - keys can be freely associated with different values over time
+//   - Overwriting a key with a different value is allowed
+//   - Suitable for state storage where keys have an arbitrary relationship to values
+//
+// Layout of the kfile:
+//
+//	Header | base: keys sorted into bins | tail: keys in the order they were Put
+//
+// The Header offsets point into the base, which ends at EndOfList.  Put only
+// appends to the tail, and the tail is indexed in memory (Cache), so writing a
+// key costs the same no matter how big the kfile is.  When the tail grows past
+// its limit, Rebin sorts the base and tail into a new base.  A Rebin writes a
+// tmp file and renames it over the kfile, then syncs the directory, so a
+// crash leaves the old kfile or the new one.  Keys in the tail win over keys
+// in the base.
 //
 // Performance Optimizations:
 // - Uses a Bloom filter to quickly determine if a key definitely doesn't exist
@@ -44,70 +56,65 @@ type KFile struct {
 	Directory       string               // Directory of the BFile
 	File            *BFile               // Key File
 	History         *HistoryFile         // The History Database (nil if history is disabled)
-	Cache           map[[32]byte]*DBBKey // Cache of DBBKey Offsets
-	BlocksCached    int                  // Track blocks cached before rewritten
+	Cache           map[[32]byte]*DBBKey // Index of the keys in the tail
+	TailCnt         uint64               // Number of entries in the tail
 	HistoryMutex    sync.Mutex           // Allow the History to be merged in background
 	KeyCnt          uint64               // Number of keys in the current KFile
 	TotalCnt        uint64               // Total number of keys processed
 	OffsetCnt       uint64               // Number of key sets in the kFile
 	KeyLimit        uint64               // How many keys triggers to send keys to History
-	MaxCachedBlocks int                  // Maximum number of keys cached before flushing to kfile
+	MaxCachedBlocks int                  // Buffers of keys in the tail before a Rebin
 	HistoryOffsets  int                  // History offset cnt
 	BloomFilter     *Bloom               // Bloom filter for quick key existence checks
+	opts            *Options             // Options the KFile was created or opened with
 }
 
 // Open
-// Open an existing k.File
-func OpenKFile(directory string) (kFile *KFile, err error) {
+// Open an existing k.File.  The offset table is loaded from the header on disk,
+// so opts.OffsetsCnt and opts.History are ignored here.
+func OpenKFile(directory string, opts *Options) (kFile *KFile, err error) {
+	opts = opts.withDefaults()
 	kFile = new(KFile)
 
 	kFile.Directory = directory
+	kFile.opts = opts
+	kFile.KeyLimit = opts.KeyLimit
+	kFile.MaxCachedBlocks = opts.MaxCachedBlocks
 	filename := filepath.Join(directory, kFileName)
-	if kFile.File, err = OpenBFile(filename); err != nil {
+	if kFile.File, err = OpenBFile(filename, opts); err != nil {
+		return nil, err
+	}
+	if err = kFile.LoadHeader(); err != nil {
+		return nil, err
+	}
+	if err = kFile.LoadTail(); err != nil {
 		return nil, err
 	}
-	kFile.Cache = make(map[[32]byte]*DBBKey)
-	kFile.BlocksCached = 0
 
 	// Check if there's a history file and open it
-	historyFilename := filepath.Join(directory, historyFilename)
-	if _, err := os.Stat(historyFilename); err == nil {
-		// History file exists, open it
-		hf := new(HistoryFile)
-		hf.Directory = directory
-		hf.Filename = historyFilename
-		if hf.File, err = os.OpenFile(historyFilename, os.O_RDWR, 0644); err != nil {
-			return nil, err
-		}
-		
-		// Read the header
-		header := make([]byte, 4)
-		if _, err = hf.File.ReadAt(header, 0); err != nil {
-			return nil, err
+	if _, err := os.Stat(filepath.Join(directory, historyFilename)); err == nil {
+		flag := os.O_RDWR
+		if opts.readOnly {
+			flag = os.O_RDONLY
 		}
-		hf.OffsetCnt = int32(binary.BigEndian.Uint32(header))
-		hf.HeaderSize = 4 + KeySetSize*uint64(hf.OffsetCnt)
-		
-		// Read the KeySets
-		keySetsData := make([]byte, hf.HeaderSize-4)
-		if _, err = hf.File.ReadAt(keySetsData, 4); err != nil {
+		if kFile.History, err = openHistoryFile(directory, flag, opts.crypt); err != nil {
 			return nil, err
 		}
-		hf.Unmarshal(append(header, keySetsData...))
-		
-		// The Bloom filter will be initialized and populated when Open is called
-		
-		kFile.History = hf
 	}
 
+	// Open builds the Bloom filter from the keys in the kFile and the History
+	if err = kFile.Open(); err != nil {
+		return nil, err
+	}
 	return kFile, nil
 }
 
 // NewKFile
-// Creates a new KFile directory (holds a key file and a value file)
-// Overwrites any existing KFile directory
+// Creates a new KFile directory (holds a key file and a value file).
+// Fails with ErrExists if a KFile exists in the directory, unless
+// opts.Overwrite is set.
 //
-// The 'history' parameter determines the behavior of the KFile:
+// opts.History determines the behavior of the KFile:
 // - When true: Values are immutable. Once a key is associated with a value, it cannot be changed.
 //   This is suitable for content-addressed storage where keys are derived from values.
 // - When false: Values are mutable. Keys can be freely associated with different values over time.
@@ -116,36 +123,38 @@ func OpenKFile(directory string) (kFile *KFile, err error) {
 // When height is increased, the old kfile is renamed, and a new kfile
 // is created. The old kfile is then merged into the kFileHistory.dat
 
-func NewKFile(
-	history bool, // Controls whether values are immutable (true) or mutable (false)
-	directory string,
-	offsetCnt uint64,
-	keyLimit uint64,
-	maxCachedBlocks int) (kFile *KFile, err error) {
+func NewKFile(directory string, opts *Options) (kFile *KFile, err error) {
+	opts = opts.withDefaults()
 	kFile = new(KFile)
 
 	filename := kFileName
 	kFile.Directory = directory
-	if kFile.File, err = NewBFile(filepath.Join(directory, filename)); err != nil {
+	kFile.opts = opts
+	if _, err = os.Stat(filepath.Join(directory, filename)); err == nil && !opts.Overwrite {
+		return nil, fmt.Errorf("%w: %s", ErrExists, filepath.Join(directory, filename))
+	}
+	if opts.Overwrite {
+		os.Remove(filepath.Join(directory, historyFilename)) // NewHistoryFile will not replace one
+	}
+	if kFile.File, err = NewBFile(filepath.Join(directory, filename), opts); err != nil {
 		return nil, err
 	}
-	
+
 	// Only create a history file if history is enabled
-	if history {
-		if kFile.History, err = NewHistoryFile(offsetCnt, directory); err != nil {
+	if opts.History {
+		if kFile.History, err = newHistoryFile(opts.OffsetsCnt, directory, opts.crypt); err != nil {
 			return nil, err
 		}
 	}
-	
-	kFile.KeyLimit = keyLimit
-	kFile.MaxCachedBlocks = maxCachedBlocks
-	kFile.Header.Init(offsetCnt)
+
+	kFile.KeyLimit = opts.KeyLimit
+	kFile.MaxCachedBlocks = opts.MaxCachedBlocks
+	kFile.Header.Init(opts.OffsetsCnt)
 	kFile.WriteHeader()
 	kFile.Cache = make(map[[32]byte]*DBBKey)
-	
-	// Initialize the Bloom filter with a reasonable size
-	// Using 10MB as a size, which is a good balance between memory usage and false positive rate
-	kFile.BloomFilter = NewBloomFilter(10.0, 3) // 10MB Bloom filter with 3 hash functions
+
+	// Initialize the Bloom filter with the configured size
+	kFile.BloomFilter = NewBloomFilter(opts.BloomSize, opts.BloomHashes)
 
 	return kFile, err
 }
@@ -154,114 +163,213 @@ func NewKFile(
 // Creates a new kFile height.  Merges the keys of the current kFile into the History.
 // Resets the KFile to accept more keys.
 func (k *KFile) PushHistory() (err error) {
-	// If history is disabled, just reset the KFile without pushing to history
-	if k.History == nil {
-		// Close the current file
-		if err = k.Close(); err != nil {
-			return err
+	if k.opts.readOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	keyValues, keyList, err := k.GetKeyList()
+	if err != nil {
+		return err
+	}
+
+	// Start over with an empty kfile.  Without a History, the keys are
+	// dropped; Put never pushes a KFile that has no History.
+	if err = k.writeKFile(nil, nil); err != nil {
+		return err
+	}
+
+	// Only attempt to push to history if we have keys to push
+	if k.History == nil || len(keyList) == 0 {
+		return nil
+	}
+
+	// Create a buffer for the keys
+	buff := make([]byte, len(keyList)*DBKeyFullSize)
+	buffPtr := buff
+	for _, key := range keyList {
+		copy(buffPtr, (*keyValues[key]).Bytes(key))
+		buffPtr = buffPtr[DBKeyFullSize:]
+	}
+
+	k.HistoryMutex.Lock()
+	defer k.HistoryMutex.Unlock()
+	if err = k.History.AddKeys(buff); err != nil {
+		return fmt.Errorf("Error sending data to history: %w", err)
+	}
+	return nil
+}
+
+// Rebin
+// Sort the keys in the tail into the bins of the base.  The new kfile is
+// written to a tmp file and renamed over the kfile.
+func (k *KFile) Rebin() (err error) {
+	_, err = k.Purge(func(key [32]byte, dbbKey *DBBKey) bool {
+		return dbbKey.IsCleared() // Cleared keys need not take up room in the base
+	})
+	return err
+}
+
+// Purge
+// Rebin the kfile, dropping the keys for which drop returns true.  Returns the
+// number of keys dropped.
+func (k *KFile) Purge(drop func(key [32]byte, dbbKey *DBBKey) bool) (dropped int, err error) {
+	if k.opts.readOnly {
+		return 0, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	keyValues, keyList, err := k.GetKeyList()
+	if err != nil {
+		return 0, err
+	}
+	kept := keyList[:0]
+	for _, key := range keyList {
+		if drop(key, keyValues[key]) {
+			delete(keyValues, key)
+			dropped++
+		} else {
+			kept = append(kept, key)
 		}
-		
-		// Remove the old file
-		if err = os.Remove(filepath.Join(k.Directory, kFileName)); err != nil {
-			return err
+	}
+	k.opts.Metrics.KeyFlushes.Add(1)
+	return dropped, k.writeKFile(keyValues, kept)
+}
+
+// tailLimit
+// The number of entries the tail can hold before a Rebin.  The limit is
+// MaxCachedBlocks buffers of keys, or a quarter of the keys in the base,
+// whichever is larger, so the cost of rebinning stays proportional to the
+// keys written.  The quarter of the base is capped at maxTailKeys, which
+// bounds the memory the Cache of the tail takes.
+func (k *KFile) tailLimit() uint64 {
+	limit := uint64(k.MaxCachedBlocks) * uint64(len(k.File.Buffer)) / DBKeyFullSize
+	quarter := (k.EndOfList - uint64(k.HeaderSize)) / DBKeyFullSize / 4
+	if quarter > maxTailKeys {
+		quarter = maxTailKeys
+	}
+	if quarter > limit {
+		limit = quarter
+	}
+	return limit
+}
+
+// writeKFile
+// Replace the kfile with one holding the given keys, sorted into bins, as its
+// base and an empty tail.  The keys are written to a tmp file that is then
+// renamed over the kfile.
+func (k *KFile) writeKFile(keyValues map[[32]byte]*DBBKey, keyList [][32]byte) (err error) {
+	var currentOffset uint64 = uint64(k.HeaderSize) // Set to the location of the first key in the file
+	lastIndex := -1                                 // This is the "last" offset processed. Start below 0
+	for _, key := range keyList {                   // Note that this never updates the first offset. That's okay, it doesn't change
+		index := k.OffsetIndex(key[:]) //       Use the first two bytes as the index
+		if lastIndex < int(index) {    //       If this index is greater than the last
+			lastIndex++                                 // Don't overwrite the previous offset
+			for ; lastIndex < int(index); lastIndex++ { // Update any skipped offsets
+				k.Offsets[lastIndex] = currentOffset //
+			}
+			k.Offsets[lastIndex] = currentOffset //        Set this offset
 		}
-		
-		// Create a new file
-		if k.File, err = NewBFile(filepath.Join(k.Directory, kFileName)); err != nil {
+		currentOffset += DBKeyFullSize //                      Add the size of the entry for next offset
+	}
+
+	// Fill in the rest of the offsets table;
+	for i := lastIndex + 1; i < int(k.OffsetsCnt); i++ {
+		k.Header.Offsets[i] = currentOffset
+	}
+	k.Header.EndOfList = currentOffset // End of List is where the currentOffset was left
+
+	tmp, err := NewBFile(filepath.Join(k.Directory, kTmpFileName), k.opts)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(k.Header.Marshal()); err != nil {
+		return err
+	}
+	for _, key := range keyList { // Write all the keys following the Header
+		if _, err = tmp.Write(keyValues[key].Bytes(key)); err != nil {
 			return err
 		}
-		
-		// Initialize the header
-		k.Header.Init(uint64(k.OffsetsCnt))
-		k.Close()
-		k.Open()
-		
-		return nil
 	}
-	
-	// Normal history-enabled flow
-	if err = k.Close(); err != nil {
+	if err = tmp.Flush(); err != nil {
 		return err
 	}
-	
-	keyValues, keyList, err := k.GetKeyList()
-	if err != nil {
+	if k.opts.Sync != SyncNever { // The tmp file has to be on disk before it replaces the kfile
+		if err = tmp.File.Sync(); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Close(); err != nil {
 		return err
 	}
-	
-	if err = os.Remove(filepath.Join(k.Directory, kFileName)); err != nil {
+	if err = k.File.Close(); err != nil {
 		return err
 	}
-	
-	if k.File, err = NewBFile(filepath.Join(k.Directory, kFileName)); err != nil {
+	if err = os.Rename(tmp.Filename, k.File.Filename); err != nil {
 		return err
 	}
-	
-	k.Header.Init(uint64(k.OffsetsCnt))
-	k.Close()
-	k.Open()
-	
-	// Only attempt to push to history if we have keys to push
-	if len(keyList) > 0 {
-		// Process history synchronously to prevent memory buildup
-		
-		// Create a buffer for the keys
-		buff := make([]byte, len(keyList)*DBKeyFullSize)
-		buffPtr := buff
-		for _, key := range keyList {
-			// Add key to Bloom filter before pushing to history
-			if k.BloomFilter != nil {
-				k.BloomFilter.Set(key)
-			}
-			
-			copy(buffPtr, (*keyValues[key]).Bytes(key))
-			buffPtr = buffPtr[DBKeyFullSize:]
-		}
-		
-		// Clear references to help with garbage collection
-		keyValues = nil
-		keyList = nil
-		
-		k.HistoryMutex.Lock()
-		
-		// Double-check that History is still valid before using it
-		if k.History != nil {
-			// Add keys to history
-			if err = k.History.AddKeys(buff); err != nil {
-				k.HistoryMutex.Unlock()
-				return fmt.Errorf("Error sending data to history: %v", err)
-			}
+	if k.opts.Sync != SyncNever { // The rename too, or a crash could bring back the old kfile
+		if err = syncDir(k.Directory); err != nil {
+			return err
 		}
-		
-		k.HistoryMutex.Unlock()
-		
-		// Clear the buffer to help with garbage collection
-		buff = nil
 	}
-	
+	if k.File, err = OpenBFile(filepath.Join(k.Directory, kFileName), k.opts); err != nil {
+		return err
+	}
+	k.Cache = make(map[[32]byte]*DBBKey)
+	k.TailCnt = 0
 	return nil
 }
 
+// syncDir
+// Sync the directory, so the files renamed into it stay renamed after a crash
+func syncDir(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if err2 := dir.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
 // Open
 // Make sure the underlying File is open for adding keys.  Sets the
 // location in the file for writing to the end of the file.
 func (k *KFile) Open() error {
-	// Initialize the Bloom filter if it doesn't exist
+	// Build the Bloom filter the first time the KFile is opened.  Keys that
+	// are already on disk (in the kFile or the History) have to be added.
 	if k.BloomFilter == nil {
-		// Using 10MB as a size, which is a good balance between memory usage and false positive rate
-		k.BloomFilter = NewBloomFilter(10.0, 3) // 10MB Bloom filter with 3 hash functions
+		k.BloomFilter = NewBloomFilter(k.opts.BloomSize, k.opts.BloomHashes)
+		if err := k.PopulateBloomFilterFromKFile(); err != nil {
+			return err
+		}
+		if err := k.PopulateBloomFilterFromHistory(); err != nil {
+			return err
+		}
 	}
-	
-	// If history is enabled, populate the Bloom filter with keys from history
 	if k.History != nil {
-		if err := k.PopulateBloomFilterFromHistory(); err != nil {
+		if err := k.History.Open(); err != nil {
 			return err
 		}
 	}
-	
 	return k.File.Open()
 }
 
+// PopulateBloomFilterFromKFile
+// Adds all the keys in the kFile on disk to the Bloom filter
+func (k *KFile) PopulateBloomFilterFromKFile() error {
+	if k.BloomFilter == nil || k.File.EOD <= uint64(k.HeaderSize) {
+		return nil
+	}
+	keys := make([]byte, k.File.EOD-uint64(k.HeaderSize))
+	if err := k.File.ReadAt(uint64(k.HeaderSize), keys); err != nil {
+		return err
+	}
+	for ; len(keys) >= DBKeyFullSize; keys = keys[DBKeyFullSize:] {
+		k.BloomFilter.Set([32]byte(keys))
+	}
+	return nil
+}
+
 // Use the min function from history_file.go
 
 // PopulateBloomFilterFromHistory
@@ -271,9 +379,9 @@ func (k *KFile) PopulateBloomFilterFromHistory() error {
 	if k.History == nil || k.BloomFilter == nil {
 		return nil
 	}
-	
+
 	hf := k.History
-	
+
 	// Iterate through all KeySets in the history file
 	for i := 0; i < int(hf.OffsetCnt); i++ {
 		start := hf.KeySets[i].Start
@@ -317,7 +425,11 @@ func (k *KFile) PopulateBloomFilterFromHistory() error {
 // LoadHeader
 // Load the Header out of the Key File
 func (k *KFile) LoadHeader() (err error) {
-	h := make([]byte, k.HeaderSize)
+	var sizes [8]byte // OffsetsCnt and HeaderSize lead the header
+	if err = k.File.ReadAt(0, sizes[:]); err != nil {
+		return err
+	}
+	h := make([]byte, binary.BigEndian.Uint32(sizes[4:]))
 	if err = k.File.ReadAt(0, h); err != nil {
 		return err
 	}
@@ -342,60 +454,93 @@ func (k *KFile) Get(Key [32]byte) (dbBKey *DBBKey, err error) {
 	if value, ok := k.Cache[Key]; ok {
 		return value, nil
 	}
-	
+
 	// If we have a Bloom filter, check it before doing any disk I/O
 	// If the Bloom filter says the key doesn't exist, it's definitely not in the file or history
 	if k.BloomFilter != nil && !k.BloomFilter.Test(Key) {
-		return nil, errors.New("not found")
+		return nil, ErrNotFound
 	}
-	
+
 	// Try to get the key from the current file
 	dbBKey, err = k.kGet(Key)
 	if err == nil {
 		return dbBKey, nil
 	}
-	
+
 	// If not found and history is enabled, try to get from history
 	if k.History != nil {
 		k.HistoryMutex.Lock()
 		defer k.HistoryMutex.Unlock()
 		return k.History.Get(Key)
 	}
-	
+
 	// If no history or not found in history, return the original error
 	return nil, err
 }
 
-// LoadKeys
-// Loads all the keys
+// Has
+// Returns the length of the value of the key, and true if the KFile has the
+// key.  A deleted or cleared key is not there.  Only the cache, the Bloom
+// filter, the key file and the HistoryFile are read.
+func (k *KFile) Has(Key [32]byte) (length uint64, ok bool, err error) {
+	dbBKey, err := k.Get(Key)
+	if errors.Is(err, ErrNotFound) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	if dbBKey.IsDeleted() || dbBKey.IsCleared() {
+		return 0, false, nil
+	}
+	return dbBKey.ValueLength(), true, nil
+}
 
 // kGet
 // Get the value for a given DBKeyFull from the file (not cache).  The value returned
 // is free for the user to use (i.e. not part of a buffer used
 // by the BFile)
 func (k *KFile) kGet(Key [32]byte) (dbBKey *DBBKey, err error) {
+	keys, err := k.kBin(k.OffsetIndex(Key[:])) // Read the section the key belongs to
+	if err != nil {
+		return nil, err
+	}
+	if dbBKey, err = findKey(keys, Key); err == nil && dbBKey == nil {
+		err = ErrNotFound
+	}
+	return dbBKey, err
+}
+
+// kBin
+// Read the section of the file holding the keys of the bin with the given
+// index; nil if it is empty
+func (k *KFile) kBin(index int) (keys []byte, err error) {
 
 	// The header reflects what is on disk.  Points keys to the section where it is.
-	index := k.OffsetIndex(Key[:])
 	var start, end uint64         // The header gives us offsets to key sections
 	start = k.Offsets[index]      // The index is where the section starts
 	if index < len(k.Offsets)-1 { // Handle the last Offset special
 		end = k.Offsets[index+1] //
-	} else { //                              The last section ends at EOD
-		end = k.File.EOD //
+	} else { //                              The last section ends at the end of the base
+		end = k.EndOfList //
 
 	}
 
 	if start == end { //                     If the start is the end, the section is empty
-		return nil, errors.New("not found")
+		return nil, nil
 	}
 
-	keys := make([]byte, end-start) //       Create a buffer for the section
+	keys = make([]byte, end-start) //       Create a buffer for the section
 
 	if err = k.File.ReadAt(start, keys); err != nil { // Read the section
 		return nil, err
 	}
+	return keys, nil
+}
 
+// findKey
+// Search a section of DBBKey entries for the key.  Returns nil if it is not
+// there.
+func findKey(keys []byte, Key [32]byte) (dbBKey *DBBKey, err error) {
 	var dbKey DBBKey                 //          Search the keys by unmarshaling each key as we search
 	for len(keys) >= DBKeyFullSize { //          Search all DBBKey entries, note they are not sorted.
 		if [32]byte(keys) == Key {
@@ -406,36 +551,39 @@ func (k *KFile) kGet(Key [32]byte) (dbBKey *DBBKey, err error) {
 		}
 		keys = keys[DBKeyFullSize:] //       Move to the next DBBKey
 	}
-	return nil, errors.New("not found")
+	return nil, nil
 }
 
 // Put
 // Put a key value pair into the BFile, return the *DBBKeyFull
 //
 // Behavior depends on whether history is enabled:
-// - With history enabled (k.History != nil): Values are immutable. If the key already exists
-//   with a different value, an error is returned. Overwriting with the same value is a no-op.
-// - With history disabled (k.History == nil): Values are mutable. Keys can be freely overwritten
-//   with different values.
+//   - With history enabled (k.History != nil): Values are immutable. If the key already exists
+//     with a different value, an error is returned. Overwriting with the same value is a no-op.
+//   - With history disabled (k.History == nil): Values are mutable. Keys can be freely overwritten
+//     with different values.
 //
 // This design supports two use cases:
-// 1. Content-addressed storage (history enabled): Where keys are derived from values (e.g., hash)
-//    and immutability is required.
-// 2. State storage (history disabled): Where keys have an arbitrary relationship to values and
-//    need to be updated over time.
+//  1. Content-addressed storage (history enabled): Where keys are derived from values (e.g., hash)
+//     and immutability is required.
+//  2. State storage (history disabled): Where keys have an arbitrary relationship to values and
+//     need to be updated over time.
 func (k *KFile) Put(Key [32]byte, dbBKey *DBBKey) (err error) {
+	if k.opts.readOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
 	// If history is enabled, check if this key already exists with a different value
 	if k.History != nil {
 		// First check the cache
 		if existingKey, ok := k.Cache[Key]; ok {
 			// Key exists in cache, compare values
 			if !bytes.Equal(existingKey.Bytes(Key), dbBKey.Bytes(Key)) {
-				return errors.New("cannot overwrite immutable value when history is enabled")
+				return fmt.Errorf("%w: cannot overwrite immutable value when history is enabled: %x", ErrImmutable, Key[:8])
 			}
 			// If values are the same, this is a no-op
 			return nil
 		}
-		
+
 		// Use the Bloom filter to avoid disk lookup if possible
 		// If the Bloom filter says the key doesn't exist, we can skip the expensive disk lookup
 		if k.BloomFilter != nil && !k.BloomFilter.Test(Key) {
@@ -446,158 +594,98 @@ func (k *KFile) Put(Key [32]byte, dbBKey *DBBKey) (err error) {
 			if err == nil {
 				// Key exists in file, compare values
 				if !bytes.Equal(existingKey.Bytes(Key), dbBKey.Bytes(Key)) {
-					return errors.New("cannot overwrite immutable value when history is enabled")
+					return fmt.Errorf("%w: cannot overwrite immutable value when history is enabled: %x", ErrImmutable, Key[:8])
 				}
 				// If values are the same, this is a no-op
-				k.Cache[Key] = dbBKey // Update cache with the existing value
 				return nil
-			} else if err.Error() != "not found" {
-				// If there was an error other than "not found", return it
+			} else if !errors.Is(err, ErrNotFound) {
+				// If there was an error other than ErrNotFound, return it
 				return err
 			}
 		}
 		// If key doesn't exist, proceed with the write
 	}
-	
-	// Add to the cache
+
+	// Add to the index of the tail
 	k.Cache[Key] = dbBKey
-	
+
 	// Add to the Bloom filter if it exists
 	if k.BloomFilter != nil {
 		k.BloomFilter.Set(Key)
 	}
-	
+
 	k.KeyCnt++
 	k.TotalCnt++
-	update, err := k.File.Write(dbBKey.Bytes(Key)) // Write the key to the file
-	if err != nil {
-		// If write fails, remove from cache
-		delete(k.Cache, Key)
+	k.TailCnt++
+	if _, err = k.File.Write(dbBKey.Bytes(Key)); err != nil { // Append the key to the tail
 		return err
 	}
-	
-	if update {                                    // If the file was updated && time to clear cache
-		if k.BlocksCached <= 0 {
-			if err = k.Close(); err != nil { //           In order to allow access to keys written to disk
-				return err //                               the file has to be closed and opened to update
-			} //                                            the key offsets
-			
-			// Save our cache
-			tempCache := make(map[[32]byte]*DBBKey)
-			for key, val := range k.Cache {
-				tempCache[key] = val
-			}
-			
-			// Clear the cache as required by the original implementation
-			clear(k.Cache)
-			
-			if err = k.File.Open(); err != nil { //       Reopen the file
-				return err
-			}
-			
-			// Restore our cache
-			for key, val := range tempCache {
-				k.Cache[key] = val
-			}
-			
-			k.BlocksCached = k.MaxCachedBlocks
-		} else {
-			k.BlocksCached--
-		}
-	}
-	
-	if k.KeyCnt > k.KeyLimit {
+
+	if k.History != nil && k.KeyCnt > k.KeyLimit {
 		k.KeyCnt = 0
-		
-		// Push to history - we've modified PushHistory to be synchronous
-		if err = k.PushHistory(); err != nil {
-			return err
-		}
-		
-		// Clear the cache to reduce memory footprint
-		// We don't need to preserve the cache since all keys are now in history
-		clear(k.Cache)
+		return k.PushHistory() // Moves all the keys to the History, leaving an empty kfile
+	}
+	if k.TailCnt > k.tailLimit() {
+		return k.Rebin()
 	}
-	
 	return nil
 }
 
 // Flush
-// Flush the buffer to disk, and clear the cache
+// Flush the buffered keys to the tail on disk.  A read-only KFile has
+// nothing to flush, and its header is never rewritten.
 func (k *KFile) Flush() (err error) {
-	if err = k.WriteHeader(); err != nil {
-		return err
-	}
-
-	if err = k.File.Flush(); err != nil {
-		return err
+	if k.opts.readOnly {
+		return nil
 	}
-
-	clear(k.Cache)
-	return nil
+	return k.File.Flush()
 }
 
 // Close
-// Take everything in flight and write it to disk, then close the file.
-// Note that if an error occurs while updating the BFile, the BFile
-// will be trashed.
+// Flush the buffered keys to the tail on disk, and close the file.  The keys
+// stay in the tail until the next Rebin.
 func (k *KFile) Close() (err error) {
-
-	keyValues, keyList, err := k.GetKeyList()
-	if err != nil {
+	if err = k.File.Close(); err != nil {
 		return err
 	}
-	if keyList == nil {
-		return nil
-	}
-
-	// Now we have a set of bin-sorted keys
-
-	var currentOffset uint64 = uint64(k.HeaderSize) // Set to the location of the first key in the file
-	lastIndex := -1                                 // This is the "last" offset processed. Start below 0
-	for _, key := range keyList {                   // Note that this never updates the first offset. That's okay, it doesn't change
-		index := k.OffsetIndex(key[:]) //       Use the first two bytes as the index
-		if lastIndex < int(index) {    //       If this index is greater than the last
-			lastIndex++                                 // Don't overwrite the previous offset
-			for ; lastIndex < int(index); lastIndex++ { // Update any skipped offsets
-				k.Offsets[lastIndex] = currentOffset //
-			}
-			k.Offsets[lastIndex] = currentOffset //        Set this offset
-		}
-		currentOffset += DBKeyFullSize //                      Add the size of the entry for next offset
-	}
-
-	// Fill in the rest of the offsets table;
-	for i := lastIndex + 1; i < int(k.OffsetsCnt); i++ {
-		k.Header.Offsets[i] = currentOffset
+	if k.History != nil {
+		return k.History.Close()
 	}
-	k.Header.EndOfList = currentOffset // End of List is where the currentOffset was left
+	return nil
+}
 
-	err = k.File.File.Close()
-	if err != nil {
-		return err
-	}
-	err = os.Remove(k.File.Filename)
-	if err != nil {
-		return err
+// LoadTail
+// Read the keys in the tail into the Cache.  A partial key at the end of the
+// tail, left by a crash in the middle of a write, is dropped.
+func (k *KFile) LoadTail() (err error) {
+	k.Cache = make(map[[32]byte]*DBBKey)
+	k.TailCnt = 0
+	if k.File.EOD <= k.EndOfList {
+		return nil
 	}
-	if k.File.File, err = os.Create(k.File.Filename); err != nil {
+	tail := make([]byte, k.File.EOD-k.EndOfList)
+	if err = k.File.ReadAt(k.EndOfList, tail); err != nil {
 		return err
 	}
-	err = k.WriteHeader()
-	if err != nil {
-		return err
+	if partial := len(tail) % DBKeyFullSize; partial != 0 {
+		tail = tail[:len(tail)-partial]
+		if !k.opts.readOnly {
+			if err = k.File.File.Truncate(int64(k.EndOfList) + int64(len(tail))); err != nil {
+				return err
+			}
+			k.File.EOD = k.EndOfList + uint64(len(tail))
+		}
 	}
-	// Write all the keys following the Header
-	for _, key := range keyList {
-		keyB := keyValues[key].Bytes(key)
-		_, err = k.File.Write(keyB)
+	for ; len(tail) > 0; tail = tail[DBKeyFullSize:] {
+		dbbKey := new(DBBKey)
+		key, err := dbbKey.Unmarshal(tail)
 		if err != nil {
 			return err
 		}
+		k.Cache[key] = dbbKey // Later entries in the tail win
+		k.TailCnt++
 	}
-
-	return k.File.Close()
+	return nil
 }
 
 // GetKeyList
@@ -610,15 +698,12 @@ func (k *KFile) GetKeyList() (keyValues map[[32]byte]*DBBKey, KeyList [][32]byte
 		return nil, nil, err
 	}
 
-	// TODO: Use ReadAt
-	_, err = k.File.File.Seek(int64(k.HeaderSize), io.SeekStart)
-	if err != nil {
-		return nil, nil, err
-	}
-	keyEntriesBytes, err := io.ReadAll(k.File.File)
-	if err != nil {
+	// The base, followed by the tail, so keys in the tail win
+	keyEntriesBytes := make([]byte, k.File.EOD-uint64(k.HeaderSize))
+	if err = k.File.ReadAt(uint64(k.HeaderSize), keyEntriesBytes); err != nil {
 		return nil, nil, err
 	}
+	keyEntriesBytes = keyEntriesBytes[:len(keyEntriesBytes)/DBKeyFullSize*DBKeyFullSize]
 	numKeys := len(keyEntriesBytes) / DBKeyFullSize
 	if numKeys == 0 {
 		return nil, nil, err
@@ -652,7 +737,7 @@ func (k *KFile) GetKeyList() (keyValues map[[32]byte]*DBBKey, KeyList [][32]byte
 	sort.Slice(KeyList, func(i, j int) bool {
 		a := k.OffsetIndex(KeyList[i][:]) // Bin for a
 		b := k.OffsetIndex(KeyList[j][:]) // Bin for b
-		return a < b // Sort in ascending order
+		return a < b                      // Sort in ascending order
 	})
 
 	return keyValues, KeyList, nil
@@ -6,15 +6,14 @@ const IndexOffsets = 0 // byte index to a 16 bit int used to define keysets in a
 const IndexShards = 4  // byte index to a 16 bit int used to define a shard for a key
 
 // Offset table for all the indexes in the KFile
-// EndOfList is necessary because when we close the KFile, the list
-// of keys will often be smaller.  So the file will have stuff past
-// the key list we need to ignore.  This way, we have an offset to
-// the end of valid keys.
+// EndOfList marks the end of the keys sorted into bins (the base).  Keys
+// past EndOfList are the tail; keys Put since the last Rebin, in the order
+// they were written.
 type Header struct {
 	OffsetsCnt uint32   // Number of bins in the Offset Table
 	HeaderSize uint32   // Length of the header
 	Offsets    []uint64 // List of offsets
-	EndOfList  uint64   // Offset marking end of the last Key section
+	EndOfList  uint64   // Offset marking end of the base (the last Key section)
 }
 
 // OffsetIndex
@@ -2,7 +2,10 @@ package blockchainDB
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"slices"
 	"testing"
 	"time"
@@ -19,7 +22,7 @@ func TestKFile(t *testing.T) {
 	const keyLimit = 1000
 	const maxCachedBlocks = 50
 
-	kf, err := NewKFile(false, dir, offsetCnt, keyLimit, maxCachedBlocks)
+	kf, err := NewKFile(dir, &Options{OffsetsCnt: offsetCnt, KeyLimit: keyLimit, MaxCachedBlocks: maxCachedBlocks})
 	assert.NoError(t, err, "failed to create KFile")
 
 	fmt.Printf("Adding Keys\n")
@@ -103,7 +106,7 @@ func TestGetKeyList(t *testing.T) {
 	const keyLimit = 1000
 	const maxCachedBlocks = 50
 
-	kf, err := NewKFile(false, dir, offsetCnt, keyLimit, maxCachedBlocks)
+	kf, err := NewKFile(dir, &Options{OffsetsCnt: offsetCnt, KeyLimit: keyLimit, MaxCachedBlocks: maxCachedBlocks})
 	assert.NoError(t, err, "Failed to create kfile")
 
 	fr := NewFastRandom([]byte{0})
@@ -154,7 +157,7 @@ func TestImmutabilityWithHistory(t *testing.T) {
 	defer rm()
 
 	// Create KFile with history enabled - values should be immutable
-	kf, err := NewKFile(true, dir, 1024, 1000, 500)
+	kf, err := NewKFile(dir, &Options{History: true, OffsetsCnt: 1024, KeyLimit: 1000, MaxCachedBlocks: 500})
 	assert.NoError(t, err, "Failed to create kfile with history")
 
 	// Create a test key and value
@@ -189,6 +192,7 @@ func TestImmutabilityWithHistory(t *testing.T) {
 	err = kf.Put(key, newValue)
 	assert.Error(t, err, "Should not allow overwriting with different value when history is enabled")
 	assert.Contains(t, err.Error(), "cannot overwrite immutable value when history is enabled")
+	assert.True(t, errors.Is(err, ErrImmutable), "ErrImmutable")
 	
 	// Verify the original value is still there
 	retrievedValue, err = kf.Get(key)
@@ -214,7 +218,7 @@ func TestMutabilityWithoutHistory(t *testing.T) {
 	defer rm()
 
 	// Create KFile with history disabled - values should be mutable
-	kf, err := NewKFile(false, dir, 1024, 1000, 500)
+	kf, err := NewKFile(dir, &Options{OffsetsCnt: 1024, KeyLimit: 1000, MaxCachedBlocks: 500})
 	assert.NoError(t, err, "Failed to create kfile without history")
 
 	// Create a test key and value
@@ -254,3 +258,84 @@ func TestMutabilityWithoutHistory(t *testing.T) {
 	assert.NoError(t, err, "Should still be able to get the key")
 	assert.Equal(t, newValue.Bytes(key), retrievedValue.Bytes(key), "Retrieved value should match the new value")
 }
+
+func TestKFileTail(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	const numKeys = 2000
+	opts := &Options{OffsetsCnt: 64, MaxCachedBlocks: 1, BufferSize: DBKeyFullSize * 10, BloomSize: .1, Metrics: new(Metrics)}
+	kf, err := NewKFile(dir, opts)
+	assert.NoError(t, err, "failed to create KFile")
+
+	fr := NewFastRandom([]byte{1})
+	keys := make(map[[32]byte]*DBBKey)
+	for i := 0; i < numKeys; i++ {
+		key := fr.NextHash()
+		keys[key] = &DBBKey{Offset: uint64(i), Length: uint64(fr.UintN(1000))}
+		assert.NoError(t, kf.Put(key, keys[key]), "failed to put")
+	}
+	// The tail grows with the base, so the number of rebins grows with the log of the keys
+	rebins := opts.Metrics.KeyFlushes.Load()
+	assert.True(t, rebins > 0 && rebins < 40, "expected a few rebins, got %d", rebins)
+
+	// Update some keys; the tail wins over the base
+	for key := range keys {
+		if fr.UintN(10) < 3 {
+			keys[key] = &DBBKey{Offset: fr.Uint64(), Length: 1}
+			assert.NoError(t, kf.Put(key, keys[key]), "failed to update")
+		}
+	}
+	rebins = opts.Metrics.KeyFlushes.Load()
+	assert.NoError(t, kf.Close(), "failed to close")
+	assert.Equal(t, rebins, opts.Metrics.KeyFlushes.Load(), "Close should not rewrite the kfile")
+	assert.Greater(t, kf.File.EOD, kf.EndOfList, "the tail should be on disk")
+
+	// A crash can leave a partial key at the end of the tail, and a tmp file
+	f, err := os.OpenFile(filepath.Join(dir, kFileName), os.O_WRONLY|os.O_APPEND, 0)
+	assert.NoError(t, err, "open kfile")
+	_, err = f.Write(make([]byte, DBKeyFullSize/2))
+	assert.NoError(t, err, "write partial key")
+	assert.NoError(t, f.Close())
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, kTmpFileName), []byte("junk"), 0644))
+
+	kf, err = OpenKFile(dir, opts)
+	assert.NoError(t, err, "failed to open KFile")
+	assert.Equal(t, uint64(0), (kf.File.EOD-kf.EndOfList)%DBKeyFullSize, "the partial key should be dropped")
+	check := func() {
+		for key, dbbKey := range keys {
+			v, err := kf.Get(key)
+			if !assert.NoError(t, err, "failed to get") {
+				return
+			}
+			assert.Equal(t, dbbKey.Bytes(key), v.Bytes(key), "wrong DBBKey")
+		}
+	}
+	check()
+
+	// A Rebin moves the tail into the base
+	assert.NoError(t, kf.Rebin(), "failed to rebin")
+	assert.Equal(t, kf.File.EOD, kf.EndOfList, "the tail should be empty")
+	assert.Len(t, kf.Cache, 0, "the tail index should be empty")
+	check()
+	assert.NoError(t, kf.Close(), "failed to close")
+}
+
+func TestKFileTailLimit(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{OffsetsCnt: 64, MaxCachedBlocks: 1, BufferSize: DBKeyFullSize * 10, BloomSize: .1}
+	kf, err := NewKFile(dir, opts)
+	assert.NoError(t, err, "failed to create KFile")
+	endOfList := kf.EndOfList
+	base := func(keys uint64) uint64 {
+		kf.EndOfList = uint64(kf.HeaderSize) + keys*DBKeyFullSize
+		return kf.tailLimit()
+	}
+	assert.Equal(t, uint64(10), base(0), "a buffer of keys")
+	assert.Equal(t, uint64(100), base(400), "a quarter of the base")
+	assert.Equal(t, maxTailKeys, base(1<<30), "capped however big the base")
+	kf.EndOfList = endOfList
+	assert.NoError(t, kf.Close(), "failed to close")
+}
@@ -1,6 +1,7 @@
 package blockchainDB
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 )
@@ -8,31 +9,65 @@ import (
 const valueFilename = "values.dat"
 const valueTmpFilename = "values_tmp.dat"
 
+var errDeleted = fmt.Errorf("%w: deleted", ErrNotFound) // The key was deleted; still ErrNotFound to errors.Is
+
 type KV struct {
 	Directory   string
 	vFile       *BFile
 	kFile       *KFile
 	HistoryFile *HistoryFile
 	UseHistory  bool
+	opts        *Options // Options the KV was created or opened with
+	lock        *dirLock // Lock on the directory while the KV is open
+	id          uint64   // Keeps the values of the KV apart from others in the value cache
+	crypt       *crypter // Encrypts the files of the KV; nil if the KV is not encrypted
+	dedup       *KFile   // Index of the values by hash; nil if the KV does not dedup; see dedup.go
 }
 
 // NewKV
-// Overwrites any existing directory; directories are created for the vFile and kFile
-func NewKV(history bool, directory string, offsetsCnt, KeyLimit uint64, MaxCachedBlocks int) (kv *KV, err error) {
-	os.RemoveAll(directory)
-	if err = os.Mkdir(directory, os.ModePerm); err != nil {
+// Create a new KV in the directory; the directory is created if needed.  Fails
+// with ErrExists if the directory already holds a KV, unless opts.Overwrite is set.
+// If opts.History is true, keys are pushed to a HistoryFile and values are immutable.
+func NewKV(directory string, opts *Options) (kv *KV, err error) {
+	opts = opts.withDefaults()
+	lock, err := lockDirectory(directory)
+	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			lock.unlock()
+		}
+	}()
+	if kvExists(directory) {
+		if !opts.Overwrite {
+			return nil, fmt.Errorf("%w: %s", ErrExists, directory)
+		}
+		if err = clearDirectory(directory); err != nil {
+			return nil, err
+		}
+	}
 	kv = new(KV)
 	kv.Directory = directory
-	if kv.kFile, err = NewKFile(history, directory, offsetsCnt, KeyLimit, MaxCachedBlocks); err != nil {
+	kv.opts = opts
+	kv.lock = lock
+	kv.id = kvIDs.Add(1)
+	if opts.Keys != nil {
+		kv.crypt = newCrypter(opts.Keys)
+		if err = kv.crypt.writeCheck(directory, opts.Sync); err != nil {
+			return nil, err
+		}
+	}
+	if kv.kFile, err = NewKFile(directory, kv.kFileOptions()); err != nil {
 		return nil, err
 	}
-	if kv.vFile, err = NewBFile(filepath.Join(directory, valueFilename)); err != nil {
+	if kv.vFile, err = NewBFile(filepath.Join(directory, valueFilename), opts); err != nil {
 		return nil, err
 	}
-	if history {
-		if kv.HistoryFile, err = NewHistoryFile(1024, directory); err != nil {
+	kv.HistoryFile = kv.kFile.History // The KFile owns the HistoryFile
+	kv.UseHistory = opts.History
+	if opts.Dedup && kv.UseHistory {
+		if err = kv.openDedup(); err != nil {
 			return nil, err
 		}
 	}
@@ -40,37 +75,152 @@ func NewKV(history bool, directory string, offsetsCnt, KeyLimit uint64, MaxCache
 }
 
 // OpenKV
-// Open an existing Key/Value Database that uses separate BFiles to hold values and keys.
-func OpenKV(directory string) (kv *KV, err error) {
+// Open a Key/Value Database that uses separate BFiles to hold values and keys.
+// If no database exists in the directory, a new one is created.
+func OpenKV(directory string, opts *Options) (kv *KV, err error) {
+	opts = opts.withDefaults()
+	if !kvExists(directory) {
+		opts.logf("creating KV in %s", directory)
+		return NewKV(directory, opts)
+	}
+	lock, err := lockDirectory(directory)
+	if err != nil {
+		return nil, err
+	}
+	return openKV(directory, opts, lock)
+}
+
+// OpenKVReadOnly
+// Open an existing KV for reading.  Every file is opened O_RDONLY, nothing on
+// disk is ever modified, and Put and Compress fail with ErrReadOnly.  A reader
+// takes a shared lock, but can also open a KV that a writer holds open; it
+// then sees the keys the writer had flushed to disk when it was opened.
+func OpenKVReadOnly(directory string, opts *Options) (kv *KV, err error) {
+	opts = opts.withDefaults()
+	opts.readOnly = true
+	if !kvExists(directory) {
+		return nil, fmt.Errorf("%w: no KV in %s", os.ErrNotExist, directory)
+	}
+	lock, err := lockReader(directory)
+	if err != nil {
+		return nil, err
+	}
+	return openKV(directory, opts, lock)
+}
+
+// openKV
+// Open the files of an existing KV, holding the given lock on its directory.
+// The lock is released if the open fails.
+func openKV(directory string, opts *Options, lock *dirLock) (kv *KV, err error) {
+	defer func() {
+		if err != nil {
+			lock.unlock()
+		}
+	}()
 	kv = new(KV)
 	kv.Directory = directory
+	kv.opts = opts
+	kv.lock = lock
+	kv.id = kvIDs.Add(1)
+	if kv.crypt, err = readCheck(directory, opts.Keys); err != nil {
+		return nil, err
+	}
 	filename := filepath.Join(directory, valueFilename)
-	if kv.vFile, err = OpenBFile(filename); err != nil {
+	if kv.vFile, err = OpenBFile(filename, opts); err != nil {
 		return nil, err
 	}
-	if kv.kFile, err = OpenKFile(directory); err != nil {
+	if kv.kFile, err = OpenKFile(directory, kv.kFileOptions()); err != nil {
 		return nil, err
 	}
+	kv.HistoryFile = kv.kFile.History
+	kv.UseHistory = kv.HistoryFile != nil
+	if opts.Dedup && kv.UseHistory && !opts.readOnly { // A reader never writes, so never looks values up
+		if err = kv.openDedup(); err != nil {
+			return nil, err
+		}
+	}
 	return kv, err
 }
 
+// kFileOptions
+// Returns the options of the KFile of the KV, which encrypt its files by
+// blocks if the KV is encrypted
+func (k *KV) kFileOptions() *Options {
+	opts := *k.opts
+	opts.crypt = k.crypt
+	return &opts
+}
+
+// kvExists
+// Returns true if the directory holds a KV database
+func kvExists(directory string) bool {
+	_, err := os.Stat(filepath.Join(directory, kFileName))
+	return err == nil
+}
+
 // Put
-// Put the key into the kFile, and the value in the vFile
+// Put the key into the kFile, and the value in the vFile.  A KV that dedups
+// points the key at the copy of the value it already holds, if it has one.
 func (k *KV) Put(key [32]byte, value []byte) (err error) {
+	if k.opts.readOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
 
-	dbbKey := new(DBBKey)
-	dbbKey.Offset, err = k.vFile.Offset()
+	var hash [32]byte
+	if k.dedup != nil {
+		var shared *DBBKey
+		if hash, shared, err = k.findValue(value); err != nil {
+			return err
+		}
+		if shared != nil {
+			k.opts.Metrics.Deduped.Add(1)
+			return k.kFile.Put(key, shared)
+		}
+	}
+
+	dbbKey, err := k.putValue(value)
 	if err != nil {
 		return err
 	}
-	dbbKey.Length = uint64(len(value))
+	if k.dedup != nil {
+		if err = k.dedup.Put(hash, dbbKey); err != nil {
+			return err
+		}
+	}
+	return k.kFile.Put(key, dbbKey)
+
+}
 
+// putValue
+// Append the value to the vFile, compressed and sealed as the KV says, and
+// return the entry that points to it
+func (k *KV) putValue(value []byte) (dbbKey *DBBKey, err error) {
+	dbbKey = new(DBBKey)
+	if dbbKey.Offset, err = k.vFile.Offset(); err != nil {
+		return nil, err
+	}
+	if value, dbbKey.Length, err = k.encodeValue(dbbKey.Offset, value); err != nil {
+		return nil, err
+	}
 	if _, err = k.vFile.Write(value); err != nil {
-		return err
+		return nil, err
 	}
+	k.opts.Metrics.Puts.Add(1)
+	k.opts.Metrics.BytesWritten.Add(uint64(len(value)))
+	return dbbKey, nil
+}
 
-	return k.kFile.Put(key, dbbKey)
-
+// Delete
+// Delete the key by writing a tombstone for it to the kFile.  The values in a
+// KV with history are immutable, so they cannot be deleted.
+func (k *KV) Delete(key [32]byte) (err error) {
+	if k.opts.readOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	if k.UseHistory {
+		return fmt.Errorf("%w: cannot delete from a KV with history: %s", ErrImmutable, k.Directory)
+	}
+	return k.kFile.Put(key, &DBBKey{Offset: tombstoneOffset})
 }
 
 // Get
@@ -80,13 +230,104 @@ func (k *KV) Get(key [32]byte) (value []byte, err error) {
 	if err != nil {
 		return nil, err
 	}
-	value = make([]byte, dbbKey.Length)
-	if err = k.vFile.ReadAt(dbbKey.Offset, value); err != nil {
+	if dbbKey.IsDeleted() {
+		return nil, errDeleted
+	}
+	if dbbKey.IsCleared() {
+		return nil, ErrNotFound
+	}
+	return k.getValue(dbbKey)
+}
+
+// Has
+// Returns the length of the value of the key, and true if the KV has the key,
+// without reading the value file
+func (k *KV) Has(key [32]byte) (length uint64, ok bool, err error) {
+	return k.kFile.Has(key)
+}
+
+// getValue
+// Read the value a DBBKey points to from the value cache, or else from the
+// value file
+func (k *KV) getValue(dbbKey *DBBKey) (value []byte, err error) {
+	if value, ok := k.opts.cache.get(k.cacheKey(dbbKey)); ok {
+		return value, nil
+	}
+	if value, err = k.readValue(dbbKey); err != nil {
 		return nil, err
 	}
+	k.opts.cache.add(k.cacheKey(dbbKey), value)
+	return value, nil
+}
+
+// readValue
+// Read the value a DBBKey points to from the value file, and decompress it
+func (k *KV) readValue(dbbKey *DBBKey) (value []byte, err error) {
+	stored := make([]byte, dbbKey.Size())
+	if err = k.vFile.ReadAt(dbbKey.Offset, stored); err != nil {
+		return nil, fmt.Errorf("reading %d bytes at offset %d of %s: %w", len(stored), dbbKey.Offset, k.vFile.Filename, err)
+	}
+	k.opts.Metrics.Gets.Add(1)
+	k.opts.Metrics.BytesRead.Add(uint64(len(stored)))
+	if value, err = k.decodeValue(dbbKey, stored); err != nil {
+		return nil, fmt.Errorf("value at offset %d of %s: %w", dbbKey.Offset, k.vFile.Filename, err)
+	}
 	return value, nil
 }
 
+// cacheKey
+// Returns the key of the value a DBBKey points to in the value cache
+func (k *KV) cacheKey(dbbKey *DBBKey) cacheKey {
+	return cacheKey{kv: k.id, offset: dbbKey.Offset, length: dbbKey.Length}
+}
+
+// ForEach
+// Call fn with every key in the KV and its value, the keys in the kfile first
+// and then those pushed to the HistoryFile, until fn returns an error.
+// Deleted keys are skipped.
+func (k *KV) ForEach(fn func(key [32]byte, value []byte) error) (err error) {
+	return k.forEachKey(func(key [32]byte, dbbKey *DBBKey) error {
+		value, err := k.getValue(dbbKey)
+		if err != nil {
+			return err
+		}
+		return fn(key, value)
+	})
+}
+
+// forEachKey
+// Call fn with every key in the KV and its entry, in the order of ForEach,
+// until fn returns an error.  Deleted keys are skipped.
+func (k *KV) forEachKey(fn func(key [32]byte, dbbKey *DBBKey) error) (err error) {
+	if err = k.Flush(); err != nil {
+		return err
+	}
+	keyValues, keyList, err := k.kFile.GetKeyList()
+	if err != nil {
+		return err
+	}
+	for _, key := range keyList {
+		dbbKey := keyValues[key]
+		if dbbKey.IsDeleted() || dbbKey.IsCleared() {
+			continue
+		}
+		if err = fn(key, dbbKey); err != nil {
+			return err
+		}
+	}
+	if k.HistoryFile == nil {
+		return nil
+	}
+	return k.HistoryFile.ForEach(func(key [32]byte, dbbKey *DBBKey) error {
+		if _, ok := keyValues[key]; ok { // The kfile has the key's latest entry
+			return nil
+		}
+		return fn(key, dbbKey)
+	})
+}
+
+// Close
+// Write everything to disk, close the files, and release the lock on the directory
 func (k *KV) Close() (err error) {
 	if err = k.kFile.Close(); err != nil {
 		return err
@@ -94,66 +335,83 @@ func (k *KV) Close() (err error) {
 	if err = k.vFile.Close(); err != nil {
 		return err
 	}
+	if k.dedup != nil {
+		if err = k.dedup.Close(); err != nil {
+			return err
+		}
+	}
+	if err = k.lock.unlock(); err != nil {
+		return err
+	}
+	k.lock = nil
 	return nil
 }
 
-func (k *KV) Open() (err error) {
-	if err = k.kFile.Open(); err != nil {
+// Flush
+// Write the buffered keys and values to disk
+func (k *KV) Flush() (err error) {
+	if err = k.vFile.Flush(); err != nil { // Values first, so no key on disk points past them
 		return err
 	}
-	if err = k.vFile.Open(); err != nil {
-		return err
+	if k.dedup != nil {
+		if err = k.dedup.Flush(); err != nil {
+			return err
+		}
 	}
-	return nil
+	return k.kFile.Flush()
 }
 
-// Compress
-// Re-write the values file to remove trash values
-func (k *KV) Compress() (err error) {
-	k.Open()
-	k.Close()
-	k.Open()
-
-	if true {
-		return nil
+// sync
+// Write everything buffered to disk, and sync the files of the KV
+func (k *KV) sync() (err error) {
+	if err = k.Flush(); err != nil {
+		return err
 	}
-
-	tvFile, err := NewBFile(filepath.Join(k.Directory, valueTmpFilename))
-	if err != nil {
+	if err = k.vFile.File.Sync(); err != nil {
 		return err
 	}
-
-	kvs, ks, err := k.kFile.GetKeyList()
-	if err != nil {
+	if err = k.kFile.File.File.Sync(); err != nil {
 		return err
 	}
-
-	var buffer [10000]byte
-	for _, key := range ks {
-		dbbKey := kvs[key]
-		// Read the current key value
-		if err := k.vFile.ReadAt(dbbKey.Offset, buffer[:dbbKey.Length]); err != nil {
-			return err
-		}
-		// Put the new offset in the tvFile into the dbbKey (length does not change)
-		dbbKey.Offset, err = tvFile.Offset()
-		if err != nil {
+	if k.dedup != nil {
+		if err = k.dedup.File.File.Sync(); err != nil {
 			return err
 		}
-		// Update the key in the kFile
-		if err = k.kFile.Put(key, dbbKey); err != nil {
-			return err
-		}
-		// Write the value into the tvFile
-		if _, err = tvFile.Write(buffer[:dbbKey.Length]); err != nil {
+	}
+	if k.HistoryFile != nil {
+		return k.HistoryFile.File.Sync()
+	}
+	return nil
+}
+
+// Open
+// Reopen a closed KV, taking the lock on the directory again.  A read-only KV
+// only locks when it is first opened.
+func (k *KV) Open() (err error) {
+	if k.lock == nil && !k.opts.readOnly {
+		if k.lock, err = lockDirectory(k.Directory); err != nil {
 			return err
 		}
 	}
-
-	k.vFile.Close()
-	tvFile.Close()
-	k.kFile.Close()
-	os.Remove(k.vFile.Filename)
-	os.Rename(tvFile.Filename, k.vFile.Filename)
+	if err = k.kFile.Open(); err != nil {
+		return err
+	}
+	if err = k.vFile.Open(); err != nil {
+		return err
+	}
+	if k.dedup != nil {
+		return k.dedup.Open()
+	}
 	return nil
 }
+
+// Compress
+// Open the KV.  A values file is only appended to, so there is nothing to
+// rewrite; AppendReencoded recompresses and re-encrypts by appending.
+func (k *KV) Compress() (err error) {
+	if k.opts.readOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	k.opts.Metrics.Compressions.Add(1)
+	return k.Open()
+}
@@ -2,8 +2,11 @@ package blockchainDB
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 const PermDirName = "perm"
@@ -17,6 +20,7 @@ const DynaDirName = "dyna"
 //    - Suitable for content-addressed storage where keys are derived from values (e.g., hash of value)
 //    - Typically used for data that doesn't change, like transaction data or blockchain blocks
 //    - Attempting to overwrite a key with a different value will result in the key being moved to DynaKV
+//      (promoted), or in ErrImmutable if Options.StrictImmutable is set
 //
 // 2. DynaKV (Dynamic KV): Uses KFile with history disabled
 //    - Values are mutable - keys can be freely associated with different values over time
@@ -28,20 +32,30 @@ const DynaDirName = "dyna"
 // common pattern in blockchain-style databases where most data is append-only and immutable,
 // but some state needs to be updated.
 //
-// ToDo: Because KV2 can be used as a shard in a sharded database, and because the PermKV values don't
-// change and that database does not benefit from sharding, then KV2 might ought to accept a *KV for the
-// the PermKV. That way, only the DynaKV is really sharded, while all the permanent key/values are kept in
-// one KV database.
+// Because KV2 can be used as a shard in a sharded database, and because the PermKV values don't
+// change and that database does not benefit from sharding, a KV2 can be given a *KV for the PermKV
+// (see NewKV2WithPerm).  That way, only the DynaKV is really sharded, while all the permanent
+// key/values are kept in one KV database.
 //
-// ToDo furthermore, the PermKV can build databases that are blocked (by major blocks). Those separate KFiles
-// could then be used to rapidly sync partially synced nodes
+// Furthermore, PermKV writes can be tagged with a major block, building a sealed segment per major block
+// (see segments.go). Those segments can then be used to rapidly sync partially synced nodes
 
 type KV2 struct {
-	Directory string // Directory where the PermKV and DynaKV directories are
-	PermKV    *KV    // The Perm KV
-	DynaKV    *KV    // the Dyna KV
-	DWrites   int    // Number of writes to the DynaKV since the last compress
-	PWrites   int    // Number of writes to the PermKV since the last compress
+	Directory  string            // Directory where the PermKV and DynaKV directories are
+	PermKV     *KV               // The Perm KV; shared with other KV2s if sharedPerm
+	DynaKV     *KV               // the Dyna KV
+	DWrites    int               // Number of writes to the DynaKV since the last compress
+	PWrites    int               // Number of writes to the PermKV since the last compress
+	VersKV     *KV               // Versions of DynaKV values by height, if versioned; see versions.go
+	undo       *BFile            // Undo log of the writes to both layers; see commit.go
+	revoked    map[[32]byte]bool // PermKV keys removed by a rollback; see commit.go
+	height     uint64            // Last committed height
+	pruned     uint64            // History below this height has been dropped; see prune.go
+	sharedPerm bool              // The PermKV was passed in, and belongs to whoever passed it
+	permMutex  *sync.Mutex       // Held around each use of a PermKV shared by a KVShard; nil otherwise
+	mutex      sync.Mutex        // Held by a KVShard while it uses the KV2, so a Prune can run in the background
+	opts       *Options          // Options the KV2 was created or opened with
+	lock       *dirLock          // Lock on the directory while the KV2 is open
 }
 
 // NewKV2
@@ -58,49 +72,252 @@ type KV2 struct {
 //
 // This design efficiently separates immutable data (content-addressed storage)
 // from mutable data (state storage) in a blockchain-style database.
-func NewKV2(directory string, offsetsCnt, KeyLimit uint64, MaxCachedBlocks int) (kv2 *KV2, err error) {
-	os.RemoveAll(directory)
-	if err = os.Mkdir(directory, os.ModePerm); err != nil {
+//
+// Fails with ErrExists if the directory already holds a KV2, unless opts.Overwrite is set.
+func NewKV2(directory string, opts *Options) (kv2 *KV2, err error) {
+	return NewKV2WithPerm(directory, nil, opts)
+}
+
+// NewKV2WithPerm
+// Create a KV2 that uses the given KV as its PermKV, so one PermKV can be
+// shared by many KV2s, such as the shards of a KVShard.  The KV2 never opens,
+// flushes, syncs or closes a shared PermKV; whoever passed it in does.  With
+// a nil perm, the KV2 creates its own PermKV, as NewKV2 does.
+func NewKV2WithPerm(directory string, perm *KV, opts *Options) (kv2 *KV2, err error) {
+	opts = opts.withDefaults()
+	lock, err := lockDirectory(directory)
+	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			lock.unlock()
+		}
+	}()
+	if kv2Exists(directory) {
+		if !opts.Overwrite {
+			return nil, fmt.Errorf("%w: %s", ErrExists, directory)
+		}
+		if err = clearDirectory(directory); err != nil {
+			return nil, err
+		}
+	}
 
 	kv2 = new(KV2)
 	kv2.Directory = directory
-	if kv2.PermKV, err = NewKV(true, filepath.Join(directory, PermDirName), offsetsCnt, KeyLimit, MaxCachedBlocks); err != nil {
+	kv2.opts = opts
+	kv2.lock = lock
+	if perm != nil {
+		kv2.PermKV, kv2.sharedPerm = perm, true
+	} else if kv2.PermKV, err = NewKV(filepath.Join(directory, PermDirName), layerOptions(opts, true)); err != nil {
 		return nil, err
 	}
-	if kv2.DynaKV, err = NewKV(false, filepath.Join(directory, DynaDirName), offsetsCnt, KeyLimit, MaxCachedBlocks); err != nil {
+	if kv2.DynaKV, err = NewKV(filepath.Join(directory, DynaDirName), layerOptions(opts, false)); err != nil {
+		return nil, err
+	}
+	if opts.Versioned {
+		if kv2.VersKV, err = NewKV(filepath.Join(directory, VersDirName), layerOptions(opts, false)); err != nil {
+			return nil, err
+		}
+	}
+	if kv2.undo, err = NewBFile(filepath.Join(directory, undoFilename), opts); err != nil {
 		return nil, err
 	}
 	return kv2, nil
 }
 
-func OpenKV2(directory string) (kv2 *KV2, err error) {
+// OpenKV2
+// Open a KV2 database.  If no database exists in the directory, a new one is created.
+func OpenKV2(directory string, opts *Options) (kv2 *KV2, err error) {
+	return OpenKV2WithPerm(directory, nil, opts)
+}
+
+// OpenKV2WithPerm
+// Open a KV2 database that uses the given KV as its PermKV; see
+// NewKV2WithPerm.  If no database exists in the directory, a new one is created.
+func OpenKV2WithPerm(directory string, perm *KV, opts *Options) (kv2 *KV2, err error) {
+	opts = opts.withDefaults()
+	if !kv2Exists(directory) {
+		opts.logf("creating KV2 in %s", directory)
+		return NewKV2WithPerm(directory, perm, opts)
+	}
+	lock, err := lockDirectory(directory)
+	if err != nil {
+		return nil, err
+	}
+	return openKV2(directory, perm, opts, lock, OpenKV)
+}
+
+// OpenKV2ReadOnly
+// Open an existing KV2 for reading; see OpenKVReadOnly
+func OpenKV2ReadOnly(directory string, opts *Options) (kv2 *KV2, err error) {
+	return OpenKV2ReadOnlyWithPerm(directory, nil, opts)
+}
+
+// OpenKV2ReadOnlyWithPerm
+// Open an existing KV2 that uses the given KV as its PermKV for reading; see
+// NewKV2WithPerm and OpenKVReadOnly
+func OpenKV2ReadOnlyWithPerm(directory string, perm *KV, opts *Options) (kv2 *KV2, err error) {
+	opts = opts.withDefaults()
+	opts.readOnly = true
+	if !kv2Exists(directory) {
+		return nil, fmt.Errorf("%w: no KV2 in %s", os.ErrNotExist, directory)
+	}
+	lock, err := lockReader(directory)
+	if err != nil {
+		return nil, err
+	}
+	return openKV2(directory, perm, opts, lock, OpenKVReadOnly)
+}
+
+// openKV2
+// Open both layers of an existing KV2 with the given open function, holding
+// the given lock on its directory.  A non-nil perm is used as the PermKV.  The
+// lock is released if the open fails.
+func openKV2(directory string, perm *KV, opts *Options, lock *dirLock,
+	open func(string, *Options) (*KV, error)) (kv2 *KV2, err error) {
+	defer func() {
+		if err != nil {
+			lock.unlock()
+		}
+	}()
 	kv2 = new(KV2)
 	kv2.Directory = directory
+	kv2.opts = opts
+	kv2.lock = lock
 	permDirName := filepath.Join(directory, PermDirName) // Add directory names
 	dynaDirName := filepath.Join(directory, DynaDirName) // Add directory names
-	if kv2.PermKV, err = OpenKV(permDirName); err != nil {
+	if !opts.readOnly {
+		if err = recoverRewrite(directory, PermDirName, permTmpDirName, permOldDirName); err != nil {
+			return nil, err
+		}
+		if err = recoverRewrite(directory, VersDirName, versTmpDirName, versOldDirName); err != nil {
+			return nil, err
+		}
+	}
+	if perm != nil {
+		kv2.PermKV, kv2.sharedPerm = perm, true
+	} else if kv2.PermKV, err = open(permDirName, layerOptions(opts, true)); err != nil {
+		return nil, err
+	}
+	if kv2.DynaKV, err = open(dynaDirName, layerOptions(opts, false)); err != nil {
+		return nil, err
+	}
+	if versDirName := filepath.Join(directory, VersDirName); kvExists(versDirName) {
+		if kv2.VersKV, err = open(versDirName, layerOptions(opts, false)); err != nil {
+			return nil, err
+		}
+	}
+	if kv2.undo, err = openUndo(directory, opts); err != nil {
 		return nil, err
 	}
-	if kv2.DynaKV, err = OpenKV(dynaDirName); err != nil {
+	if kv2.revoked, err = loadRevoked(directory); err != nil {
 		return nil, err
 	}
 	return kv2, nil
 }
 
-func (k *KV2) Open() error {
-	if err := k.PermKV.Open(); err != nil {
+// kv2Exists
+// Returns true if the directory holds a KV2 database
+func kv2Exists(directory string) bool {
+	return kvExists(filepath.Join(directory, PermDirName)) || kvExists(filepath.Join(directory, DynaDirName))
+}
+
+// layerOptions
+// Returns the options for one of the layers of a KV2. The PermKV keeps
+// history (immutable values), and compresses and dedups as PermCompression
+// and PermDedup say; the DynaKV does not keep history.
+func layerOptions(opts *Options, history bool) *Options {
+	layer := *opts
+	layer.History = history
+	if history {
+		layer.Compression = opts.PermCompression
+		layer.Dedup = opts.PermDedup
+	}
+	return &layer
+}
+
+// Open
+// Reopen a closed KV2, taking the lock on the directory again.  A read-only
+// KV2 only locks when it is first opened.
+func (k *KV2) Open() (err error) {
+	if k.lock == nil && !k.opts.readOnly {
+		if k.lock, err = lockDirectory(k.Directory); err != nil {
+			return err
+		}
+	}
+	if !k.sharedPerm {
+		if err := k.PermKV.Open(); err != nil {
+			return err
+		}
+	}
+	if err := k.DynaKV.Open(); err != nil {
 		return err
 	}
-	return k.DynaKV.Open()
+	if k.VersKV != nil {
+		if err := k.VersKV.Open(); err != nil {
+			return err
+		}
+	}
+	if k.undo != nil {
+		return k.undo.Open()
+	}
+	return nil
 }
 
+// Flush
+// Write the buffered keys and values of both layers to disk
+func (k *KV2) Flush() error {
+	if k.undo != nil {
+		if err := k.undo.Flush(); err != nil { // The undo log goes first, ahead of the writes it undoes
+			return err
+		}
+	}
+	if !k.sharedPerm {
+		if err := k.PermKV.Flush(); err != nil {
+			return err
+		}
+	}
+	if k.VersKV != nil {
+		if err := k.VersKV.Flush(); err != nil {
+			return err
+		}
+	}
+	return k.DynaKV.Flush()
+}
+
+// Close
+// Close both layers, but not a shared PermKV, and release the lock on the directory
 func (k *KV2) Close() error {
-	if err := k.PermKV.Close(); err != nil {
+	if err := k.closeFiles(); err != nil {
+		return err
+	}
+	err := k.lock.unlock()
+	k.lock = nil
+	return err
+}
+
+// closeFiles
+// Close both layers, but not a shared PermKV, keeping the lock on the
+// directory; Open reopens them
+func (k *KV2) closeFiles() error {
+	if !k.sharedPerm {
+		if err := k.PermKV.Close(); err != nil {
+			return err
+		}
+	}
+	if err := k.DynaKV.Close(); err != nil {
 		return err
 	}
-	return k.DynaKV.Close()
+	if k.VersKV != nil {
+		if err := k.VersKV.Close(); err != nil {
+			return err
+		}
+	}
+	if k.undo != nil {
+		return k.undo.Close()
+	}
+	return nil
 }
 
 // GetDyna
@@ -114,10 +331,13 @@ func (k *KV2) GetDyna(key [32]byte) (value []byte, err error) {
 }
 
 // GetPerm
-// Get a k/v from the PermKV db.  Doesn't check the DynaKV.
+// Get a k/v from the PermKV db.  Doesn't check the DynaKV, unless a rollback
+// removed the key from the PermKV; the key is then read as Get reads it.
 func (k *KV2) GetPerm(key [32]byte) (value []byte, err error) {
-
-	if value, err = k.PermKV.Get(key); err != nil { // Not in PermKV, then return whatever
+	if k.revoked[key] {
+		return k.Get(key)
+	}
+	if value, err = k.permGet(key); err != nil { // Not in PermKV, then return whatever
 		return nil, err
 	}
 	return value, nil
@@ -126,64 +346,210 @@ func (k *KV2) GetPerm(key [32]byte) (value []byte, err error) {
 // Get
 // Get a value from the KV2.  Checks the DynaKV first, then the PermKV
 func (k *KV2) Get(key [32]byte) (value []byte, err error) {
+	value, _, err = k.GetWithLayer(key)
+	return value, err
+}
 
-	// Check and see if this is a key that has been changed
-	if value, err = k.DynaKV.Get(key); err == nil { // Not in DynaKV, then return whatever
-		return value, nil
+// Has
+// Returns the length of the value of the key, and true if the KV2 has the
+// key.  Checks the DynaKV first, then the PermKV, without reading either
+// value file.
+func (k *KV2) Has(key [32]byte) (length uint64, ok bool, err error) {
+	dbbKey, err := k.dynaEntry(key)
+	switch {
+	case err != nil:
+		return 0, false, err
+	case dbbKey.IsDeleted():
+		return 0, false, nil
+	case !dbbKey.IsCleared():
+		return dbbKey.ValueLength(), true, nil
 	}
-	return k.PermKV.Get(key) //                      PermKV has.
+	k.lockPerm()
+	defer k.unlockPerm()
+	return k.PermKV.Has(key)
+}
+
+// lockPerm
+// Lock the PermKV, if a KVShard shares it between its shards
+func (k *KV2) lockPerm() {
+	if k.permMutex != nil {
+		k.permMutex.Lock()
+	}
+}
+
+// unlockPerm
+// Unlock the PermKV locked by lockPerm
+func (k *KV2) unlockPerm() {
+	if k.permMutex != nil {
+		k.permMutex.Unlock()
+	}
+}
+
+// permGet
+// Get the value of the key from the PermKV, holding its lock
+func (k *KV2) permGet(key [32]byte) (value []byte, err error) {
+	k.lockPerm()
+	defer k.unlockPerm()
+	return k.PermKV.Get(key)
+}
 
+// permPut
+// Put the key/value in the PermKV, holding its lock
+func (k *KV2) permPut(key [32]byte, value []byte) error {
+	k.lockPerm()
+	defer k.unlockPerm()
+	return k.PermKV.Put(key, value)
 }
 
 // PutDyna
 // Use when the k/v is known to be a dynamic k/v
 func (k *KV2) PutDyna(key [32]byte, value []byte) (writes int, err error) {
+	if k.opts.readOnly {
+		return 0, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	return k.putDyna(key, value)
+}
+
+// putDyna
+// Put the key value pair in the DynaKV, logging it for rollback and
+// recording its version
+func (k *KV2) putDyna(key [32]byte, value []byte) (writes int, err error) {
+	if err = k.logUndo(undoDyna, key); err != nil {
+		return k.DWrites, err
+	}
 	k.DWrites++
-	err = k.DynaKV.Put(key, value)
-	return k.DWrites, err
+	if err = k.DynaKV.Put(key, value); err != nil {
+		return k.DWrites, err
+	}
+	return k.DWrites, k.putVersion(key)
 }
 
 // PutPerm
-// Use when the k/v is known to be a dynamic k/v
+// Use when the k/v is known to be a permanent k/v.  A key hidden by a
+// tombstone in the DynaKV is visible again.  A new value for a key a rollback
+// removed from the PermKV goes to the DynaKV; see commit.go.
 func (k *KV2) PutPerm(key [32]byte, value []byte) (writes int, err error) {
-	k.PWrites++
-	err = k.PermKV.Put(key, value)
+	if k.opts.readOnly {
+		return 0, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	value2, err2 := k.permGet(key)
+	if err2 != nil && !errors.Is(err2, ErrNotFound) {
+		return k.DWrites, err2
+	}
+	if k.revoked[key] && err2 == nil && !bytes.Equal(value, value2) {
+		if current, err := k.Get(key); err == nil && bytes.Equal(value, current) {
+			return k.DWrites, nil // Already replayed
+		}
+		return k.putDyna(key, value)
+	}
+	if err2 != nil || !bytes.Equal(value, value2) { // The same value is a no-op
+		if err2 != nil { // Only a key new to the PermKV has to be undone
+			if err = k.logUndo(undoPerm, key); err != nil {
+				return k.DWrites, err
+			}
+		}
+		k.PWrites++
+		if err = k.permPut(key, value); err != nil {
+			return k.DWrites, err
+		}
+		if err2 != nil {
+			if err = k.putVersion(key); err != nil {
+				return k.DWrites, err
+			}
+		}
+	}
+	dbbKey, err := k.dynaEntry(key)
+	if err != nil {
+		return k.DWrites, err
+	}
+	if dbbKey.IsDeleted() {
+		if err = k.logUndo(undoDyna, key); err != nil {
+			return k.DWrites, err
+		}
+		if err = k.DynaKV.kFile.Put(key, &DBBKey{Offset: clearedOffset}); err != nil {
+			return k.DWrites, err
+		}
+		err = k.putVersion(key)
+	}
 	return k.DWrites, err
 }
 
 // Put
 // Returns the number of writes since the last compress, and an err if the put failed
 func (k *KV2) Put(key [32]byte, value []byte) (writes int, err error) {
+	if k.opts.readOnly {
+		return 0, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
 
 	if value2, err2 := k.DynaKV.Get(key); err2 == nil { // Check.  Is this a DynaKV key?
 		if bytes.Equal(value, value2) { // If the key is in DynaKV, it stays there.
-			return k.DWrites, nil //       If the value is not changed, do nothing
+			k.opts.Metrics.NoOpWrites.Add(1) // If the value is not changed, do nothing
+			return k.DWrites, nil
 		}
-		k.DWrites++
-		err = k.DynaKV.Put(key, value) // If the value DID change, update
-		return k.DWrites, err
+		return k.putDyna(key, value) // If the value DID change, update
+	} else if errors.Is(err2, errDeleted) { // A deleted key comes back in the DynaKV
+		return k.putDyna(key, value)
+	} else if !errors.Is(err2, ErrNotFound) {
+		return k.DWrites, err2
 	}
-	if value2, err2 := k.PermKV.Get(key); err2 == nil { // Check. Is it a PermKV
+	if value2, err2 := k.permGet(key); err2 == nil { // Check. Is it a PermKV
 		if bytes.Equal(value, value2) { // If no change, ignore;
+			k.opts.Metrics.NoOpWrites.Add(1)
 			return k.PWrites, nil
 		}
-		k.DWrites++
-		err = k.DynaKV.Put(key, value) // If the perm value changed, it is now a DynaKV
-		return k.DWrites, err
+		if k.opts.StrictImmutable {
+			return k.DWrites, fmt.Errorf("%w: %x", ErrImmutable, key[:8])
+		}
+		k.opts.Metrics.Promotions.Add(1)
+		return k.putDyna(key, value) // If the perm value changed, it is now a DynaKV
+	} else if !errors.Is(err2, ErrNotFound) {
+		return k.DWrites, err2
 	}
 	// If not yet a DynaKV or not in k.PermKV, default to k.PermKV
+	if err = k.logUndo(undoPerm, key); err != nil {
+		return k.DWrites, err
+	}
 	k.PWrites++
-	err = k.PermKV.Put(key, value)
-	return k.DWrites, err // We do not compress the PermKV ... Only report DWrites
+	if err = k.permPut(key, value); err != nil {
+		return k.DWrites, err
+	}
+	return k.DWrites, k.putVersion(key) // We do not compress the PermKV ... Only report DWrites
+}
+
+// Delete
+// Delete a key.  Since PermKV values are immutable, the delete is a tombstone
+// in the DynaKV, which hides the key in both layers.
+func (k *KV2) Delete(key [32]byte) (writes int, err error) {
+	if k.opts.readOnly {
+		return 0, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	if _, err = k.DynaKV.Get(key); errors.Is(err, errDeleted) {
+		return k.DWrites, nil // Already deleted
+	} else if errors.Is(err, ErrNotFound) {
+		if _, err = k.permGet(key); errors.Is(err, ErrNotFound) {
+			return k.DWrites, nil // Nothing to delete
+		}
+	}
+	if err != nil {
+		return k.DWrites, err
+	}
+	if err = k.logUndo(undoDyna, key); err != nil {
+		return k.DWrites, err
+	}
+	k.DWrites++
+	if err = k.DynaKV.Delete(key); err != nil {
+		return k.DWrites, err
+	}
+	return k.DWrites, k.putVersion(key)
 }
 
 // Compress
-// Only DynaKV is compressed, since PermKV doesn't change.  That does mean one
-// bogus DynaKV key will exist in PermKV.
-//
-// TODO: Cleanse PermKV of keys in DynaKV
-func (k *KV2) Compress() {
-	k.DynaKV.Compress()
+// Clear the write counts.  Nothing is rewritten: the PermKV doesn't change,
+// so one bogus DynaKV key will exist in PermKV until PurgePerm removes it, and
+// the DynaKV values are only appended to; see KV.AppendReencoded.
+func (k *KV2) Compress() error {
+	k.opts.Metrics.Compressions.Add(1)
 	k.DWrites = 0 // Clear write counts
 	k.PWrites = 0
+	return nil
 }
@@ -2,7 +2,10 @@ package blockchainDB
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -22,7 +25,7 @@ func TestKV2(t *testing.T) {
 	var cntWrites, cntReads float64
 
 	fr := NewFastRandom([]byte{1})
-	kv2, err := NewKV2(dir, offsetCnt, keyLimit, MaxCachedBlocks)
+	kv2, err := NewKV2(dir, &Options{OffsetsCnt: offsetCnt, KeyLimit: keyLimit, MaxCachedBlocks: MaxCachedBlocks})
 	assert.NoError(t, err, "create kv")
 
 	fmt.Print("Writing\n")
@@ -85,7 +88,7 @@ func TestKV2_2(t *testing.T) {
 	start := time.Now()
 	var cntWrites, cntReads float64
 
-	kv2, err := NewKV2(dir, offsetCnt, keyLimit, MaxCachedBlocks)
+	kv2, err := NewKV2(dir, &Options{OffsetsCnt: offsetCnt, KeyLimit: keyLimit, MaxCachedBlocks: MaxCachedBlocks})
 	assert.NoError(t, err, "create kv")
 
 	fmt.Print("Writing\n")
@@ -148,3 +151,88 @@ func TestKV2_2(t *testing.T) {
 	fmt.Printf("Writes per second %10.3f Reads per second %10.3f\n", wps, rps)
 	fmt.Printf("Writes %s Reads %s\n", ComputeTimePerOp(wps), ComputeTimePerOp(rps))
 }
+
+func TestOpenKV2(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+	directory := filepath.Join(dir, "kv2")
+
+	const numKVs = 2000
+	opts := &Options{OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1}
+
+	kv2, err := OpenKV2(directory, opts)
+	assert.NoError(t, err, "create kv2")
+	fr := NewFastRandom([]byte{1})
+	for i := 0; i < numKVs; i++ {
+		_, err = kv2.Put(fr.NextHash(), fr.RandBuff(10, 100))
+		assert.NoError(t, err, "failed to put")
+	}
+	assert.NoError(t, kv2.Close(), "failed to close")
+
+	kv2, err = OpenKV2(directory, opts)
+	assert.NoError(t, err, "open kv2")
+	assert.True(t, kv2.PermKV.UseHistory, "the PermKV keeps history")
+	assert.False(t, kv2.DynaKV.UseHistory, "the DynaKV has no history")
+	fr.Reset()
+	for i := 0; i < numKVs; i++ {
+		key := fr.NextHash()
+		value, err := kv2.Get(key)
+		assert.NoErrorf(t, err, "failed to get %d", i)
+		assert.Equal(t, fr.RandBuff(10, 100), value, "wrong value")
+	}
+	assert.NoError(t, kv2.Close(), "failed to close")
+}
+
+func TestKV2Delete(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1}
+	kv2, err := NewKV2(dir, opts)
+	assert.NoError(t, err, "create kv2")
+
+	fr := NewFastRandom([]byte{1})
+	perm, dyna, missing := fr.NextHash(), fr.NextHash(), fr.NextHash()
+	_, err = kv2.Put(perm, []byte("perm"))
+	assert.NoError(t, err, "put perm")
+	_, err = kv2.PutDyna(dyna, []byte("dyna"))
+	assert.NoError(t, err, "put dyna")
+
+	for _, key := range [][32]byte{perm, dyna, missing} {
+		_, err = kv2.Delete(key)
+		assert.NoError(t, err, "delete")
+	}
+	check := func() {
+		for _, key := range [][32]byte{perm, dyna, missing} {
+			_, err = kv2.Get(key)
+			assert.Error(t, err, "deleted keys should not be found")
+		}
+		value, err := kv2.GetPerm(perm)
+		assert.NoError(t, err, "the PermKV value is immutable")
+		assert.Equal(t, []byte("perm"), value)
+	}
+	check()
+	assert.NoError(t, kv2.Close(), "close")
+	kv2, err = OpenKV2(dir, opts)
+	assert.NoError(t, err, "open kv2")
+	check()
+
+	// A deleted key can be written again, even with its old PermKV value
+	_, err = kv2.Put(perm, []byte("perm"))
+	assert.NoError(t, err, "put perm again")
+	value, err := kv2.Get(perm)
+	assert.NoError(t, err, "get perm")
+	assert.Equal(t, []byte("perm"), value)
+
+	// A value that cannot be read is an error, not a missing key
+	_, err = kv2.PutDyna(dyna, []byte("dyna"))
+	assert.NoError(t, err, "put dyna again")
+	assert.NoError(t, kv2.Close(), "close")
+	assert.NoError(t, os.Truncate(filepath.Join(dir, DynaDirName, valueFilename), 0), "truncate")
+	kv2, err = OpenKV2(dir, opts)
+	assert.NoError(t, err, "open kv2")
+	_, err = kv2.Delete(dyna)
+	assert.Error(t, err, "delete of an unreadable value")
+	assert.False(t, errors.Is(err, ErrNotFound), "not a missing key")
+	assert.NoError(t, kv2.Close(), "close")
+}
@@ -1,16 +1,30 @@
 package blockchainDB
 
 import (
+	"encoding/binary"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 )
 
-const NumShards = 512
+const NumShards = 512 // Default number of shards in a KVShard
 
 type KVShard struct {
-	Directory string
-	Shards    [NumShards]*KV2
+	Directory  string
+	Shards     []*KV2
+	Perm       *KV               // The PermKV shared by every shard, if created with SharedPerm; nil otherwise
+	opts       *Options          // Options the KVShard was created or opened with
+	lock       *dirLock          // Lock on the directory while the KVShard is open
+	height     uint64            // Last committed height
+	pruned     uint64            // History below this height has been dropped; see prune.go
+	pruning    *Pruning          // The last Prune started
+	pruneMutex sync.Mutex        // Guards pruned and pruning; Prune holds it until its Pruning starts
+	segments   map[uint64]*BFile // Open segments of major blocks; see segments.go
+	segMutex   sync.Mutex        // Guards segments, the segment files and the manifest; taken before the lock of any shard
+	permMutex  sync.Mutex        // Held around each use of the shared PermKV, after the lock of any shard
+	closed     atomic.Bool       // Set by Close; every call after it fails with ErrClosed
 }
 
 func (k *KVShard) ShardDir(index int) string {
@@ -19,52 +33,251 @@ func (k *KVShard) ShardDir(index int) string {
 	return shardDir
 }
 
+// Index
+// Returns the index of the shard that holds the given key
+func (k *KVShard) Index(key [32]byte) int {
+	return int(binary.BigEndian.Uint32(key[IndexShards:]) % uint32(len(k.Shards)))
+}
+
 // OpenKVShard
-// Open an existing KVShard Database
-func OpenKVShard(directory string) (kVShard *KVShard, err error) {
+// Open a KVShard Database.  If no database exists in the directory, a new one
+// is created.  The number of shards of an existing database comes from its manifest.
+func OpenKVShard(directory string, opts *Options) (kVShard *KVShard, err error) {
+	opts = opts.withDefaults()
+	shardCnt, exists := kvShardCount(directory)
+	if !exists {
+		opts.logf("creating KVShard in %s", directory)
+		return NewKVShard(directory, opts)
+	}
+	lock, err := lockDirectory(directory)
+	if err != nil {
+		return nil, err
+	}
+	if manifest, err := ReadManifest(directory); err == nil { // A checkpoint stops sharing files when first written
+		if err = manifest.unshareLinks(directory, opts.Sync); err != nil {
+			lock.unlock()
+			return nil, err
+		}
+	}
+	return openKVShard(directory, opts, lock, shardCnt, OpenKV, OpenKV2WithPerm)
+}
+
+// OpenKVShardReadOnly
+// Open an existing KVShard for reading.  Every file is opened O_RDONLY, nothing
+// on disk is ever modified, and Put and Compress fail with ErrReadOnly.  The
+// KVShard can be opened while a writer holds it open; see OpenKVReadOnly.
+func OpenKVShardReadOnly(directory string, opts *Options) (kVShard *KVShard, err error) {
+	opts = opts.withDefaults()
+	opts.readOnly = true
+	shardCnt, exists := kvShardCount(directory)
+	if !exists {
+		return nil, fmt.Errorf("%w: no KVShard in %s", os.ErrNotExist, directory)
+	}
+	lock, err := lockReader(directory)
+	if err != nil {
+		return nil, err
+	}
+	return openKVShard(directory, opts, lock, shardCnt, OpenKVReadOnly, OpenKV2ReadOnlyWithPerm)
+}
+
+// openKVShard
+// Open the shards of an existing KVShard, and its shared PermKV if it has
+// one, with the given open functions, holding the given lock on its
+// directory.  The lock is released if the open fails.
+func openKVShard(directory string, opts *Options, lock *dirLock, shardCnt int,
+	openPerm func(string, *Options) (*KV, error),
+	open func(string, *KV, *Options) (*KV2, error)) (kVShard *KVShard, err error) {
+	defer func() {
+		if err != nil {
+			lock.unlock()
+		}
+	}()
+
 	kVShard = new(KVShard)
 	kVShard.Directory = directory
+	kVShard.opts = opts
+	kVShard.lock = lock
+	kVShard.Shards = make([]*KV2, shardCnt)
+	if manifest, err := ReadManifest(directory); err == nil {
+		kVShard.height = manifest.Height
+		kVShard.pruned = manifest.PrunedBelow
+		if err = kVShard.useRetention(manifest); err != nil { // Before the shards get the options
+			return nil, err
+		}
+		if manifest.SharedPerm {
+			if !opts.readOnly {
+				if err = recoverRewrite(directory, PermDirName, permTmpDirName, permOldDirName); err != nil {
+					return nil, err
+				}
+			}
+			if kVShard.Perm, err = openPerm(filepath.Join(directory, PermDirName), layerOptions(opts, true)); err != nil {
+				return nil, err
+			}
+		}
+	}
 
 	for i := range kVShard.Shards {
 		shardDir := kVShard.ShardDir(i)
-		if kVShard.Shards[i], err = OpenKV2(shardDir); err != nil {
+		if kVShard.Shards[i], err = open(shardDir, kVShard.Perm, opts); err != nil {
 			return nil, err
 		}
+		if kVShard.Perm != nil {
+			kVShard.Shards[i].permMutex = &kVShard.permMutex
+		}
+		kVShard.Shards[i].height = kVShard.height
+		kVShard.Shards[i].pruned = kVShard.pruned
 	}
 
 	return kVShard, nil
 }
 
+// kvShardCount
+// Returns the number of shards in the KVShard in the directory, and true if
+// a KVShard exists there.  Databases written before the manifest existed
+// always have NumShards shards.
+func kvShardCount(directory string) (shardCnt int, exists bool) {
+	if manifest, err := ReadManifest(directory); err == nil {
+		return manifest.ShardCnt, true
+	}
+	if kv2Exists(filepath.Join(directory, fmt.Sprintf("Shard%04d", 0))) {
+		return NumShards, true
+	}
+	return 0, false
+}
+
 // NewKVShard
 // Create a new KVShard database.  This database creates database shards to
-// reduce the overhead of compressing large database files.
-func NewKVShard(directory string, offsetsCnt, keyLimit uint64, MaxCachedBlocks int) (kvs *KVShard, err error) {
-	os.RemoveAll(directory)                                    // Get rid of any existing directory
-	if err = os.MkdirAll(directory, os.ModePerm); err != nil { // Make the directory
+// reduce the overhead of compressing large database files.  opts.ShardCnt
+// sets the number of shards.  Fails with ErrExists if the directory already
+// holds a KVShard, unless opts.Overwrite is set.
+func NewKVShard(directory string, opts *Options) (kvs *KVShard, err error) {
+	opts = opts.withDefaults()
+	lock, err := lockDirectory(directory) // Makes the directory if it doesn't exist
+	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			lock.unlock()
+		}
+	}()
+	if _, exists := kvShardCount(directory); exists {
+		if !opts.Overwrite {
+			return nil, fmt.Errorf("%w: %s", ErrExists, directory)
+		}
+		if err = clearDirectory(directory); err != nil { // Get rid of the existing database
+			return nil, err
+		}
+	}
 
-	kvs = new(KVShard)          // Create a new sharded directory
-	kvs.Directory = directory   // Keep the directory
+	kvs = new(KVShard)                       // Create a new sharded directory
+	kvs.Directory = directory                // Keep the directory
+	kvs.opts = opts                          // Keep the options
+	kvs.lock = lock                          // Keep the lock
+	kvs.Shards = make([]*KV2, opts.ShardCnt) // Make room for the shards
+	if opts.SharedPerm {                     // One PermKV for every shard
+		if kvs.Perm, err = NewKV(filepath.Join(directory, PermDirName), layerOptions(opts, true)); err != nil {
+			return nil, err
+		}
+	}
 	for i := range kvs.Shards { // Then create all the shards
 		shardDir := kvs.ShardDir(i)
-		if kvs.Shards[i], err = NewKV2(shardDir, offsetsCnt, keyLimit, MaxCachedBlocks); err != nil { // Create the KV2 for each shard
+		if kvs.Shards[i], err = NewKV2WithPerm(shardDir, kvs.Perm, opts); err != nil { // Create the KV2 for each shard
 			return nil, err
 		}
+		if kvs.Perm != nil {
+			kvs.Shards[i].permMutex = &kvs.permMutex
+		}
+	}
+
+	manifest := &Manifest{Version: ManifestVersion, ShardCnt: len(kvs.Shards), SharedPerm: opts.SharedPerm,
+		KeepHeights: opts.KeepHeights, KeepAfter: opts.KeepAfter}
+	if err = manifest.Write(directory, opts.Sync); err != nil {
+		return nil, err
 	}
 
 	return kvs, nil
 }
 
+// shard
+// Returns the shard holding the key, open and locked.  The caller unlocks it.
+func (k *KVShard) shard(key [32]byte) (*KV2, error) {
+	return k.shardAt(k.Index(key))
+}
+
+// shardAt
+// Returns the shard with the given index, open and locked.  The caller
+// unlocks it.
+func (k *KVShard) shardAt(i int) (*KV2, error) {
+	if err := k.checkOpen(); err != nil {
+		return nil, err
+	}
+	kv2 := k.Shards[i]
+	k.lockShard(kv2)
+	if err := kv2.Open(); err != nil {
+		k.unlockShard(kv2)
+		return nil, fmt.Errorf("shard %d: %w", i, err)
+	}
+	return kv2, nil
+}
+
+// checkOpen
+// Returns ErrClosed once the KVShard has been closed
+func (k *KVShard) checkOpen() error {
+	if k.closed.Load() {
+		return fmt.Errorf("%w: %s", ErrClosed, k.Directory)
+	}
+	return nil
+}
+
+// lockShard
+// Lock a shard against a Prune running in the background.  A shared PermKV
+// is locked by the shard around each use of it; see KV2.lockPerm.
+func (k *KVShard) lockShard(kv2 *KV2) {
+	kv2.mutex.Lock()
+}
+
+// unlockShard
+// Unlock a shard locked by lockShard
+func (k *KVShard) unlockShard(kv2 *KV2) {
+	kv2.mutex.Unlock()
+}
+
+// lockAll
+// Lock every shard, and then the shared PermKV if there is one, so that
+// nothing is written to the KVShard until unlockAll
+func (k *KVShard) lockAll() {
+	for _, kv2 := range k.Shards {
+		kv2.mutex.Lock()
+	}
+	if k.Perm != nil {
+		k.permMutex.Lock()
+	}
+}
+
+// unlockAll
+// Unlock what lockAll locked
+func (k *KVShard) unlockAll() {
+	if k.Perm != nil {
+		k.permMutex.Unlock()
+	}
+	for _, kv2 := range k.Shards {
+		kv2.mutex.Unlock()
+	}
+}
+
 // PutDyna
 // Find the right shard, and put the key/value in the DynaKV in the shard
 func (k *KVShard) PutDyna(key [32]byte, value []byte) (err error) {
-	index := ShardIndex(key[:])
-	k.Shards[index].Open()
-	if writes, err := k.Shards[index].PutDyna(key, value); err != nil {
+	kv2, err := k.shard(key)
+	if err != nil {
+		return err
+	}
+	defer k.unlockShard(kv2)
+	if writes, err := kv2.PutDyna(key, value); err != nil {
 		return err
 	} else if writes > 5000 {
-		k.Shards[index].Compress()
+		return kv2.Compress()
 	}
 	return nil
 }
@@ -72,12 +285,15 @@ func (k *KVShard) PutDyna(key [32]byte, value []byte) (err error) {
 // PutPerm
 // Find the right shard, and put the key/value in the PermKV in the shard
 func (k *KVShard) PutPerm(key [32]byte, value []byte) (err error) {
-	index := ShardIndex(key[:])
-	k.Shards[index].Open()
-	if writes, err := k.Shards[index].PutPerm(key, value); err != nil {
+	kv2, err := k.shard(key)
+	if err != nil {
+		return err
+	}
+	defer k.unlockShard(kv2)
+	if writes, err := kv2.PutPerm(key, value); err != nil {
 		return err
 	} else if writes > 5000 {
-		k.Shards[index].Compress()
+		return kv2.Compress()
 	}
 	return nil
 }
@@ -85,12 +301,31 @@ func (k *KVShard) PutPerm(key [32]byte, value []byte) (err error) {
 // Put
 // Find the right shard, and put the key/value in said shard
 func (k *KVShard) Put(key [32]byte, value []byte) (err error) {
-	index := ShardIndex(key[:])
-	k.Shards[index].Open()
-	if writes, err := k.Shards[index].Put(key, value); err != nil {
+	kv2, err := k.shard(key)
+	if err != nil {
+		return err
+	}
+	defer k.unlockShard(kv2)
+	if writes, err := kv2.Put(key, value); err != nil {
 		return err
 	} else if writes > 5000 {
-		k.Shards[index].Compress()
+		return kv2.Compress()
+	}
+	return nil
+}
+
+// Delete
+// Find the right shard, and delete the key from said shard
+func (k *KVShard) Delete(key [32]byte) (err error) {
+	kv2, err := k.shard(key)
+	if err != nil {
+		return err
+	}
+	defer k.unlockShard(kv2)
+	if writes, err := kv2.Delete(key); err != nil {
+		return err
+	} else if writes > 5000 {
+		return kv2.Compress()
 	}
 	return nil
 }
@@ -98,9 +333,12 @@ func (k *KVShard) Put(key [32]byte, value []byte) (err error) {
 // GetDyna
 // Find the right shard, and extract the value from the DynaKV in the shard
 func (k *KVShard) GetDyna(key [32]byte) (value []byte, err error) {
-	index := ShardIndex(key[:])
-	k.Shards[index].Open()
-	if value, err = k.Shards[index].GetDyna(key); err != nil {
+	kv2, err := k.shard(key)
+	if err != nil {
+		return nil, err
+	}
+	defer k.unlockShard(kv2)
+	if value, err = kv2.GetDyna(key); err != nil {
 		return nil, err
 	}
 	return value, nil
@@ -109,9 +347,12 @@ func (k *KVShard) GetDyna(key [32]byte) (value []byte, err error) {
 // GetPerm
 // Find the right shard, and extract the value from the PermKV in the shard
 func (k *KVShard) GetPerm(key [32]byte) (value []byte, err error) {
-	index := ShardIndex(key[:])
-	k.Shards[index].Open()
-	if value, err = k.Shards[index].GetPerm(key); err != nil {
+	kv2, err := k.shard(key)
+	if err != nil {
+		return nil, err
+	}
+	defer k.unlockShard(kv2)
+	if value, err = kv2.GetPerm(key); err != nil {
 		return nil, err
 	}
 	return value, nil
@@ -120,32 +361,82 @@ func (k *KVShard) GetPerm(key [32]byte) (value []byte, err error) {
 // Get
 // Find the right shard, and extract the value from said shard
 func (k *KVShard) Get(key [32]byte) (value []byte, err error) {
-	index := ShardIndex(key[:])
-	k.Shards[index].Open()
-	if value, err = k.Shards[index].Get(key); err != nil {
+	kv2, err := k.shard(key)
+	if err != nil {
+		return nil, err
+	}
+	defer k.unlockShard(kv2)
+	if value, err = kv2.Get(key); err != nil {
 		return nil, err
 	}
 	return value, nil
 }
 
+// Has
+// Find the right shard, and return the length of the value of the key, and
+// true if the shard has the key
+func (k *KVShard) Has(key [32]byte) (length uint64, ok bool, err error) {
+	kv2, err := k.shard(key)
+	if err != nil {
+		return 0, false, err
+	}
+	defer k.unlockShard(kv2)
+	return kv2.Has(key)
+}
+
 // Compress
-// Compress all the shards
+// Close the files of all the shards, keeping the lock on each shard
+// directory, purge the PermKV keys their DynaKVs hide, and
+// demote the DynaKV keys that no longer change; see PurgePerm and Demote.
+// The DynaKV values are left as they are; see AppendReencoded.
 func (k *KVShard) Compress() (err error) {
+	if err = k.checkOpen(); err != nil {
+		return err
+	}
+	if k.opts.readOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
 	for _, kvs := range k.Shards {
-		if err = kvs.Close(); err != nil {
+		k.lockShard(kvs)
+		err = kvs.closeFiles() // Reopened when next used
+		k.unlockShard(kvs)
+		if err != nil {
 			return err
 		}
 	}
-	return nil
+	if _, err = k.PurgePerm(); err != nil {
+		return err
+	}
+	_, err = k.Demote()
+	return err
 }
 
 // Close
-// Close all the shards
+// Close all the shards, and release the lock on the directory.  A Prune still
+// running is waited for.
 func (k *KVShard) Close() (err error) {
+	if k.closed.Load() {
+		return nil
+	}
+	k.waitPrune()
+	k.segMutex.Lock()
+	err = k.closeSegments()
+	k.segMutex.Unlock()
+	if err != nil {
+		return err
+	}
 	for _, kvs := range k.Shards {
 		if err = kvs.Close(); err != nil {
 			return err
 		}
 	}
-	return nil
+	if k.Perm != nil {
+		if err = k.Perm.Close(); err != nil {
+			return err
+		}
+	}
+	err = k.lock.unlock()
+	k.lock = nil
+	k.closed.Store(true)
+	return err
 }
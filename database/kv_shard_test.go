@@ -2,6 +2,7 @@ package blockchainDB
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -22,7 +23,7 @@ func TestKVShard(t *testing.T) {
 	var cntWrites, cntReads float64
 
 	fr := NewFastRandom([]byte{1})
-	kvs, err := NewKVShard(dir, 1024, 100_000, 50)
+	kvs, err := NewKVShard(dir, &Options{OffsetsCnt: 1024, KeyLimit: 100_000, MaxCachedBlocks: 50})
 	assert.NoError(t, err, "create kv")
 
 	fmt.Print("Writing\n")
@@ -84,7 +85,7 @@ func TestKVShard_2(t *testing.T) {
 	start := time.Now()
 	var cntWrites, cntReads float64
 
-	kvs, err := NewKVShard(dir, 1024, 100_000, 50)
+	kvs, err := NewKVShard(dir, &Options{Overwrite: true, OffsetsCnt: 1024, KeyLimit: 100_000, MaxCachedBlocks: 50})
 	assert.NoError(t, err, "create kv")
 
 	fmt.Print("Generating Keys\n")
@@ -194,7 +195,7 @@ func TestBuildBig(t *testing.T) {
 	start := time.Now()
 	var cntWrites, cntReads float64
 
-	kvs, err := NewKVShard(dir, 1024, 100_000, 50)
+	kvs, err := NewKVShard(dir, &Options{Overwrite: true, OffsetsCnt: 1024, KeyLimit: 100_000, MaxCachedBlocks: 50})
 	assert.NoError(t, err, "create kv")
 
 	fmt.Print("Writing Keys to the Databases\n")
@@ -249,7 +250,7 @@ func TestBuildBig2(t *testing.T) {
 	start := time.Now()
 	var cntWrites float64
 
-	kvs, err := NewKVShard(dir, 1024, 100_000, 50)
+	kvs, err := NewKVShard(dir, &Options{Overwrite: true, OffsetsCnt: 1024, KeyLimit: 100_000, MaxCachedBlocks: 50})
 	assert.NoError(t, err, "create kv")
 
 	fmt.Print("Writing Keys to the Databases\n")
@@ -293,3 +294,72 @@ func TestBuildBig2(t *testing.T) {
 	cntWrites++
 
 }
+
+func TestOpenKVShard(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+	directory := filepath.Join(dir, "shards")
+
+	const numKVs = 2000
+	opts := &Options{ShardCnt: 8, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1}
+
+	kvs, err := OpenKVShard(directory, opts)
+	assert.NoError(t, err, "create kvShard")
+	assert.Len(t, kvs.Shards, 8, "shard count comes from the options")
+	fr := NewFastRandom([]byte{1})
+	for i := 0; i < numKVs; i++ {
+		assert.NoError(t, kvs.Put(fr.NextHash(), fr.RandBuff(10, 100)), "failed to put")
+	}
+	assert.NoError(t, kvs.Close(), "failed to close")
+
+	// The shard count of an existing database comes from its manifest
+	kvs, err = OpenKVShard(directory, &Options{ShardCnt: 3, BloomSize: .1})
+	assert.NoError(t, err, "open kvShard")
+	assert.Len(t, kvs.Shards, 8, "shard count comes from the manifest")
+	fr.Reset()
+	for i := 0; i < numKVs; i++ {
+		key := fr.NextHash()
+		value, err := kvs.Get(key)
+		assert.NoErrorf(t, err, "failed to get %d", i)
+		assert.Equal(t, fr.RandBuff(10, 100), value, "wrong value")
+	}
+	assert.NoError(t, kvs.Close(), "failed to close")
+}
+
+func TestOpenKVShardReadOnly(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+	directory := filepath.Join(dir, "shards")
+
+	const numKVs = 2000
+	opts := &Options{ShardCnt: 8, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1}
+	kvs, err := NewKVShard(directory, opts)
+	assert.NoError(t, err, "create kvShard")
+	fr := NewFastRandom([]byte{1})
+	for i := 0; i < numKVs; i++ {
+		assert.NoError(t, kvs.Put(fr.NextHash(), fr.RandBuff(10, 100)), "failed to put")
+	}
+	assert.NoError(t, kvs.Close(), "failed to close")
+
+	reader, err := OpenKVShardReadOnly(directory, opts)
+	assert.NoError(t, err, "open reader")
+	assert.Len(t, reader.Shards, 8, "shard count comes from the manifest")
+	_, err = OpenKVShard(directory, opts)
+	assert.True(t, errors.Is(err, ErrLocked), "a reader keeps writers out")
+
+	fr.Reset()
+	for i := 0; i < numKVs; i++ {
+		key := fr.NextHash()
+		value, err := reader.Get(key)
+		assert.NoErrorf(t, err, "failed to get %d", i)
+		assert.Equal(t, fr.RandBuff(10, 100), value, "wrong value")
+	}
+	assert.True(t, errors.Is(reader.Put([32]byte{1}, []byte{1}), ErrReadOnly), "put should fail")
+	assert.True(t, errors.Is(reader.PutDyna([32]byte{1}, []byte{1}), ErrReadOnly), "put should fail")
+	assert.True(t, errors.Is(reader.Compress(), ErrReadOnly), "compress should fail")
+	assert.NoError(t, reader.Close(), "close reader")
+
+	kvs, err = OpenKVShard(directory, opts)
+	assert.NoError(t, err, "open writer after the reader closed")
+	assert.NoError(t, kvs.Close(), "close writer")
+}
@@ -2,7 +2,10 @@ package blockchainDB
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -19,7 +22,7 @@ func TestKV(t *testing.T) {
 	var cntWrites, cntReads float64
 
 	fr := NewFastRandom([]byte{1})
-	kv, err := NewKVShard(dir, 1024, 100_000, 50)
+	kv, err := NewKVShard(dir, &Options{OffsetsCnt: 1024, KeyLimit: 100_000, MaxCachedBlocks: 50})
 	assert.NoError(t, err, "create kv")
 
 	fmt.Print("Writing\n")
@@ -76,7 +79,7 @@ func TestKV_2(t *testing.T) {
 	frKeys := NewFastRandom([]byte{1})
 	frValues := NewFastRandom([]byte{2})
 
-	kv2, err := NewKV2(dir, 1024, 10_000, 50)
+	kv2, err := NewKV2(dir, &Options{OffsetsCnt: 1024, KeyLimit: 10_000, MaxCachedBlocks: 50})
 	assert.NoError(t, err, "create kv")
 
 	fmt.Print("Writing\n")
@@ -203,3 +206,154 @@ func TestKV_2(t *testing.T) {
 	fmt.Printf("Writes per second %10.3f Reads per second %10.3f\n", wps, rps)
 	fmt.Printf("Writes %s Reads %s\n", ComputeTimePerOp(wps), ComputeTimePerOp(rps))
 }
+
+func TestOpenKV(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+	directory := filepath.Join(dir, "kv")
+
+	const numKVs = 5000
+	opts := &Options{History: true, OffsetsCnt: 64, KeyLimit: 1000, BloomSize: .1, Metrics: new(Metrics)}
+
+	// Open creates the KV when it does not exist
+	kv, err := OpenKV(directory, opts)
+	assert.NoError(t, err, "create kv")
+	fr := NewFastRandom([]byte{1})
+	for i := 0; i < numKVs; i++ {
+		assert.NoError(t, kv.Put(fr.NextHash(), fr.RandBuff(10, 100)), "failed to put")
+	}
+	assert.NoError(t, kv.Close(), "failed to close")
+
+	// Open finds the KV that exists, along with everything in it
+	kv, err = OpenKV(directory, opts)
+	assert.NoError(t, err, "open kv")
+	assert.True(t, kv.UseHistory, "history should come from the disk")
+	fr.Reset()
+	for i := 0; i < numKVs; i++ {
+		key := fr.NextHash()
+		value, err := kv.Get(key)
+		assert.NoErrorf(t, err, "failed to get %d", i)
+		assert.Equal(t, fr.RandBuff(10, 100), value, "wrong value")
+	}
+	assert.NoError(t, kv.Close(), "failed to close")
+	assert.Equal(t, uint64(numKVs), opts.Metrics.Puts.Load(), "puts not counted")
+	assert.Equal(t, uint64(numKVs), opts.Metrics.Gets.Load(), "gets not counted")
+}
+
+func TestOpenKVReadOnly(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+	directory := filepath.Join(dir, "kv")
+
+	_, err := OpenKVReadOnly(directory, nil)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "a read-only open must not create a KV")
+
+	const numKVs = 2000
+	opts := &Options{History: true, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1}
+	kv, err := NewKV(directory, opts)
+	assert.NoError(t, err, "create kv")
+	fr := NewFastRandom([]byte{1})
+	for i := 0; i < numKVs; i++ {
+		assert.NoError(t, kv.Put(fr.NextHash(), fr.RandBuff(10, 100)), "failed to put")
+	}
+	assert.NoError(t, kv.Close(), "failed to close")
+	kFile, err := os.ReadFile(filepath.Join(directory, kFileName))
+	assert.NoError(t, err, "read kfile")
+
+	// A reader can open the KV while a writer holds it open
+	writer, err := OpenKV(directory, opts)
+	assert.NoError(t, err, "open writer")
+	kv, err = OpenKVReadOnly(directory, opts)
+	assert.NoError(t, err, "open reader")
+	fr.Reset()
+	for i := 0; i < numKVs; i++ {
+		value, err := kv.Get(fr.NextHash())
+		assert.NoErrorf(t, err, "failed to get %d", i)
+		assert.Equal(t, fr.RandBuff(10, 100), value, "wrong value")
+	}
+	assert.True(t, errors.Is(kv.Put([32]byte{1}, []byte{1}), ErrReadOnly), "put should fail")
+	assert.True(t, errors.Is(kv.Compress(), ErrReadOnly), "compress should fail")
+	assert.NoError(t, kv.Close(), "close reader")
+
+	kFile2, err := os.ReadFile(filepath.Join(directory, kFileName))
+	assert.NoError(t, err, "read kfile")
+	assert.Equal(t, kFile, kFile2, "the reader should not have touched the kfile")
+	assert.NoError(t, writer.Close(), "close writer")
+}
+
+func TestKVDelete(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1}
+	kv, err := NewKV(dir, opts)
+	assert.NoError(t, err, "create kv")
+	fr := NewFastRandom([]byte{1})
+	keys := make([][32]byte, 100)
+	for i := range keys {
+		keys[i] = fr.NextHash()
+		assert.NoError(t, kv.Put(keys[i], []byte{byte(i)}), "put")
+	}
+	for i := 0; i < len(keys); i += 2 {
+		assert.NoError(t, kv.Delete(keys[i]), "delete")
+	}
+	check := func() {
+		for i, key := range keys {
+			value, err := kv.Get(key)
+			if i%2 == 0 {
+				assert.Error(t, err, "deleted keys should not be found")
+			} else {
+				assert.NoError(t, err, "get")
+				assert.Equal(t, []byte{byte(i)}, value)
+			}
+		}
+	}
+	check()
+	assert.NoError(t, kv.Close(), "close")
+	kv, err = OpenKV(dir, opts)
+	assert.NoError(t, err, "open kv")
+	check()
+	assert.NoError(t, kv.kFile.Rebin(), "rebin")
+	check()
+	assert.NoError(t, kv.Close(), "close")
+
+	history, err := NewKV(filepath.Join(dir, "history"), &Options{History: true, OffsetsCnt: 64, BloomSize: .1})
+	assert.NoError(t, err, "create kv")
+	assert.NoError(t, history.Put(keys[0], []byte{0}), "put")
+	assert.Error(t, history.Delete(keys[0]), "values in a KV with history are immutable")
+	assert.NoError(t, history.Close(), "close")
+}
+
+func TestKVHas(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{History: true, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+	kv, err := NewKV(dir, opts)
+	assert.NoError(t, err, "create kv")
+	fr := NewFastRandom([]byte{11})
+	keys := make([][32]byte, 200) // Enough to push keys to the HistoryFile
+	for i := range keys {
+		keys[i] = fr.NextHash()
+		assert.NoError(t, kv.Put(keys[i], make([]byte, i)), "put")
+	}
+	check := func() {
+		gets := opts.Metrics.Gets.Load()
+		for i, key := range keys {
+			length, ok, err := kv.Has(key)
+			assert.NoError(t, err, "has")
+			assert.True(t, ok, "key %d", i)
+			assert.Equal(t, uint64(i), length, "length of key %d", i)
+		}
+		_, ok, err := kv.Has(fr.NextHash())
+		assert.NoError(t, err, "a missing key is not an error")
+		assert.False(t, ok, "missing key")
+		assert.Equal(t, gets, opts.Metrics.Gets.Load(), "no value was read")
+	}
+	check()
+	assert.NoError(t, kv.Close(), "close")
+	kv, err = OpenKV(dir, opts)
+	assert.NoError(t, err, "open kv")
+	check()
+	assert.NoError(t, kv.Close(), "close")
+}
@@ -0,0 +1,54 @@
+package blockchainDB
+
+import "errors"
+
+// Layer
+// The layer of a KV2 that answered a Get
+type Layer int
+
+const (
+	LayerNone Layer = iota // Neither layer has the key
+	LayerPerm              // The PermKV has the key
+	LayerDyna              // The DynaKV has the key, or a tombstone hiding it
+)
+
+// String
+// Returns the name of the layer
+func (l Layer) String() string {
+	switch l {
+	case LayerPerm:
+		return "perm"
+	case LayerDyna:
+		return "dyna"
+	}
+	return "none"
+}
+
+// GetWithLayer
+// Get a value from the KV2, as Get does, along with the layer that answered.
+// A deleted key is answered by the DynaKV.  Counts the hits of each layer in
+// the Metrics.
+func (k *KV2) GetWithLayer(key [32]byte) (value []byte, layer Layer, err error) {
+	if value, err = k.DynaKV.Get(key); err == nil || errors.Is(err, errDeleted) {
+		k.opts.Metrics.DynaHits.Add(1)
+		return value, LayerDyna, err
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, LayerNone, err
+	}
+	if value, err = k.permGet(key); err != nil {
+		return nil, LayerNone, err
+	}
+	k.opts.Metrics.PermHits.Add(1)
+	return value, LayerPerm, nil
+}
+
+// GetWithLayer
+// Find the right shard, and get the value and the layer that answered
+func (k *KVShard) GetWithLayer(key [32]byte) (value []byte, layer Layer, err error) {
+	kv2, err := k.shard(key)
+	if err != nil {
+		return nil, LayerNone, err
+	}
+	defer k.unlockShard(kv2)
+	return kv2.GetWithLayer(key)
+}
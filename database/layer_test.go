@@ -0,0 +1,64 @@
+package blockchainDB
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetWithLayer(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+	kv2, err := NewKV2(dir, opts)
+	assert.NoError(t, err, "create KV2")
+
+	perm, dyna, gone := [32]byte{1}, [32]byte{2}, [32]byte{3}
+	_, err = kv2.Put(perm, []byte("perm"))
+	assert.NoError(t, err, "put")
+	_, err = kv2.Put(dyna, []byte("first"))
+	assert.NoError(t, err, "put")
+	_, err = kv2.Put(dyna, []byte("second"))
+	assert.NoError(t, err, "a changed PermKV key is promoted")
+	_, err = kv2.Put(dyna, []byte("second"))
+	assert.NoError(t, err, "the same value again")
+	_, err = kv2.Put(gone, []byte("gone"))
+	assert.NoError(t, err, "put")
+	_, err = kv2.Delete(gone)
+	assert.NoError(t, err, "delete")
+
+	for _, c := range []struct {
+		key   [32]byte
+		value string
+		layer Layer
+	}{{perm, "perm", LayerPerm}, {dyna, "second", LayerDyna}, {gone, "", LayerDyna}, {[32]byte{4}, "", LayerNone}} {
+		value, layer, err := kv2.GetWithLayer(c.key)
+		assert.Equal(t, c.layer, layer, "layer of %x", c.key[:1])
+		if c.value == "" {
+			assert.Error(t, err, "not found")
+		} else if assert.NoError(t, err, "get with layer") {
+			assert.Equal(t, c.value, string(value))
+		}
+	}
+	assert.Equal(t, uint64(1), opts.Metrics.PermHits.Load(), "perm hits")
+	assert.Equal(t, uint64(2), opts.Metrics.DynaHits.Load(), "dyna hits")
+	assert.Equal(t, uint64(1), opts.Metrics.Promotions.Load(), "promotions")
+	assert.Equal(t, uint64(1), opts.Metrics.NoOpWrites.Load(), "no-op writes")
+	assert.NoError(t, kv2.Close(), "close")
+
+	// With StrictImmutable, changing a PermKV key is an error
+	opts.StrictImmutable = true
+	kv2, err = OpenKV2(dir, opts)
+	assert.NoError(t, err, "open")
+	_, err = kv2.Put(perm, []byte("changed"))
+	assert.True(t, errors.Is(err, ErrImmutable), "no promotion")
+	_, err = kv2.Put(dyna, []byte("third"))
+	assert.NoError(t, err, "a DynaKV key still changes")
+	value, layer, err := kv2.GetWithLayer(perm)
+	assert.NoError(t, err, "get with layer")
+	assert.Equal(t, LayerPerm, layer)
+	assert.Equal(t, "perm", string(value), "the PermKV value is unchanged")
+	assert.NoError(t, kv2.Close(), "close")
+}
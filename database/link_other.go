@@ -0,0 +1,12 @@
+//go:build !unix
+
+package blockchainDB
+
+import "os"
+
+// linkCount
+// Link counts are only read on unix systems.  Elsewhere the count is not
+// known, and a linked file is assumed to be shared.
+func linkCount(info os.FileInfo) uint64 {
+	return 0
+}
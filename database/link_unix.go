@@ -0,0 +1,17 @@
+//go:build unix
+
+package blockchainDB
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkCount
+// Returns the number of hard links to the file, or 0 if it is not known
+func linkCount(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 0
+}
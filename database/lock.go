@@ -0,0 +1,128 @@
+package blockchainDB
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const lockFilename = "LOCK" // Lock file in the root of every KV, KV2 and KVShard
+
+// dirLock
+// A lock on a database directory.  The lock is held on the LOCK file in the
+// directory for as long as the database is open.  A writer holds an exclusive
+// lock, so a second process (or a second open in the same process) cannot use
+// the directory.  Readers hold a shared lock, which keeps writers out but not
+// other readers.
+//
+// The writer records its PID in the LOCK file, so whoever is locked out can
+// be told who holds the lock.
+type dirLock struct {
+	file   *os.File // The open LOCK file that holds the lock
+	shared bool     // True if this is a reader's shared lock
+}
+
+// lockDirectory
+// Take the exclusive lock on the given directory, creating the directory and
+// the LOCK file if they do not exist.  Fails with ErrLocked if the lock is held.
+func lockDirectory(directory string) (lock *dirLock, err error) {
+	if err = os.MkdirAll(directory, os.ModePerm); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(directory, lockFilename), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(file, false); err != nil {
+		file.Close()
+		return nil, lockError(directory, err)
+	}
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n") // Tell anyone locked out who holds the lock
+	if err = file.Truncate(0); err == nil {
+		_, err = file.WriteAt(pid, 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &dirLock{file: file}, nil
+}
+
+// lockDirectoryShared
+// Take a shared lock on the given directory.  Nothing is created; a directory
+// without a LOCK file (a copy of a database, say) is not locked, and nil is
+// returned.  Fails with ErrLocked if a writer holds the lock.
+func lockDirectoryShared(directory string) (lock *dirLock, err error) {
+	file, err := os.Open(filepath.Join(directory, lockFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(file, true); err != nil {
+		file.Close()
+		return nil, lockError(directory, err)
+	}
+	return &dirLock{file: file, shared: true}, nil
+}
+
+// lockReader
+// Take the shared lock for a read-only open.  Readers are allowed to use a
+// database that a writer has open, so if a writer holds the lock the reader
+// goes on without one.
+func lockReader(directory string) (lock *dirLock, err error) {
+	if lock, err = lockDirectoryShared(directory); errors.Is(err, ErrLocked) {
+		return nil, nil
+	}
+	return lock, err
+}
+
+// lockError
+// Add the holder of the lock to an ErrLocked error
+func lockError(directory string, err error) error {
+	if !errors.Is(err, ErrLocked) {
+		return err
+	}
+	data, _ := os.ReadFile(filepath.Join(directory, lockFilename))
+	if pid := strings.TrimSpace(string(data)); pid != "" {
+		return fmt.Errorf("%w: %s is held by pid %s", ErrLocked, directory, pid)
+	}
+	return fmt.Errorf("%w: %s is held by readers", ErrLocked, directory)
+}
+
+// unlock
+// Release the lock.  Unlocking a nil lock does nothing.
+func (l *dirLock) unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	if !l.shared {
+		l.file.Truncate(0) // The PID is no longer the holder
+	}
+	err := l.file.Close() // Closing the file releases the lock
+	l.file = nil
+	return err
+}
+
+// clearDirectory
+// Remove everything in the directory but the LOCK file.  Used to overwrite a
+// database while holding its lock.
+func clearDirectory(directory string) error {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == lockFilename {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(directory, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
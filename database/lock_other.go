@@ -0,0 +1,12 @@
+//go:build !unix
+
+package blockchainDB
+
+import "os"
+
+// lockFile
+// File locks are only implemented on unix systems.  Elsewhere the LOCK file is
+// created but not locked.
+func lockFile(file *os.File, shared bool) error {
+	return nil
+}
@@ -0,0 +1,102 @@
+package blockchainDB
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewExists(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{ShardCnt: 8, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+	key := [32]byte{1}
+	assert.NoError(t, kvs.Put(key, []byte("value")), "put")
+	assert.NoError(t, kvs.Close(), "close")
+
+	_, err = NewKVShard(dir, opts)
+	assert.True(t, errors.Is(err, ErrExists), "New over an existing KVShard should fail")
+
+	kvs, err = OpenKVShard(dir, opts)
+	assert.NoError(t, err, "open KVShard")
+	value, err := kvs.Get(key)
+	assert.NoError(t, err, "the failed New should not have touched the data")
+	assert.Equal(t, []byte("value"), value)
+	assert.NoError(t, kvs.Close(), "close")
+
+	overwrite := *opts
+	overwrite.Overwrite = true
+	kvs, err = NewKVShard(dir, &overwrite)
+	assert.NoError(t, err, "Overwrite should replace the KVShard")
+	_, err = kvs.Get(key)
+	assert.Error(t, err, "the old data should be gone")
+	assert.NoError(t, kvs.Close(), "close")
+
+	_, err = NewKV(dir+"/kv", opts)
+	assert.NoError(t, err, "create KV")
+	_, err = NewKFile(dir+"/kv", opts)
+	assert.True(t, errors.Is(err, ErrExists), "New over an existing KFile should fail")
+}
+
+func TestLocked(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{ShardCnt: 8, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+
+	_, err = OpenKVShard(dir, opts)
+	assert.True(t, errors.Is(err, ErrLocked), "a second open should fail")
+	_, err = NewKVShard(dir, &Options{Overwrite: true})
+	assert.True(t, errors.Is(err, ErrLocked), "an overwrite of an open KVShard should fail")
+	assert.NoError(t, kvs.Compress(), "compress")
+	_, err = lockDirectory(kvs.ShardDir(0))
+	assert.True(t, errors.Is(err, ErrLocked), "Compress should keep the shards locked")
+
+	assert.NoError(t, kvs.Close(), "close")
+	kvs, err = OpenKVShard(dir, opts)
+	assert.NoError(t, err, "open after close")
+	assert.NoError(t, kvs.Close(), "close")
+}
+
+func TestLockHolder(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1}
+	kv, err := NewKV(dir, opts)
+	assert.NoError(t, err, "create KV")
+
+	_, err = OpenKV(dir, opts)
+	assert.True(t, errors.Is(err, ErrLocked), "a second open should fail")
+	assert.Contains(t, err.Error(), fmt.Sprintf("pid %d", os.Getpid()), "the error should name the holder")
+	_, err = lockDirectoryShared(dir)
+	assert.True(t, errors.Is(err, ErrLocked), "a reader should be locked out by a writer")
+
+	assert.NoError(t, kv.Close(), "close")
+
+	r1, err := lockDirectoryShared(dir)
+	assert.NoError(t, err, "first reader")
+	r2, err := lockDirectoryShared(dir)
+	assert.NoError(t, err, "readers share the lock")
+	_, err = OpenKV(dir, opts)
+	assert.True(t, errors.Is(err, ErrLocked), "a writer should be locked out by readers")
+	assert.Contains(t, err.Error(), "held by readers")
+
+	assert.NoError(t, r1.unlock())
+	assert.NoError(t, r2.unlock())
+	kv, err = OpenKV(dir, opts)
+	assert.NoError(t, err, "open after the readers are done")
+	assert.NoError(t, kv.Close(), "close")
+
+	lock, err := lockDirectoryShared(t.TempDir())
+	assert.NoError(t, err, "a directory without a LOCK file")
+	assert.Nil(t, lock)
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package blockchainDB
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile
+// Take a flock on the file without waiting; shared for readers, exclusive
+// otherwise.  Returns ErrLocked if the lock is held.
+func lockFile(file *os.File, shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrLocked
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package blockchainDB
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	manifestFilename    = "manifest.json"     // Name of the manifest in a database root
+	manifestTmpFilename = "manifest_tmp.json" // Manifest under construction
+	ManifestVersion     = 1                   // Version of the manifest format
+)
+
+// Manifest
+// The structural settings of a database, kept in its root directory so that
+// opening the database does not depend on the caller passing the same Options
+// used to create it.
+type Manifest struct {
+	Version     int               // Version of the manifest format
+	ShardCnt    int               // Number of shards in a KVShard
+	SharedPerm  bool              `json:",omitempty"` // The shards of a KVShard share one PermKV, in its root
+	Height      uint64            `json:",omitempty"` // Last height committed by KVShard.Commit
+	KeepHeights uint64            `json:",omitempty"` // Retention: history is kept for the last N committed heights
+	KeepAfter   uint64            `json:",omitempty"` // Retention: history is kept for every height after H
+	PrunedBelow uint64            `json:",omitempty"` // History below this height was dropped by KVShard.Prune
+	Links       map[string]int64  `json:",omitempty"` // Values files a checkpoint shares with its source, and their lengths
+	Sealed      map[uint64]uint64 `json:",omitempty"` // Height of the last write in each sealed segment, by major block
+}
+
+// ReadManifest
+// Read the manifest from the given database directory
+func ReadManifest(directory string) (manifest *Manifest, err error) {
+	data, err := os.ReadFile(filepath.Join(directory, manifestFilename))
+	if err != nil {
+		return nil, err
+	}
+	manifest = new(Manifest)
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("%w: manifest in %s: %v", ErrCorrupt, directory, err)
+	}
+	return manifest, nil
+}
+
+// Write
+// Write the manifest into the given database directory.  The manifest is
+// written to a tmp file and renamed, so a crash leaves either the old or the
+// new manifest, never a partial one.
+func (m *Manifest) Write(directory string, sync SyncPolicy) (err error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpName := filepath.Join(directory, manifestTmpFilename)
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if sync != SyncNever {
+		if err = file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filepath.Join(directory, manifestFilename))
+}
@@ -0,0 +1,47 @@
+package blockchainDB
+
+import "sync/atomic"
+
+// Metrics
+// Counters shared by all the layers opened with the same Options.  Counters are
+// updated atomically, so they can be read while the database is in use.
+type Metrics struct {
+	Puts         atomic.Uint64 // Values written by KV.Put
+	Gets         atomic.Uint64 // Values read from a values file by KV.Get
+	BytesWritten atomic.Uint64 // Bytes written to values files, after compression
+	BytesRead    atomic.Uint64 // Bytes read from values files, before decompression
+	KeyFlushes   atomic.Uint64 // Times a KFile rewrote its keys to disk
+	Compressions atomic.Uint64 // Times a KV was compressed
+	Commits      atomic.Uint64 // Heights committed by KVShard.Commit
+	BytesPruned  atomic.Uint64 // Bytes freed by Prune
+	PermPurged   atomic.Uint64 // Shadowed PermKV keys removed by PurgePerm
+	PermHits     atomic.Uint64 // KV2 Gets answered by the PermKV
+	DynaHits     atomic.Uint64 // KV2 Gets answered by the DynaKV
+	Promotions   atomic.Uint64 // PermKV keys moved to the DynaKV by a Put of a new value
+	NoOpWrites   atomic.Uint64 // KV2 Puts of the value the key already has
+	Demotions    atomic.Uint64 // DynaKV keys moved to the PermKV by Demote
+	CacheHits    atomic.Uint64 // Values found in the value cache
+	CacheMisses  atomic.Uint64 // Values not in the value cache, read from a values file
+	Recompressed atomic.Uint64 // Raw values copied compressed by AppendReencoded
+	Reencrypted  atomic.Uint64 // Values copied under the current key by AppendReencoded
+	Deduped      atomic.Uint64 // Values KV.Put found already stored, and did not write again
+}
+
+// Metrics
+// Returns the Metrics the KV reports to: the one in its Options, or one of
+// its own if the Options had none
+func (k *KV) Metrics() *Metrics {
+	return k.opts.Metrics
+}
+
+// Metrics
+// Returns the Metrics the KV2 and its layers report to; see KV.Metrics
+func (k *KV2) Metrics() *Metrics {
+	return k.opts.Metrics
+}
+
+// Metrics
+// Returns the Metrics the KVShard and its shards report to; see KV.Metrics
+func (k *KVShard) Metrics() *Metrics {
+	return k.opts.Metrics
+}
@@ -0,0 +1,217 @@
+package blockchainDB
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// MultiGet
+//
+// Prefetching the keys of a block one Get at a time reads the bin of the key
+// file for every key, and seeks the values file for every value.  MultiGet
+// groups the keys by shard and by bin, reads each bin once, and reads the
+// values in offset order, one read for each run of values that lie close
+// together.  Results come back in the order of the keys, each with its own
+// error.
+
+const coalesceGap = 4096 // Bytes between two values still read in one go
+
+// MultiGet
+// Returns the DBBKey of each key, and an error for each key that is not
+// found.  Each bin of the key file and of the HistoryFile is read once.
+func (k *KFile) MultiGet(keys [][32]byte) (dbBKeys []*DBBKey, errs []error) {
+	dbBKeys = make([]*DBBKey, len(keys))
+	errs = make([]error, len(keys))
+	bins := make(map[int][]int) // The keys (by position) to look for in each bin
+	for i, key := range keys {
+		if dbBKey, ok := k.Cache[key]; ok {
+			dbBKeys[i] = dbBKey
+		} else if k.BloomFilter != nil && !k.BloomFilter.Test(key) {
+			errs[i] = ErrNotFound
+		} else {
+			index := k.OffsetIndex(key[:])
+			bins[index] = append(bins[index], i)
+		}
+	}
+	missed := searchBins(keys, bins, k.kBin, dbBKeys, errs)
+	if len(missed) == 0 {
+		return dbBKeys, errs
+	}
+	if k.History == nil {
+		for _, i := range missed {
+			errs[i] = ErrNotFound
+		}
+		return dbBKeys, errs
+	}
+
+	k.HistoryMutex.Lock()
+	defer k.HistoryMutex.Unlock()
+	bins = make(map[int][]int)
+	for _, i := range missed {
+		index := k.History.Index(keys[i])
+		bins[index] = append(bins[index], i)
+	}
+	for _, i := range searchBins(keys, bins, k.History.bin, dbBKeys, errs) {
+		errs[i] = ErrNotFound
+	}
+	return dbBKeys, errs
+}
+
+// searchBins
+// Read each bin once, in index order, and look for its keys in it.  Returns
+// the keys (by position) in none of the bins.
+func searchBins(keys [][32]byte, bins map[int][]int, bin func(index int) ([]byte, error),
+	dbBKeys []*DBBKey, errs []error) (missed []int) {
+	indexes := make([]int, 0, len(bins))
+	for index := range bins {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes) // Bins are in index order in the file
+	for _, index := range indexes {
+		section, err := bin(index)
+		for _, i := range bins[index] {
+			if err == nil {
+				dbBKeys[i], errs[i] = findKey(section, keys[i])
+			} else {
+				errs[i] = err
+			}
+			if errs[i] == nil && dbBKeys[i] == nil {
+				missed = append(missed, i)
+			}
+		}
+	}
+	return missed
+}
+
+// MultiGet
+// Get the value of each key.  Returns the values in the order of the keys,
+// and an error for each key that could not be read.
+func (k *KV) MultiGet(keys [][32]byte) (values [][]byte, errs []error) {
+	dbbKeys, errs := k.kFile.MultiGet(keys)
+	values = make([][]byte, len(keys))
+	var reads []int // The keys (by position) with a value to read
+	for i, dbbKey := range dbbKeys {
+		switch {
+		case errs[i] != nil:
+		case dbbKey.IsDeleted():
+			errs[i] = errDeleted
+		case dbbKey.IsCleared():
+			errs[i] = ErrNotFound
+		default:
+			if value, ok := k.opts.cache.get(k.cacheKey(dbbKey)); ok {
+				values[i] = value
+			} else {
+				reads = append(reads, i)
+			}
+		}
+	}
+	sort.Slice(reads, func(a, b int) bool { return dbbKeys[reads[a]].Offset < dbbKeys[reads[b]].Offset })
+
+	for len(reads) > 0 {
+		// Extend the read over every value that starts within coalesceGap of its end
+		first := dbbKeys[reads[0]].Offset
+		end := first + dbbKeys[reads[0]].Size()
+		n := 1
+		for ; n < len(reads) && dbbKeys[reads[n]].Offset <= end+coalesceGap; n++ {
+			end = max(end, dbbKeys[reads[n]].Offset+dbbKeys[reads[n]].Size())
+		}
+		span := make([]byte, end-first)
+		err := k.vFile.ReadAt(first, span)
+		if err != nil {
+			err = fmt.Errorf("reading %d bytes at offset %d of %s: %w", len(span), first, k.vFile.Filename, err)
+		}
+		for _, i := range reads[:n] {
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			start := dbbKeys[i].Offset - first
+			stop := start + dbbKeys[i].Size()
+			k.opts.Metrics.Gets.Add(1)
+			k.opts.Metrics.BytesRead.Add(stop - start)
+			// A raw value is a slice of the span; appending to it can't overwrite the next
+			if values[i], errs[i] = k.decodeValue(dbbKeys[i], span[start:stop:stop]); errs[i] != nil {
+				errs[i] = fmt.Errorf("value at offset %d of %s: %w", dbbKeys[i].Offset, k.vFile.Filename, errs[i])
+				continue
+			}
+			k.opts.cache.add(k.cacheKey(dbbKeys[i]), values[i])
+		}
+		reads = reads[n:]
+	}
+	return values, errs
+}
+
+// MultiGet
+// Get the value of each key from the KV2, as Get does.  Keys the DynaKV does
+// not have are looked up in the PermKV together.
+func (k *KV2) MultiGet(keys [][32]byte) (values [][]byte, errs []error) {
+	values, errs = k.DynaKV.MultiGet(keys)
+	var perm []int // The keys (by position) to look up in the PermKV
+	for i, err := range errs {
+		if err == nil || errors.Is(err, errDeleted) {
+			k.opts.Metrics.DynaHits.Add(1)
+		} else if errors.Is(err, ErrNotFound) {
+			perm = append(perm, i)
+		}
+	}
+	if len(perm) == 0 {
+		return values, errs
+	}
+	permKeys := make([][32]byte, len(perm))
+	for j, i := range perm {
+		permKeys[j] = keys[i]
+	}
+	k.lockPerm()
+	permValues, permErrs := k.PermKV.MultiGet(permKeys)
+	k.unlockPerm()
+	for j, i := range perm {
+		values[i], errs[i] = permValues[j], permErrs[j]
+		if errs[i] == nil {
+			k.opts.Metrics.PermHits.Add(1)
+		}
+	}
+	return values, errs
+}
+
+// MultiGet
+// Get the value of each key.  The keys are grouped by shard, and each shard
+// is locked once for all of its keys.
+func (k *KVShard) MultiGet(keys [][32]byte) (values [][]byte, errs []error) {
+	values = make([][]byte, len(keys))
+	errs = make([]error, len(keys))
+	shards := make([][]int, len(k.Shards)) // The keys (by position) in each shard
+	for i, key := range keys {
+		index := k.Index(key)
+		shards[index] = append(shards[index], i)
+	}
+	for index, list := range shards {
+		if len(list) == 0 {
+			continue
+		}
+		shardKeys := make([][32]byte, len(list))
+		for j, i := range list {
+			shardKeys[j] = keys[i]
+		}
+		shardValues, shardErrs := k.multiGetShard(index, shardKeys)
+		for j, i := range list {
+			values[i], errs[i] = shardValues[j], shardErrs[j]
+		}
+	}
+	return values, errs
+}
+
+// multiGetShard
+// MultiGet the keys from one shard, holding its lock
+func (k *KVShard) multiGetShard(index int, keys [][32]byte) (values [][]byte, errs []error) {
+	kv2, err := k.shardAt(index)
+	if err != nil {
+		errs = make([]error, len(keys))
+		for i := range errs {
+			errs[i] = err
+		}
+		return make([][]byte, len(keys)), errs
+	}
+	defer k.unlockShard(kv2)
+	return kv2.MultiGet(keys)
+}
@@ -0,0 +1,60 @@
+package blockchainDB
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiGet(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+
+	fr := NewFastRandom([]byte{12})
+	var keys [][32]byte
+	for i := 0; i < 500; i++ { // Enough to push keys to the HistoryFiles
+		key := fr.NextHash()
+		keys = append(keys, key)
+		assert.NoError(t, kvs.Put(key, []byte(fmt.Sprintf("perm %d", i))), "put")
+		switch i % 5 {
+		case 1:
+			assert.NoError(t, kvs.Put(key, []byte(fmt.Sprintf("changed %d", i))), "put")
+		case 2:
+			assert.NoError(t, kvs.PutDyna(key, []byte(fmt.Sprintf("dyna %d", i))), "put dyna")
+		case 3:
+			assert.NoError(t, kvs.Delete(key), "delete")
+		}
+		if i%50 == 0 {
+			keys = append(keys, fr.NextHash(), keys[i/2]) // Missing keys, and keys asked for twice
+		}
+	}
+
+	check := func(what string) {
+		values, errs := kvs.MultiGet(keys)
+		assert.Equal(t, len(keys), len(values), what)
+		assert.Equal(t, len(keys), len(errs), what)
+		for i, key := range keys {
+			value, err := kvs.Get(key)
+			if err != nil {
+				assert.True(t, errors.Is(errs[i], ErrNotFound), "%s: key %d is not found", what, i)
+			} else if assert.NoError(t, errs[i], what) {
+				assert.Equal(t, string(value), string(values[i]), "%s: key %d", what, i)
+			}
+		}
+	}
+	check("open")
+	assert.NoError(t, kvs.Close(), "close")
+
+	kvs, err = OpenKVShard(dir, opts)
+	assert.NoError(t, err, "open")
+	check("reopen")
+	assert.NoError(t, kvs.Close(), "close")
+	_, errs := kvs.MultiGet(keys[:1])
+	assert.True(t, errors.Is(errs[0], ErrClosed), "closed")
+}
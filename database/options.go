@@ -0,0 +1,127 @@
+package blockchainDB
+
+import (
+	"time"
+)
+
+// SyncPolicy
+// Controls when buffered writes are forced to stable storage
+type SyncPolicy int
+
+const (
+	SyncNever   SyncPolicy = iota // Leave it to the OS to write data back (default)
+	SyncOnClose                   // fsync files as they are closed
+	SyncAlways                    // fsync after every buffer flush
+)
+
+// Default values used for any Options field left at its zero value
+const (
+	DefaultBloomSize       = 10.0             // 10MB Bloom filter per KFile
+	DefaultBloomHashes     = 3                // Hash functions per Bloom filter
+	DefaultOffsetsCnt      = 1024             // Bins in a KFile offset table
+	DefaultKeyLimit        = 100_000          // Keys in a KFile before a push to History
+	DefaultMaxCachedBlocks = 50               // Buffers of keys in a KFile tail before a Rebin
+	DefaultViewTimeout     = time.Second * 30 // Idle time before a View expires
+)
+
+// Logger
+// Anything that can print a formatted line; *log.Logger qualifies
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Options
+// Configuration shared by every layer of the database (KFile, KV, KV2, KVShard
+// and KVView).  Any field left at its zero value takes its default, so &Options{}
+// (or even a nil *Options) is a valid set of options.
+//
+// Structural settings (OffsetsCnt, ShardCnt, History, Versioned, SharedPerm) are only used when a
+// database is created.  Opening an existing database uses what is on disk.
+type Options struct {
+	Overwrite       bool          // Let New* replace an existing database instead of failing with ErrExists
+	History         bool          // KV only: keys are pushed to a HistoryFile and values are immutable
+	Versioned       bool          // KV2 and KVShard: keep the versions of DynaKV values by height, for GetAt
+	SharedPerm      bool          // KVShard: one PermKV shared by every shard, instead of one per shard
+	StrictImmutable bool          // KV2 and KVShard: Put of a new value for a PermKV key fails with ErrImmutable
+	DemoteAfter     uint64        // KV2 and KVShard: compaction moves DynaKV keys unchanged for N commits to the PermKV; 0 never does
+	KeepHeights     uint64        // Retention: keep the history of the last N committed heights; 0 keeps all
+	KeepAfter       uint64        // Retention: keep the history of every height after H; 0 keeps all
+	Sync            SyncPolicy    // When writes are forced to disk
+	BloomSize       float64       // Size of each KFile Bloom filter in MB
+	BloomHashes     int           // Number of hash functions used by each Bloom filter
+	BufferSize      int           // Size of the write buffer of each BFile in bytes
+	OffsetsCnt      uint64        // Number of bins in the KFile offset table
+	KeyLimit        uint64        // Keys in a KFile with History that trigger a push to History
+	MaxCachedBlocks int           // Buffers of keys in the KFile tail before it is re-binned
+	ShardCnt        int           // Number of shards in a KVShard
+	ViewTimeout     time.Duration // How long an idle View in a KVView stays valid
+	Logger          Logger        // Where to report notable events; nil is silent
+	Metrics         *Metrics      // Counters shared by every layer opened with these Options; nil gets one, see KVShard.Metrics
+	Compression     Compression   // How a KV compresses the values it writes; in a KV2, the DynaKV and VersKV
+	PermCompression Compression   // KV2 and KVShard: how the PermKV compresses the values it writes
+	Dedup           bool          // KV with History: store each distinct value once; see dedup.go
+	PermDedup       bool          // KV2 and KVShard: the PermKV stores each distinct value once
+	Keys            KeyProvider   // Encrypts the KVs created with these Options; see crypt.go
+	CacheSize       int64         // Bytes of values kept in an LRU cache shared by the layers opened together; 0 caches none
+
+	readOnly bool        // Set by the Open*ReadOnly functions; every file is opened O_RDONLY
+	cache    *valueCache // The value cache, made by withDefaults if CacheSize is set; see cache.go
+	crypt    *crypter    // Encrypts files by blocks; set by a KV for the files of its KFile
+}
+
+// DefaultOptions
+// Returns a fully populated set of Options
+func DefaultOptions() *Options {
+	return new(Options).withDefaults()
+}
+
+// withDefaults
+// Returns a copy of the options with every zero field set to its default.  The
+// copy shares the Logger and Metrics of the original, so all the layers opened
+// from one set of Options report to the same place, and they share one value
+// cache.
+func (o *Options) withDefaults() *Options {
+	opts := new(Options)
+	if o != nil {
+		*opts = *o
+	}
+	if opts.BloomSize <= 0 {
+		opts.BloomSize = DefaultBloomSize
+	}
+	if opts.BloomHashes <= 0 {
+		opts.BloomHashes = DefaultBloomHashes
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = BufferSize
+	}
+	if opts.OffsetsCnt == 0 {
+		opts.OffsetsCnt = DefaultOffsetsCnt
+	}
+	if opts.KeyLimit == 0 {
+		opts.KeyLimit = DefaultKeyLimit
+	}
+	if opts.MaxCachedBlocks <= 0 {
+		opts.MaxCachedBlocks = DefaultMaxCachedBlocks
+	}
+	if opts.ShardCnt <= 0 {
+		opts.ShardCnt = NumShards
+	}
+	if opts.ViewTimeout <= 0 {
+		opts.ViewTimeout = DefaultViewTimeout
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = new(Metrics)
+	}
+	if opts.CacheSize > 0 && opts.cache == nil {
+		opts.cache = newValueCache(opts.CacheSize, opts.Metrics)
+	}
+	return opts
+}
+
+// logf
+// Report an event to the Logger, if there is one
+func (o *Options) logf(format string, v ...any) {
+	if o != nil && o.Logger != nil {
+		o.Logger.Printf(format, v...)
+	}
+}
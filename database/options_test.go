@@ -0,0 +1,53 @@
+package blockchainDB
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptions(t *testing.T) {
+	// A nil set of options is fully populated with defaults
+	opts := (*Options)(nil).withDefaults()
+	assert.Equal(t, DefaultOptions(), opts, "nil options should be the defaults")
+	assert.Equal(t, NumShards, opts.ShardCnt, "default shard count")
+	assert.Equal(t, BufferSize, opts.BufferSize, "default buffer size")
+	assert.NotNil(t, opts.Metrics, "metrics should always exist")
+
+	// Fields that are set are kept, and the original is not modified
+	metrics := new(Metrics)
+	set := &Options{ShardCnt: 16, KeyLimit: 10, Sync: SyncAlways, Metrics: metrics}
+	opts = set.withDefaults()
+	assert.Equal(t, 16, opts.ShardCnt, "shard count should be kept")
+	assert.Equal(t, uint64(10), opts.KeyLimit, "key limit should be kept")
+	assert.Equal(t, SyncAlways, opts.Sync, "sync policy should be kept")
+	assert.True(t, metrics == opts.Metrics, "metrics should be shared")
+	assert.Equal(t, 0, set.BufferSize, "original options should not change")
+}
+
+func TestMetricsAccessor(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	// Without Metrics in the Options, the KVShard keeps its own, shared by its layers
+	kvs, err := NewKVShard(dir, &Options{ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1})
+	assert.NoError(t, err, "create KVShard")
+	metrics := kvs.Metrics()
+	assert.NotNil(t, metrics, "metrics should always exist")
+	assert.NoError(t, kvs.Put([32]byte{1}, []byte("value")), "put")
+	assert.NoError(t, kvs.Commit(1), "commit")
+	assert.Equal(t, uint64(1), metrics.Commits.Load(), "commits")
+	assert.Equal(t, uint64(1), metrics.Puts.Load(), "puts by a shard")
+	for _, kv2 := range kvs.Shards {
+		assert.True(t, metrics == kv2.Metrics(), "shared with the shards")
+		assert.True(t, metrics == kv2.DynaKV.Metrics(), "shared with the layers")
+	}
+	assert.NoError(t, kvs.Close(), "close")
+
+	// Metrics passed in are the ones returned
+	set := new(Metrics)
+	kvs, err = OpenKVShard(dir, &Options{Metrics: set})
+	assert.NoError(t, err, "open KVShard")
+	assert.True(t, set == kvs.Metrics(), "the caller's metrics")
+	assert.NoError(t, kvs.Close(), "close")
+}
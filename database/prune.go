@@ -0,0 +1,425 @@
+package blockchainDB
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Pruning history
+//
+// Undo logs and version lists only grow.  Prune drops the history below a
+// height: the undo records written before the Commit of the height, so the
+// KV2 can no longer be rolled back below it; the versions no height at or
+// above it reads; and the tombstones in the DynaKV that nothing needs any
+// more, those of keys not in the PermKV and not written since the height.
+//
+// The undo log is cut by copying the records kept to a tmp file renamed over
+// it.  The VersKV is rewritten into a tmp directory that replaces it, which
+// also drops the old lists from its values file.  The values of old versions
+// stay in the DynaKV's values file.
+//
+// A KVShard records the height it prunes below, and its retention
+// (KeepHeights and KeepAfter), in its manifest, and prunes its shards in the
+// background, one at a time.
+
+const (
+	undoTmpFilename = "undo_tmp.dat" // Undo log under construction by Prune
+	versTmpDirName  = "vers_tmp"     // VersKV under construction by Prune
+	versOldDirName  = "vers_old"     // VersKV being replaced by Prune
+)
+
+// Prune
+// Drop the history of the KV2 below the height; see pruneHeight.  Returns the
+// bytes freed.
+func (k *KV2) Prune(belowHeight uint64) (freed uint64, err error) {
+	if k.opts.readOnly {
+		return 0, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	if belowHeight = k.pruneHeight(belowHeight); belowHeight == 0 {
+		return 0, nil
+	}
+	k.pruned = max(k.pruned, belowHeight)
+	if err = k.Flush(); err != nil {
+		return 0, err
+	}
+	before, err := dirSize(k.Directory)
+	if err != nil {
+		return 0, err
+	}
+	written, err := k.pruneUndo(belowHeight)
+	if err != nil {
+		return 0, err
+	}
+	if err = k.pruneVersions(belowHeight); err != nil {
+		return 0, err
+	}
+	if err = k.pruneTombstones(written); err != nil {
+		return 0, err
+	}
+	if err = k.Flush(); err != nil {
+		return 0, err
+	}
+	after, err := dirSize(k.Directory)
+	if err != nil {
+		return 0, err
+	}
+	if after < before {
+		freed = uint64(before - after)
+	}
+	k.opts.Metrics.BytesPruned.Add(freed)
+	return freed, nil
+}
+
+// pruneHeight
+// Returns the height to prune below when asked for belowHeight: no higher
+// than the last committed height, nor than the oldest height the retention
+// keeps, if one is set
+func (k *KV2) pruneHeight(belowHeight uint64) uint64 {
+	if belowHeight > k.height {
+		belowHeight = k.height
+	}
+	if kept := k.keptHeight(); (k.opts.KeepHeights > 0 || k.opts.KeepAfter > 0) && belowHeight > kept {
+		belowHeight = kept
+	}
+	return belowHeight
+}
+
+// pruneUndo
+// Cut the undo log before the newest commit marker at or below the height.
+// Returns the keys written after the marker.
+func (k *KV2) pruneUndo(belowHeight uint64) (written map[[32]byte]struct{}, err error) {
+	written = make(map[[32]byte]struct{})
+	mark := int64(-1)
+	err = k.undoRecords(0, func(offset int64, key [32]byte, dbbKey *DBBKey, kind byte) (bool, error) {
+		if kind == undoCommit && dbbKey.Offset <= belowHeight {
+			mark = offset
+			return true, nil
+		}
+		if kind != undoCommit {
+			written[key] = struct{}{}
+		}
+		return false, nil
+	})
+	if err != nil || mark <= 0 {
+		return written, err
+	}
+
+	filename := filepath.Join(k.Directory, undoFilename)
+	tmpName := filepath.Join(k.Directory, undoTmpFilename)
+	tmp, err := os.Create(tmpName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(tmp, io.NewSectionReader(k.undo.File, mark, int64(k.undo.EOD)-mark)); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err = tmp.Sync(); err != nil { // The records kept have to be on disk before they replace the log
+		tmp.Close()
+		return nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err = k.undo.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmpName, filename); err != nil {
+		return nil, err
+	}
+	if k.undo, err = OpenBFile(filename, k.opts); err != nil {
+		return nil, err
+	}
+	return written, nil
+}
+
+// pruneVersions
+// Rewrite the VersKV, keeping in the list of each key only the versions read
+// at or above the height
+func (k *KV2) pruneVersions(belowHeight uint64) (err error) {
+	if k.VersKV == nil {
+		return nil
+	}
+	keyValues, keyList, err := k.VersKV.kFile.GetKeyList()
+	if err != nil {
+		return err
+	}
+	opts := k.VersKV.keepEncryption(layerOptions(k.opts, false))
+	opts.Overwrite = true // Replace anything left by a crash
+	tmpDir := filepath.Join(k.Directory, versTmpDirName)
+	pruned, err := NewKV(tmpDir, opts)
+	if err != nil {
+		return err
+	}
+	for _, key := range keyList {
+		dbbKey := keyValues[key]
+		if dbbKey.IsCleared() { // Every version was rolled back
+			continue
+		}
+		if err = k.rewriteChunks(key, belowHeight, pruned); err != nil {
+			pruned.Close()
+			return err
+		}
+	}
+	if err = pruned.sync(); err != nil {
+		pruned.Close()
+		return err
+	}
+	if err = pruned.Close(); err != nil {
+		return err
+	}
+
+	versDir := filepath.Join(k.Directory, VersDirName)
+	oldDir := filepath.Join(k.Directory, versOldDirName)
+	if err = k.VersKV.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(versDir, oldDir); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpDir, versDir); err != nil {
+		return err
+	}
+	if err = os.RemoveAll(oldDir); err != nil {
+		return err
+	}
+	k.VersKV, err = OpenKV(versDir, layerOptions(k.opts, false))
+	return err
+}
+
+// rewriteChunks
+// Put the versions of the key read at or above the height in the KV, in new
+// chunks
+func (k *KV2) rewriteChunks(key [32]byte, belowHeight uint64, to *KV) (err error) {
+	var chunks []versionList // Newest first
+	err = k.chunks(key, func(chunk versionChunk) (bool, error) {
+		chunks = append(chunks, chunk.list)
+		return chunk.list.at(belowHeight) >= 0, nil // The rest are below the height
+	})
+	if err != nil {
+		return err
+	}
+	var list versionList
+	for i := len(chunks) - 1; i >= 0; i-- {
+		list = append(list, chunks[i]...)
+	}
+	if i := list.at(belowHeight); i > 0 {
+		list = list[i*versionSize:]
+	}
+	var prev *DBBKey
+	for ; list.len() > chunkVersions; list = list[chunkVersions*versionSize:] {
+		chunk := versionChunk{prev: prev, list: list[:chunkVersions*versionSize]}
+		if prev, err = to.putValue(chunk.bytes()); err != nil {
+			return err
+		}
+	}
+	return to.Put(key, versionChunk{prev: prev, list: list}.bytes())
+}
+
+// recoverRewrite
+// Finish, or back out of, a rewrite of the KV in the named directory under
+// the directory, cut short by a crash.  The rewrite built the KV in tmpName,
+// then renamed the KV to oldName and tmpName to name.
+func recoverRewrite(directory, name, tmpName, oldName string) error {
+	kvDir := filepath.Join(directory, name)
+	oldDir := filepath.Join(directory, oldName)
+	if _, err := os.Stat(oldDir); err == nil {
+		if kvExists(kvDir) { // The new KV is in place
+			if err = os.RemoveAll(oldDir); err != nil {
+				return err
+			}
+		} else if err = os.Rename(oldDir, kvDir); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(directory, tmpName))
+}
+
+// pruneTombstones
+// Drop the tombstones in the DynaKV of keys not written since the height
+// pruned below, unless they hide a key in the PermKV.  Get finds neither a
+// deleted key nor a missing key.
+func (k *KV2) pruneTombstones(written map[[32]byte]struct{}) (err error) {
+	_, err = k.DynaKV.kFile.Purge(func(key [32]byte, dbbKey *DBBKey) bool {
+		if !dbbKey.IsDeleted() {
+			return false
+		}
+		if _, ok := written[key]; ok { // A rollback may still need it
+			return false
+		}
+		if _, err := k.permGet(key); err == nil || !errors.Is(err, ErrNotFound) {
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+// dirSize
+// Returns the size of all the files in and below the directory
+func dirSize(directory string) (size int64, err error) {
+	err = filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// Pruning
+// A KVShard.Prune running in the background
+type Pruning struct {
+	Below uint64        // Height the history is pruned below
+	freed atomic.Uint64 // Bytes freed so far
+	done  chan struct{} // Closed when the Prune finishes
+	err   error         // Why the Prune failed, if it did
+}
+
+// Freed
+// Returns the bytes freed so far; it can be called while the Prune runs
+func (p *Pruning) Freed() uint64 {
+	return p.freed.Load()
+}
+
+// Done
+// Returns a channel that is closed when the Prune finishes
+func (p *Pruning) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait
+// Wait for the Prune to finish.  Returns the bytes freed, and the error that
+// stopped it, if any.
+func (p *Pruning) Wait() (freed uint64, err error) {
+	p.wait()
+	return p.Freed(), p.err
+}
+
+// wait
+// Wait for the Prune, if any, to finish
+func (p *Pruning) wait() {
+	if p != nil {
+		<-p.done
+	}
+}
+
+// Prune
+// Drop the history of every shard below the height, in the background.  The
+// height is limited as KV2.Prune limits it.  Heights below it can no longer be
+// read with GetAt nor rolled back to.
+//
+// The shards are pruned one at a time, each locked only while it is pruned,
+// so the KVShard can be used meanwhile.  A shared PermKV is locked only while
+// each key is looked up in it.  RollbackTo, Checkpoint, Close and another
+// Prune wait for the Prune to finish.
+func (k *KVShard) Prune(belowHeight uint64) (pruning *Pruning, err error) {
+	if err = k.checkOpen(); err != nil {
+		return nil, err
+	}
+	if k.opts.readOnly {
+		return nil, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	k.pruneMutex.Lock()
+	defer k.pruneMutex.Unlock()
+	k.pruning.wait()
+
+	if belowHeight, err = k.recordPruned(belowHeight); err != nil {
+		return nil, err
+	}
+
+	pruning = &Pruning{Below: belowHeight, done: make(chan struct{})}
+	k.pruning = pruning
+	go func() {
+		defer close(pruning.done)
+		for _, kv2 := range k.Shards {
+			freed, err := k.pruneShard(kv2, belowHeight)
+			pruning.freed.Add(freed)
+			if err != nil {
+				pruning.err = err
+				return
+			}
+		}
+		k.opts.logf("pruned %s below height %d, freeing %d bytes", k.Directory, belowHeight, pruning.Freed())
+	}()
+	return pruning, nil
+}
+
+// recordPruned
+// Limit the height to prune below, and record it in the manifest before any
+// shard is pruned.  Holds segMutex, so no Commit or RollbackTo changes the
+// height or the manifest meanwhile.
+func (k *KVShard) recordPruned(belowHeight uint64) (uint64, error) {
+	k.segMutex.Lock()
+	defer k.segMutex.Unlock()
+
+	// Every shard has the height and the options of the KVShard
+	belowHeight = k.Shards[0].pruneHeight(belowHeight)
+	if belowHeight <= k.pruned {
+		return belowHeight, nil
+	}
+	manifest, err := ReadManifest(k.Directory)
+	if err != nil {
+		return 0, err
+	}
+	manifest.PrunedBelow = belowHeight
+	if err = manifest.Write(k.Directory, SyncAlways); err != nil {
+		return 0, err
+	}
+	k.pruned = belowHeight
+	return belowHeight, nil
+}
+
+// waitPrune
+// Wait for the last Prune started, if any, to finish
+func (k *KVShard) waitPrune() {
+	k.pruneMutex.Lock()
+	pruning := k.pruning
+	k.pruneMutex.Unlock()
+	pruning.wait()
+}
+
+// prunedBelow
+// Returns the height history has been dropped below
+func (k *KVShard) prunedBelow() uint64 {
+	k.pruneMutex.Lock()
+	defer k.pruneMutex.Unlock()
+	return k.pruned
+}
+
+// pruneShard
+// Prune one shard, holding its lock
+func (k *KVShard) pruneShard(kv2 *KV2, belowHeight uint64) (freed uint64, err error) {
+	k.lockShard(kv2)
+	defer k.unlockShard(kv2)
+	if err = kv2.Open(); err != nil {
+		return 0, err
+	}
+	return kv2.Prune(belowHeight)
+}
+
+// useRetention
+// Take the retention from the manifest, unless the options set one, which
+// then replaces the retention in the manifest
+func (k *KVShard) useRetention(manifest *Manifest) error {
+	opts := k.opts
+	if opts.KeepHeights == 0 && opts.KeepAfter == 0 {
+		opts.KeepHeights, opts.KeepAfter = manifest.KeepHeights, manifest.KeepAfter
+		return nil
+	}
+	if opts.readOnly || (opts.KeepHeights == manifest.KeepHeights && opts.KeepAfter == manifest.KeepAfter) {
+		return nil
+	}
+	manifest.KeepHeights, manifest.KeepAfter = opts.KeepHeights, opts.KeepAfter
+	return manifest.Write(k.Directory, SyncAlways)
+}
@@ -0,0 +1,176 @@
+package blockchainDB
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrune(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{Versioned: true, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BufferSize: 4096, MaxCachedBlocks: 1, BloomSize: .1,
+		Metrics: new(Metrics)}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+
+	fr := NewFastRandom([]byte{6})
+	accounts := make([][32]byte, 100)
+	for i := range accounts {
+		accounts[i] = fr.NextHash()
+	}
+	perm := accounts[0]
+	assert.NoError(t, kvs.PutPerm(perm, []byte("perm")), "put perm")
+
+	// history[h][i] is the value of account i at height h; "" if not found
+	history := make(map[uint64][]string)
+	state := make([]string, len(accounts))
+	state[0] = "perm"
+	for height := uint64(1); height <= 10; height++ {
+		for i := range accounts {
+			switch {
+			case i > 0 && (height == 1 || i%int(height+1) == 0):
+				state[i] = fmt.Sprintf("%d at %d", i, height)
+				assert.NoError(t, kvs.PutDyna(accounts[i], []byte(state[i])), "put")
+			case i%10 == int(height%10): // Account 0, in the PermKV, is hidden at height 10
+				assert.NoError(t, kvs.Delete(accounts[i]), "delete")
+				state[i] = ""
+			}
+		}
+		assert.NoError(t, kvs.Commit(height), "commit")
+		history[height] = append([]string(nil), state...)
+	}
+	history[11] = history[10] // The height after the last commit is the current state
+	check := func(kvs *KVShard, height uint64) {
+		for i, account := range accounts {
+			value, err := kvs.GetAt(account, height)
+			what := fmt.Sprintf("account %d at height %d", i, height)
+			if history[height][i] == "" {
+				assert.Error(t, err, what)
+			} else if assert.NoError(t, err, what) {
+				assert.Equal(t, history[height][i], string(value), what)
+			}
+		}
+	}
+	dynaEntry := func(kvs *KVShard, key [32]byte) *DBBKey {
+		dbbKey, err := kvs.Shards[kvs.Index(key)].dynaEntry(key)
+		assert.NoError(t, err, "dyna entry")
+		return dbbKey
+	}
+	assert.True(t, dynaEntry(kvs, accounts[2]).IsDeleted(), "account 2 was deleted at height 2")
+
+	// The shards can be used while they are pruned
+	pruning, err := kvs.Prune(8)
+	assert.NoError(t, err, "prune")
+	for i, account := range accounts {
+		_, err := kvs.Get(account)
+		assert.Equal(t, history[10][i] == "", err != nil, "get while pruning")
+	}
+	freed, err := pruning.Wait()
+	assert.NoError(t, err, "pruning")
+	assert.Greater(t, freed, uint64(0), "bytes freed")
+	assert.Equal(t, freed, opts.Metrics.BytesPruned.Load(), "bytes pruned")
+
+	for height := uint64(8); height <= 11; height++ {
+		check(kvs, height)
+	}
+	_, err = kvs.GetAt(accounts[2], 7)
+	assert.True(t, errors.Is(err, ErrPruned), "height 7 is pruned")
+	assert.True(t, errors.Is(kvs.RollbackTo(7), ErrPruned), "no rollback below the pruned height")
+	assert.True(t, dynaEntry(kvs, accounts[2]).IsCleared(), "the old tombstone is dropped")
+	assert.True(t, dynaEntry(kvs, accounts[9]).IsDeleted(), "a tombstone since the height is kept")
+	assert.True(t, dynaEntry(kvs, accounts[0]).IsDeleted(), "a tombstone hiding a PermKV key is kept")
+
+	pruning, err = kvs.Prune(100)
+	assert.NoError(t, err, "prune")
+	assert.Equal(t, uint64(10), pruning.Below, "no prune past the last commit")
+	_, err = pruning.Wait()
+	assert.NoError(t, err, "pruning")
+	assert.NoError(t, kvs.Close(), "close")
+
+	// The pruned height is in the manifest; a rollback to it still works
+	kvs, err = OpenKVShard(dir, opts)
+	assert.NoError(t, err, "open")
+	_, err = kvs.GetAt(accounts[2], 9)
+	assert.True(t, errors.Is(err, ErrPruned), "height 9 is pruned")
+	assert.NoError(t, kvs.Put(accounts[2], []byte("new")), "put")
+	assert.NoError(t, kvs.RollbackTo(10), "rollback")
+	check(kvs, 10)
+	assert.NoError(t, kvs.Close(), "close")
+}
+
+func TestPruneRetention(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{Versioned: true, KeepHeights: 3, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+	key := [32]byte{1}
+	for height := uint64(1); height <= 6; height++ {
+		assert.NoError(t, kvs.Put(key, []byte(fmt.Sprint(height))), "put")
+		assert.NoError(t, kvs.Commit(height), "commit")
+	}
+	assert.NoError(t, kvs.Close(), "close")
+
+	// The retention comes from the manifest when the options set none
+	kvs, err = OpenKVShard(dir, &Options{OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1})
+	assert.NoError(t, err, "open")
+	pruning, err := kvs.Prune(6)
+	assert.NoError(t, err, "prune")
+	assert.Equal(t, uint64(4), pruning.Below, "the last 3 heights are kept")
+	_, err = pruning.Wait()
+	assert.NoError(t, err, "pruning")
+	for height := uint64(4); height <= 6; height++ {
+		value, err := kvs.GetAt(key, height)
+		assert.NoError(t, err, "get at")
+		assert.Equal(t, fmt.Sprint(height), string(value))
+	}
+	assert.NoError(t, kvs.Close(), "close")
+
+	// Options that set a retention replace it
+	kvs, err = OpenKVShard(dir, &Options{KeepAfter: 2, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1})
+	assert.NoError(t, err, "open")
+	assert.NoError(t, kvs.Close(), "close")
+	manifest, err := ReadManifest(dir)
+	assert.NoError(t, err, "read manifest")
+	assert.Equal(t, uint64(0), manifest.KeepHeights)
+	assert.Equal(t, uint64(2), manifest.KeepAfter)
+	assert.Equal(t, uint64(4), manifest.PrunedBelow)
+}
+
+func TestPruneConcurrent(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	kvs, err := NewKVShard(dir, &Options{Versioned: true, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1})
+	assert.NoError(t, err, "create KVShard")
+	fr := NewFastRandom([]byte{7})
+	for height := uint64(1); height <= 20; height++ {
+		assert.NoError(t, kvs.Put(fr.NextHash(), fr.RandBuff(10, 100)), "put")
+		assert.NoError(t, kvs.Commit(height), "commit")
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 2; g++ {
+		wg.Add(1)
+		go func() { // Prunes started while others wait for them
+			defer wg.Done()
+			for height := uint64(1); height <= 10; height++ {
+				pruning, err := kvs.Prune(height)
+				if assert.NoError(t, err, "prune") {
+					_, err = pruning.Wait()
+					assert.NoError(t, err, "pruning")
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, kvs.RollbackTo(20), "rollback waits for the Prune")
+	}
+	wg.Wait()
+	assert.NoError(t, kvs.Close(), "close")
+}
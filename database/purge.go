@@ -0,0 +1,276 @@
+package blockchainDB
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Purging shadowed PermKV keys
+//
+// KV2.Put of a PermKV key with a new value writes the key to the DynaKV, and
+// the old value stays in the PermKV, hidden.  PurgePerm rewrites the PermKV
+// without the keys the DynaKV hides for good, which drops them from the
+// KFile, the HistoryFile and the values file.
+//
+// A DynaKV entry hides the PermKV key for good unless something can still
+// clear it: a record in the undo log that restores the DynaKV entry to
+// cleared, or a version of the key that is cleared, which GetAt reads from the
+// PermKV.  Such keys are kept until Prune drops what needs them.
+//
+// The PermKV is rebuilt in a tmp directory that replaces it, as Prune rewrites
+// the VersKV.  A pass over the keys alone decides first whether to rebuild:
+// only if a key is shadowed, a value is uncompressed that PermCompression
+// would compress, PermDedup is set and some values predate the index, or the
+// PermKV is sealed with a key that is no longer current (see crypt.go).  The
+// rebuilt PermKV also replaces one that it makes smaller, which recompresses
+// the values as PermCompression says.  A value shared by keys is copied once,
+// and dropped with the last of them; see dedup.go.
+// KVShard.Compress purges every shard, then demotes the stable DynaKV keys;
+// see demote.go.
+
+const permOldDirName = "perm_old" // PermKV being replaced by PurgePerm
+
+// PurgePerm
+// Remove the keys of the PermKV that the DynaKV hides for good.  Returns the
+// number of keys removed.  A shared PermKV is purged by KVShard.PurgePerm.
+func (k *KV2) PurgePerm() (purged int, err error) {
+	if k.opts.readOnly {
+		return 0, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	if k.sharedPerm {
+		return 0, fmt.Errorf("the PermKV of %s is shared; purge it with KVShard.PurgePerm", k.Directory)
+	}
+	if err = k.Flush(); err != nil {
+		return 0, err
+	}
+	restorable, err := k.restorable()
+	if err != nil {
+		return 0, err
+	}
+	k.PermKV, purged, err = rewritePerm(k.PermKV, k.opts, func(key [32]byte) (bool, error) {
+		return k.shadows(key, restorable)
+	})
+	if err != nil {
+		return 0, err
+	}
+	k.opts.Metrics.PermPurged.Add(uint64(purged))
+	return purged, nil
+}
+
+// restorable
+// Returns the keys whose DynaKV entry a rollback can restore to cleared
+func (k *KV2) restorable() (keys map[[32]byte]struct{}, err error) {
+	keys = make(map[[32]byte]struct{})
+	err = k.undoRecords(0, func(offset int64, key [32]byte, dbbKey *DBBKey, kind byte) (bool, error) {
+		if kind == undoDyna && dbbKey.IsCleared() {
+			keys[key] = struct{}{}
+		}
+		return false, nil
+	})
+	return keys, err
+}
+
+// shadows
+// Returns true if the DynaKV hides the PermKV value of the key for good; see
+// restorable for the keys a rollback can clear
+func (k *KV2) shadows(key [32]byte, restorable map[[32]byte]struct{}) (bool, error) {
+	if _, ok := restorable[key]; ok {
+		return false, nil
+	}
+	dbbKey, err := k.dynaEntry(key)
+	if err != nil || dbbKey.IsCleared() {
+		return false, err
+	}
+	return k.stableVersions(key)
+}
+
+// rewritePerm
+// Rebuild the PermKV without the keys shadowed returns true for, and replace
+// it.  Returns the new PermKV, open, and the number of keys dropped.
+func rewritePerm(perm *KV, opts *Options, shadowed func(key [32]byte) (bool, error)) (kv *KV, purged int, err error) {
+	if err = perm.Open(); err != nil {
+		return perm, 0, err
+	}
+	stale, err := perm.staleKeys()
+	if err != nil {
+		return perm, 0, err
+	}
+	permOpts := perm.keepEncryption(layerOptions(opts, true))
+	if !stale {
+		rebuild, err := permRebuild(perm, permOpts, shadowed)
+		if err != nil || !rebuild {
+			return perm, 0, err
+		}
+	}
+	directory := filepath.Dir(perm.Directory)
+	tmpOpts := *permOpts
+	tmpOpts.Overwrite = true // Replace anything left by a crash
+	tmpDir := filepath.Join(directory, permTmpDirName)
+	tmp, err := NewKV(tmpDir, &tmpOpts)
+	if err != nil {
+		return perm, 0, err
+	}
+	copies := make(map[uint64]*DBBKey) // The new entry of each value copied, by its old offset
+	err = perm.forEachKey(func(key [32]byte, dbbKey *DBBKey) error {
+		if shadow, err := shadowed(key); shadow || err != nil {
+			if shadow {
+				purged++
+			}
+			return err
+		}
+		if copied, ok := copies[dbbKey.Offset]; ok { // A value shared by keys is copied once
+			shared := *copied
+			return tmp.kFile.Put(key, &shared)
+		}
+		value, err := perm.getValue(dbbKey)
+		if err != nil {
+			return err
+		}
+		if err = tmp.Put(key, value); err != nil {
+			return err
+		}
+		copies[dbbKey.Offset], err = tmp.kFile.Get(key)
+		return err
+	})
+	if err == nil {
+		err = tmp.sync()
+	}
+	var tmpSize, permSize uint64
+	if err == nil {
+		tmpSize, err = tmp.vFile.Offset()
+	}
+	if err == nil {
+		permSize, err = perm.vFile.Offset()
+	}
+	if err != nil {
+		tmp.Close()
+		return perm, 0, err
+	}
+	if err = tmp.Close(); err != nil {
+		return perm, 0, err
+	}
+	if purged == 0 && tmpSize >= permSize && !stale { // Nothing dropped, compressed or re-encrypted; keep the PermKV as it is
+		return perm, 0, os.RemoveAll(tmpDir)
+	}
+
+	oldDir := filepath.Join(directory, permOldDirName)
+	if err = perm.Close(); err != nil {
+		return perm, 0, err
+	}
+	if err = os.Rename(perm.Directory, oldDir); err != nil {
+		return perm, 0, err
+	}
+	if err = os.Rename(tmpDir, perm.Directory); err != nil {
+		return perm, 0, err
+	}
+	if err = os.RemoveAll(oldDir); err != nil {
+		return perm, 0, err
+	}
+	if kv, err = OpenKV(perm.Directory, permOpts); err != nil {
+		return perm, 0, err
+	}
+	return kv, purged, nil
+}
+
+// permRebuild
+// Returns true if rebuilding the PermKV would drop a shadowed key, compress a
+// value, or merge copies of a value; reads the keys only
+func permRebuild(perm *KV, permOpts *Options, shadowed func(key [32]byte) (bool, error)) (rebuild bool, err error) {
+	offsets := make(map[uint64]struct{}) // The values the keys point to
+	err = perm.forEachKey(func(key [32]byte, dbbKey *DBBKey) error {
+		if rebuild {
+			return nil
+		}
+		length := dbbKey.ValueLength()
+		if permOpts.Compression != CompressNone && !dbbKey.IsCompressed() &&
+			length >= compressMin && length < compressMax {
+			rebuild = true
+			return nil
+		}
+		offsets[dbbKey.Offset] = struct{}{}
+		rebuild, err = shadowed(key)
+		return err
+	})
+	if err != nil || rebuild || perm.dedup == nil {
+		return rebuild, err
+	}
+	indexed, _, err := perm.dedup.GetKeyList()
+	if err != nil {
+		return false, err
+	}
+	return len(offsets) > len(indexed), nil // Values written before the index
+}
+
+// PurgePerm
+// Remove the keys of the PermKVs of the shards, or of the shared PermKV, that
+// the DynaKVs hide for good.  Returns the number of keys removed.
+func (k *KVShard) PurgePerm() (purged int, err error) {
+	if err = k.checkOpen(); err != nil {
+		return 0, err
+	}
+	if k.opts.readOnly {
+		return 0, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	k.waitPrune()
+	if k.Perm == nil {
+		for _, kv2 := range k.Shards {
+			n, err := k.purgeShard(kv2)
+			purged += n
+			if err != nil {
+				return purged, err
+			}
+		}
+		k.opts.logf("purged %d shadowed PermKV keys from %s", purged, k.Directory)
+		return purged, nil
+	}
+
+	// The shared PermKV: each key is checked against the shard it belongs to,
+	// and no shard is written until every shard uses the rebuilt PermKV
+	k.lockAll()
+	defer k.unlockAll()
+	restorable := make([]map[[32]byte]struct{}, len(k.Shards))
+	for i, kv2 := range k.Shards {
+		if restorable[i], err = shardRestorable(kv2); err != nil {
+			return 0, err
+		}
+	}
+	perm, purged, err := rewritePerm(k.Perm, k.opts, func(key [32]byte) (bool, error) {
+		i := k.Index(key)
+		return k.Shards[i].shadows(key, restorable[i])
+	})
+	k.Perm = perm
+	for _, kv2 := range k.Shards {
+		kv2.PermKV = perm
+	}
+	if err != nil {
+		return 0, err
+	}
+	k.opts.Metrics.PermPurged.Add(uint64(purged))
+	k.opts.logf("purged %d shadowed PermKV keys from %s", purged, k.Directory)
+	return purged, nil
+}
+
+// purgeShard
+// Purge the PermKV of one shard, holding its lock
+func (k *KVShard) purgeShard(kv2 *KV2) (purged int, err error) {
+	k.lockShard(kv2)
+	defer k.unlockShard(kv2)
+	if err = kv2.Open(); err != nil {
+		return 0, err
+	}
+	return kv2.PurgePerm()
+}
+
+// shardRestorable
+// Returns the keys of one shard a rollback can clear; the shard is left open.
+// The caller holds the lock of the shard.
+func shardRestorable(kv2 *KV2) (keys map[[32]byte]struct{}, err error) {
+	if err = kv2.Open(); err != nil {
+		return nil, err
+	}
+	if err = kv2.Flush(); err != nil {
+		return nil, err
+	}
+	return kv2.restorable()
+}
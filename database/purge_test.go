@@ -0,0 +1,126 @@
+package blockchainDB
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPurgePerm(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SharedPerm=%v", shared), func(t *testing.T) {
+			dir, rm := MakeDir()
+			defer rm()
+
+			opts := &Options{SharedPerm: shared, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+			kvs, err := NewKVShard(dir, opts)
+			assert.NoError(t, err, "create KVShard")
+
+			state := make(map[[32]byte]string)      // What Get returns for each key, "" if not found
+			rolledBack := make(map[[32]byte]string) // The values after the rollback to height 1
+			fr := NewFastRandom([]byte{9})
+			for i := 0; i < 300; i++ { // Enough to push keys to the HistoryFile
+				key := fr.NextHash()
+				state[key] = fmt.Sprintf("perm %d", i)
+				assert.NoError(t, kvs.PutPerm(key, []byte(state[key])), "put perm")
+				switch i % 10 {
+				case 1:
+					state[key] = fmt.Sprintf("changed %d", i)
+					assert.NoError(t, kvs.Put(key, []byte(state[key])), "put")
+				case 2:
+					assert.NoError(t, kvs.Delete(key), "delete")
+					state[key] = ""
+				}
+			}
+			assert.NoError(t, kvs.Commit(1), "commit")
+			for key, value := range state {
+				rolledBack[key] = value
+			}
+			pruning, err := kvs.Prune(1)
+			assert.NoError(t, err, "prune")
+			_, err = pruning.Wait()
+			assert.NoError(t, err, "pruning")
+
+			// Keys changed since the last commit are kept; a rollback may need them
+			for key, value := range rolledBack {
+				if value != "" && value[:4] == "perm" && key[0]%4 == 0 {
+					state[key] = "changed later"
+					assert.NoError(t, kvs.Put(key, []byte(state[key])), "put")
+				}
+			}
+
+			assert.NoError(t, kvs.Compress(), "compress")
+			assert.Equal(t, uint64(60), opts.Metrics.PermPurged.Load(), "the changed and deleted keys are purged")
+			checkKeys(t, kvs, state, "purged")
+			written := opts.Metrics.BytesWritten.Load()
+			purged, err := kvs.PurgePerm()
+			assert.NoError(t, err, "purge")
+			assert.Equal(t, 0, purged, "nothing left to purge")
+			assert.Equal(t, written, opts.Metrics.BytesWritten.Load(), "no value is copied when nothing is purged")
+
+			assert.NoError(t, kvs.RollbackTo(1), "rollback")
+			checkKeys(t, kvs, rolledBack, "rolled back")
+			assert.NoError(t, kvs.Close(), "close")
+
+			kvs, err = OpenKVShard(dir, opts)
+			assert.NoError(t, err, "open")
+			checkKeys(t, kvs, rolledBack, "reopen")
+			assert.NoError(t, kvs.Close(), "close")
+			for _, name := range []string{permTmpDirName, permOldDirName} {
+				assert.NoDirExists(t, filepath.Join(dir, name), "nothing left behind")
+				assert.NoDirExists(t, filepath.Join(dir, "Shard0000", name), "nothing left behind")
+			}
+		})
+	}
+}
+
+func TestPurgePermConcurrent(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SharedPerm=%v", shared), func(t *testing.T) {
+			dir, rm := MakeDir()
+			defer rm()
+
+			opts := &Options{SharedPerm: shared, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1}
+			kvs, err := NewKVShard(dir, opts)
+			assert.NoError(t, err, "create KVShard")
+			state := sharedPermKeys(t, kvs) // Some keys shadowed, for PurgePerm to drop
+
+			// Writers keep going while the PermKV is purged
+			written := make(map[[32]byte]string)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fr := NewFastRandom([]byte{10})
+				for i := 0; i < 500; i++ {
+					key := fr.NextHash()
+					written[key] = fmt.Sprintf("written %d", i)
+					if i%2 == 0 {
+						assert.NoError(t, kvs.PutPerm(key, []byte(written[key])), "put perm")
+					} else {
+						assert.NoError(t, kvs.PutDyna(key, []byte(written[key])), "put dyna")
+					}
+					_, err := kvs.Get(key)
+					assert.NoError(t, err, "get")
+				}
+			}()
+			done := make(chan struct{})
+			go func() { wg.Wait(); close(done) }()
+			for purging := true; purging; {
+				_, err := kvs.PurgePerm()
+				assert.NoError(t, err, "purge")
+				select {
+				case <-done:
+					purging = false
+				default:
+				}
+			}
+			checkKeys(t, kvs, state, "purged")
+			checkKeys(t, kvs, written, "written alongside")
+			assert.NoError(t, kvs.Close(), "close")
+		})
+	}
+}
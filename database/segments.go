@@ -0,0 +1,583 @@
+package blockchainDB
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Major block segments
+//
+// PermKV writes can be tagged with the major block they belong to.  Besides
+// going to the PermKV, the key and value are appended to the open segment of
+// the major block, a file in the segments directory of the KVShard.  Sealing
+// the segment turns it into an immutable file holding every key written in
+// the major block, sorted, with its value, and a SHA-256 digest of the file.
+// A node that is partially synced can fetch the sealed segments it lacks from
+// a peer, verify them, and import them, rather than replaying the blocks.
+//
+// A sealed segment is laid out as:
+//
+//	header  "BCDBSEG1", the major block, and the number of keys
+//	index   a DBBKey per key, sorted by key; offsets are from the first value
+//	values  the values, in the order of the index
+//	digest  SHA-256 of everything before it
+//
+// The open segments, and the files of the segments, are guarded by segMutex,
+// which is taken before the lock of any shard; the functions here that do not
+// take it are called with it held.
+//
+// Records in an open segment carry the height they were written at, so
+// RollbackTo can drop the records of the heights it rolls back.  A sealed
+// segment cannot be changed, so the manifest records the height of its last
+// write, and RollbackTo fails with ErrSealed below it; seal a major block once
+// it is final.
+//
+// The values are in both the PermKV and the open segment.  The segment cannot
+// read them from the PermKV when it is sealed: PurgePerm may have dropped a
+// key since, once a DynaKV write shadowed it, and the sealed segment has to
+// hold the value the major block wrote.
+//
+// Segments are made to be shared, so they are plain files.  An encrypted
+// KVShard keeps none: PutPermIn and ImportSegment fail with ErrEncrypted,
+// rather than leave its values on disk in the clear.
+
+const (
+	SegmentsDirName     = "segments"   // Directory of the segments in a KVShard
+	segmentMagic        = "BCDBSEG1"   // First bytes of a sealed segment
+	segmentHeaderSize   = 24           // Magic, major block, and number of keys
+	segmentRecordHeader = 48           // Height, key, and length of a record in an open segment
+	sealedExt           = ".seg"       // Extension of a sealed segment
+	openExt             = ".open"      // Extension of an open segment
+	segmentTmpExt       = ".tmp"       // Extension of a segment being sealed
+	importTmpName       = "import.tmp" // Copy of a segment being imported
+)
+
+// SegmentInfo
+// Describes a sealed segment
+type SegmentInfo struct {
+	MajorBlock uint64   // Major block the segment holds the PermKV writes of
+	Keys       uint64   // Number of keys in the segment
+	Size       int64    // Size of the segment file in bytes
+	Digest     [32]byte // SHA-256 of the segment file, up to the digest
+}
+
+// segmentFile
+// Returns the name of the file of a major block's segment with the given extension
+func (k *KVShard) segmentFile(majorBlock uint64, ext string) string {
+	return filepath.Join(k.Directory, SegmentsDirName, fmt.Sprintf("%020d%s", majorBlock, ext))
+}
+
+// checkSegments
+// Returns ErrEncrypted if the KVShard is encrypted, and cannot keep segments
+func (k *KVShard) checkSegments() error {
+	if k.Shards[0].DynaKV.crypt != nil {
+		return fmt.Errorf("%w: %s keeps no segments", ErrEncrypted, k.Directory)
+	}
+	return nil
+}
+
+// PutPermIn
+// Put the key/value in the PermKV, as a write of the given major block, and
+// add it to the open segment of the major block.  Fails with ErrSealed if
+// the segment has been sealed, and ErrEncrypted if the KVShard is encrypted.
+func (k *KVShard) PutPermIn(majorBlock uint64, key [32]byte, value []byte) (err error) {
+	if err = k.checkOpen(); err != nil {
+		return err
+	}
+	if k.opts.readOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	if err = k.checkSegments(); err != nil {
+		return err
+	}
+	k.segMutex.Lock()
+	defer k.segMutex.Unlock()
+	segment, err := k.openSegment(majorBlock)
+	if err != nil {
+		return err
+	}
+	if err = k.PutPerm(key, value); err != nil {
+		return err
+	}
+	record := make([]byte, segmentRecordHeader, segmentRecordHeader+len(value))
+	binary.BigEndian.PutUint64(record, k.height+1) // Writes after a Commit are at the next height
+	copy(record[8:], key[:])
+	binary.BigEndian.PutUint64(record[40:], uint64(len(value)))
+	_, err = segment.Write(append(record, value...))
+	return err
+}
+
+// openSegment
+// Returns the open segment of the major block, creating it if need be
+func (k *KVShard) openSegment(majorBlock uint64) (segment *BFile, err error) {
+	if segment = k.segments[majorBlock]; segment != nil {
+		return segment, nil
+	}
+	if _, err = os.Stat(k.segmentFile(majorBlock, sealedExt)); err == nil {
+		return nil, fmt.Errorf("%w: major block %d", ErrSealed, majorBlock)
+	}
+	if err = os.MkdirAll(filepath.Join(k.Directory, SegmentsDirName), os.ModePerm); err != nil {
+		return nil, err
+	}
+	filename := k.segmentFile(majorBlock, openExt)
+	if _, err = os.Stat(filename); err == nil {
+		segment, err = OpenBFile(filename, k.opts)
+	} else {
+		segment, err = NewBFile(filename, k.opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if k.segments == nil {
+		k.segments = make(map[uint64]*BFile)
+	}
+	k.segments[majorBlock] = segment
+	return segment, nil
+}
+
+// openSegments
+// Returns the major blocks with an open segment on disk
+func (k *KVShard) openSegments() (majorBlocks []uint64, err error) {
+	entries, err := os.ReadDir(filepath.Join(k.Directory, SegmentsDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), openExt)
+		if !ok {
+			continue
+		}
+		majorBlock, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue // Not a segment
+		}
+		majorBlocks = append(majorBlocks, majorBlock)
+	}
+	return majorBlocks, err
+}
+
+// segmentRecords
+// Call fn for each record in an open segment, oldest first, until fn returns
+// an error.  A partial record at the end, left by a crash, is ignored.
+func segmentRecords(segment *BFile, fn func(offset int64, height uint64, key [32]byte, length uint64) error) (err error) {
+	if err = segment.Flush(); err != nil {
+		return err
+	}
+	var header [segmentRecordHeader]byte
+	end := int64(segment.EOD)
+	for offset := int64(0); offset+segmentRecordHeader <= end; {
+		if _, err = segment.File.ReadAt(header[:], offset); err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint64(header[40:])
+		next := offset + segmentRecordHeader + int64(length)
+		if next > end {
+			break
+		}
+		if err = fn(offset, binary.BigEndian.Uint64(header[:]), [32]byte(header[8:40]), length); err != nil {
+			return err
+		}
+		offset = next
+	}
+	return nil
+}
+
+// rollbackSegments
+// Drop the records written after the height from every open segment
+func (k *KVShard) rollbackSegments(height uint64) error {
+	majorBlocks, err := k.openSegments()
+	if err != nil {
+		return err
+	}
+	for _, majorBlock := range majorBlocks {
+		segment, err := k.openSegment(majorBlock)
+		if err != nil {
+			return err
+		}
+		cut := int64(-1)
+		err = segmentRecords(segment, func(offset int64, recordHeight uint64, key [32]byte, length uint64) error {
+			if recordHeight > height && cut < 0 {
+				cut = offset
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if cut >= 0 {
+			if err = segment.File.Truncate(cut); err != nil {
+				return err
+			}
+			segment.EOD = uint64(cut)
+		}
+	}
+	return nil
+}
+
+// recordSealed
+// Record in the manifest the height of the last write in the segment of the
+// major block, before the segment is sealed
+func (k *KVShard) recordSealed(majorBlock, height uint64) error {
+	manifest, err := ReadManifest(k.Directory)
+	if err != nil {
+		return err
+	}
+	if manifest.Sealed == nil {
+		manifest.Sealed = make(map[uint64]uint64)
+	}
+	manifest.Sealed[majorBlock] = height
+	return manifest.Write(k.Directory, SyncAlways)
+}
+
+// checkSealed
+// Fails with ErrSealed if a sealed segment holds writes above the height.  A
+// height recorded for a segment a crash kept from being sealed is ignored.
+func (k *KVShard) checkSealed(height uint64) error {
+	manifest, err := ReadManifest(k.Directory)
+	if err != nil {
+		return err
+	}
+	for majorBlock, last := range manifest.Sealed {
+		if last <= height {
+			continue
+		}
+		if _, err = os.Stat(k.segmentFile(majorBlock, sealedExt)); err == nil {
+			return fmt.Errorf("%w: major block %d holds writes above height %d", ErrSealed, majorBlock, height)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncSegments
+// Write the open segments to disk, and sync them
+func (k *KVShard) syncSegments() error {
+	for _, segment := range k.segments {
+		if err := segment.Flush(); err != nil {
+			return err
+		}
+		if err := segment.File.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeSegments
+// Close the open segments
+func (k *KVShard) closeSegments() error {
+	for majorBlock, segment := range k.segments {
+		if err := segment.Close(); err != nil {
+			return err
+		}
+		delete(k.segments, majorBlock)
+	}
+	return nil
+}
+
+// SealSegment
+// Seal the segment of the major block, which then takes no more writes.  The
+// sealed segment holds each key written in the major block once.  Writes not
+// yet committed are sealed too.
+func (k *KVShard) SealSegment(majorBlock uint64) (info *SegmentInfo, err error) {
+	if err = k.checkOpen(); err != nil {
+		return nil, err
+	}
+	if k.opts.readOnly {
+		return nil, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	k.segMutex.Lock()
+	defer k.segMutex.Unlock()
+	segment, err := k.openSegment(majorBlock)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[[32]byte]bool)
+	var index []DBBKeyFull // Offsets of the values in the open segment
+	var last uint64        // Height of the last write
+	err = segmentRecords(segment, func(offset int64, height uint64, key [32]byte, length uint64) error {
+		last = max(last, height)
+		if !seen[key] { // PermKV values are immutable, so any later record has the same value
+			seen[key] = true
+			index = append(index, DBBKeyFull{key, DBBKey{uint64(offset) + segmentRecordHeader, length}})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(index, func(i, j int) bool { return bytes.Compare(index[i].Key[:], index[j].Key[:]) < 0 })
+
+	tmpName := k.segmentFile(majorBlock, segmentTmpExt)
+	if info, err = writeSegment(tmpName, majorBlock, index, segment.File); err != nil {
+		os.Remove(tmpName)
+		return nil, err
+	}
+	if err = k.recordSealed(majorBlock, last); err != nil {
+		os.Remove(tmpName)
+		return nil, err
+	}
+	if err = os.Rename(tmpName, k.segmentFile(majorBlock, sealedExt)); err != nil {
+		return nil, err
+	}
+	if err = segment.Close(); err != nil {
+		return nil, err
+	}
+	delete(k.segments, majorBlock)
+	if err = os.Remove(k.segmentFile(majorBlock, openExt)); err != nil {
+		return nil, err
+	}
+	k.opts.logf("sealed the segment of major block %d with %d keys", majorBlock, info.Keys)
+	return info, nil
+}
+
+// writeSegment
+// Write a sealed segment of the keys in the index, reading their values from
+// src, and sync it to disk
+func writeSegment(filename string, majorBlock uint64, index []DBBKeyFull, src io.ReaderAt) (info *SegmentInfo, err error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	digest := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(file, digest))
+	var header [segmentHeaderSize]byte
+	copy(header[:], segmentMagic)
+	binary.BigEndian.PutUint64(header[8:], majorBlock)
+	binary.BigEndian.PutUint64(header[16:], uint64(len(index)))
+	if _, err = w.Write(header[:]); err != nil {
+		return nil, err
+	}
+	var offset uint64
+	for _, entry := range index {
+		if _, err = w.Write((&DBBKey{Offset: offset, Length: entry.Length}).Bytes(entry.Key)); err != nil {
+			return nil, err
+		}
+		offset += entry.Length
+	}
+	for _, entry := range index {
+		if _, err = io.Copy(w, io.NewSectionReader(src, int64(entry.Offset), int64(entry.Length))); err != nil {
+			return nil, err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return nil, err
+	}
+	info = &SegmentInfo{MajorBlock: majorBlock, Keys: uint64(len(index))}
+	copy(info.Digest[:], digest.Sum(nil))
+	if _, err = file.Write(info.Digest[:]); err != nil {
+		return nil, err
+	}
+	if err = file.Sync(); err != nil { // A sealed segment is never rewritten, so it goes to disk now
+		return nil, err
+	}
+	info.Size = segmentHeaderSize + int64(len(index))*DBKeyFullSize + int64(offset) + sha256.Size
+	return info, file.Close()
+}
+
+// readSegmentInfo
+// Read the header and the digest of a sealed segment, without verifying it
+func readSegmentInfo(file *os.File) (info *SegmentInfo, err error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var header [segmentHeaderSize]byte
+	if stat.Size() < segmentHeaderSize+sha256.Size {
+		return nil, fmt.Errorf("%w: %s is too short to be a segment", ErrCorrupt, file.Name())
+	}
+	if _, err = file.ReadAt(header[:], 0); err != nil {
+		return nil, err
+	}
+	if string(header[:8]) != segmentMagic {
+		return nil, fmt.Errorf("%w: %s is not a segment", ErrCorrupt, file.Name())
+	}
+	info = &SegmentInfo{
+		MajorBlock: binary.BigEndian.Uint64(header[8:]),
+		Keys:       binary.BigEndian.Uint64(header[16:]),
+		Size:       stat.Size(),
+	}
+	if _, err = file.ReadAt(info.Digest[:], stat.Size()-sha256.Size); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Segments
+// Returns the sealed segments of the KVShard, by major block
+func (k *KVShard) Segments() (segments []SegmentInfo, err error) {
+	entries, err := os.ReadDir(filepath.Join(k.Directory, SegmentsDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	for _, entry := range entries { // Names sort by major block
+		if !strings.HasSuffix(entry.Name(), sealedExt) {
+			continue
+		}
+		file, err := os.Open(filepath.Join(k.Directory, SegmentsDirName, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		info, err := readSegmentInfo(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, *info)
+	}
+	return segments, err
+}
+
+// ExportSegment
+// Copy the sealed segment of the major block to the given file, which must
+// not exist
+func (k *KVShard) ExportSegment(majorBlock uint64, filename string) error {
+	return copyFile(k.segmentFile(majorBlock, sealedExt), filename, -1, k.opts.Sync)
+}
+
+// VerifySegment
+// Check that the file is a whole, well formed segment that matches its
+// digest.  Returns what the segment holds; compare the digest with the one
+// the peer it came from lists for the major block.
+func VerifySegment(filename string) (info *SegmentInfo, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if info, err = readSegmentInfo(file); err != nil {
+		return nil, err
+	}
+	bad := func(why string) error { return fmt.Errorf("%w: bad segment %s: %s", ErrCorrupt, filename, why) }
+
+	values := info.Size - segmentHeaderSize - sha256.Size // Bytes of the index and the values
+	if info.Keys > uint64(values)/DBKeyFullSize {
+		return nil, bad("index is past the end")
+	}
+	index := make([]byte, info.Keys*DBKeyFullSize)
+	if _, err = file.ReadAt(index, segmentHeaderSize); err != nil {
+		return nil, err
+	}
+	var offset uint64
+	var last [32]byte
+	for i := 0; i < len(index); i += DBKeyFullSize {
+		key, dbbKey, err := GetDBBKey(index[i:])
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && bytes.Compare(key[:], last[:]) <= 0 {
+			return nil, bad("keys are not sorted")
+		}
+		if dbbKey.Offset != offset {
+			return nil, bad("values are not contiguous")
+		}
+		if dbbKey.Length > uint64(values)-uint64(len(index))-offset { // Checked first, so offset never wraps
+			return nil, bad("a value is past the end")
+		}
+		offset += dbbKey.Length
+		last = key
+	}
+	if int64(len(index))+int64(offset) != values {
+		return nil, bad("values do not fill the segment")
+	}
+
+	digest := sha256.New()
+	if _, err = io.Copy(digest, io.NewSectionReader(file, 0, info.Size-sha256.Size)); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(digest.Sum(nil), info.Digest[:]) {
+		return nil, bad("digest does not match")
+	}
+	return info, nil
+}
+
+// ImportSegment
+// Verify a segment received from a peer, put its keys in the PermKV, and keep
+// it as the sealed segment of its major block.  Importing a segment already
+// sealed here does nothing; a different segment for the same major block
+// fails with ErrSealed.  An encrypted KVShard fails with ErrEncrypted.
+func (k *KVShard) ImportSegment(filename string) (info *SegmentInfo, err error) {
+	if err = k.checkOpen(); err != nil {
+		return nil, err
+	}
+	if k.opts.readOnly {
+		return nil, fmt.Errorf("%w: %s", ErrReadOnly, k.Directory)
+	}
+	if err = k.checkSegments(); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Join(k.Directory, SegmentsDirName), os.ModePerm); err != nil {
+		return nil, err
+	}
+	k.segMutex.Lock()
+	defer k.segMutex.Unlock()
+
+	// Work from a copy, so the file verified is the file read and kept
+	tmpName := filepath.Join(k.Directory, SegmentsDirName, importTmpName)
+	os.Remove(tmpName) // Left by a crash
+	if err = copyFile(filename, tmpName, -1, SyncAlways); err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpName) // Gone once renamed
+	if info, err = VerifySegment(tmpName); err != nil {
+		return nil, err
+	}
+	sealed := k.segmentFile(info.MajorBlock, sealedExt)
+	if file, err := os.Open(sealed); err == nil {
+		have, err := readSegmentInfo(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		if have.Digest != info.Digest {
+			return nil, fmt.Errorf("%w: major block %d has a different segment", ErrSealed, info.MajorBlock)
+		}
+		return have, nil
+	}
+	if _, err = os.Stat(k.segmentFile(info.MajorBlock, openExt)); err == nil {
+		return nil, fmt.Errorf("major block %d has an open segment", info.MajorBlock)
+	}
+
+	file, err := os.Open(tmpName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	index := make([]byte, info.Keys*DBKeyFullSize)
+	if _, err = file.ReadAt(index, segmentHeaderSize); err != nil {
+		return nil, err
+	}
+	start := segmentHeaderSize + int64(len(index)) // Where the values begin
+	for i := 0; i < len(index); i += DBKeyFullSize {
+		key, dbbKey, err := GetDBBKey(index[i:])
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, dbbKey.Length)
+		if _, err = file.ReadAt(value, start+int64(dbbKey.Offset)); err != nil {
+			return nil, err
+		}
+		if err = k.PutPerm(key, value); err != nil {
+			return nil, err
+		}
+	}
+	if err = k.recordSealed(info.MajorBlock, k.height+1); err != nil { // The keys were put after the last Commit
+		return nil, err
+	}
+	if err = os.Rename(tmpName, sealed); err != nil {
+		return nil, err
+	}
+	k.opts.logf("imported the segment of major block %d with %d keys", info.MajorBlock, info.Keys)
+	return info, nil
+}
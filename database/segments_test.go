@@ -0,0 +1,241 @@
+package blockchainDB
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegments(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1}
+	kvs, err := NewKVShard(filepath.Join(dir, "source"), opts)
+	assert.NoError(t, err, "create KVShard")
+
+	fr := NewFastRandom([]byte{8})
+	blocks := make(map[uint64]map[[32]byte]string) // The keys of each major block
+	put := func(majorBlock uint64, n int) {
+		if blocks[majorBlock] == nil {
+			blocks[majorBlock] = make(map[[32]byte]string)
+		}
+		for i := 0; i < n; i++ {
+			key := fr.NextHash()
+			value := fmt.Sprintf("%x in %d", key[:4], majorBlock)
+			assert.NoError(t, kvs.PutPermIn(majorBlock, key, []byte(value)), "put perm in")
+			blocks[majorBlock][key] = value
+		}
+	}
+	put(1, 50)
+	assert.NoError(t, kvs.Commit(1), "commit")
+	put(2, 20)
+	assert.NoError(t, kvs.Commit(2), "commit")
+	for key, value := range blocks[1] {
+		assert.NoError(t, kvs.PutPermIn(1, key, []byte(value)), "a key written again is in the segment once")
+		break
+	}
+
+	// Writes rolled back are dropped from the open segment
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, kvs.PutPermIn(2, fr.NextHash(), []byte("rolled back")), "put perm in")
+	}
+	assert.NoError(t, kvs.RollbackTo(2), "rollback")
+	assert.NoError(t, kvs.Close(), "close")
+
+	kvs, err = OpenKVShard(filepath.Join(dir, "source"), opts)
+	assert.NoError(t, err, "open")
+	for majorBlock := uint64(1); majorBlock <= 2; majorBlock++ {
+		info, err := kvs.SealSegment(majorBlock)
+		assert.NoError(t, err, "seal")
+		assert.Equal(t, uint64(len(blocks[majorBlock])), info.Keys, "keys in the segment")
+	}
+	err = kvs.PutPermIn(1, fr.NextHash(), []byte("late"))
+	assert.True(t, errors.Is(err, ErrSealed), "a sealed segment takes no writes")
+	segments, err := kvs.Segments()
+	assert.NoError(t, err, "segments")
+	assert.Equal(t, 2, len(segments), "segments")
+	assert.Equal(t, uint64(1), segments[0].MajorBlock)
+	assert.Equal(t, uint64(2), segments[1].MajorBlock)
+
+	// A peer verifies and imports the segments it lacks
+	exported := filepath.Join(dir, "segment1")
+	assert.NoError(t, kvs.ExportSegment(1, exported), "export")
+	info, err := VerifySegment(exported)
+	assert.NoError(t, err, "verify")
+	assert.Equal(t, segments[0], *info, "the export is the segment")
+	assert.NoError(t, kvs.Close(), "close")
+
+	peer, err := NewKVShard(filepath.Join(dir, "peer"), opts)
+	assert.NoError(t, err, "create KVShard")
+	_, err = peer.ImportSegment(exported)
+	assert.NoError(t, err, "import")
+	for key, value := range blocks[1] {
+		got, err := peer.GetPerm(key)
+		assert.NoError(t, err, "get perm")
+		assert.Equal(t, value, string(got))
+	}
+	_, err = peer.ImportSegment(exported)
+	assert.NoError(t, err, "importing a segment again does nothing")
+	peerSegments, err := peer.Segments()
+	assert.NoError(t, err, "segments")
+	assert.Equal(t, segments[:1], peerSegments, "the peer has the same segment")
+
+	// A damaged segment fails to verify, and is not imported
+	data, err := os.ReadFile(exported)
+	assert.NoError(t, err, "read")
+	data[len(data)/2] ^= 1
+	damaged := filepath.Join(dir, "damaged")
+	assert.NoError(t, os.WriteFile(damaged, data, 0644), "write")
+	_, err = VerifySegment(damaged)
+	assert.Error(t, err, "a damaged segment fails to verify")
+	_, err = peer.ImportSegment(damaged)
+	assert.Error(t, err, "a damaged segment is not imported")
+	assert.NoError(t, peer.Close(), "close")
+}
+
+func TestSegmentLengths(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	// Two values of 1<<63 bytes: their offsets add up to a segment of no values
+	var data []byte
+	data = append(data, segmentMagic...)
+	data = binary.BigEndian.AppendUint64(data, 1)
+	data = binary.BigEndian.AppendUint64(data, 2)
+	data = append(data, (&DBBKey{Offset: 0, Length: 1 << 63}).Bytes([32]byte{1})...)
+	data = append(data, (&DBBKey{Offset: 1 << 63, Length: 1 << 63}).Bytes([32]byte{2})...)
+	digest := sha256.Sum256(data)
+	data = append(data, digest[:]...)
+	crafted := filepath.Join(dir, "crafted")
+	assert.NoError(t, os.WriteFile(crafted, data, 0644), "write")
+
+	_, err := VerifySegment(crafted)
+	assert.ErrorIs(t, err, ErrCorrupt, "a value past the end")
+
+	kvs, err := NewKVShard(filepath.Join(dir, "kvs"), &Options{ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1})
+	assert.NoError(t, err, "create KVShard")
+	_, err = kvs.ImportSegment(crafted)
+	assert.ErrorIs(t, err, ErrCorrupt, "not imported")
+	assert.NoError(t, kvs.Close(), "close")
+}
+
+func TestSegmentsEncrypted(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1}
+	plain, err := NewKVShard(filepath.Join(dir, "plain"), opts)
+	assert.NoError(t, err, "create KVShard")
+	assert.NoError(t, plain.PutPermIn(1, [32]byte{1}, []byte("secret value")), "put perm in")
+	_, err = plain.SealSegment(1)
+	assert.NoError(t, err, "seal")
+	exported := filepath.Join(dir, "segment1")
+	assert.NoError(t, plain.ExportSegment(1, exported), "export")
+	assert.NoError(t, plain.Close(), "close")
+
+	ring, err := NewKeyRing(1, testKey(1))
+	assert.NoError(t, err, "key ring")
+	encrypted := filepath.Join(dir, "encrypted")
+	opts.Keys = ring
+	kvs, err := NewKVShard(encrypted, opts)
+	assert.NoError(t, err, "create KVShard")
+	err = kvs.PutPermIn(1, [32]byte{2}, []byte("secret value"))
+	assert.ErrorIs(t, err, ErrEncrypted, "put perm in")
+	_, err = kvs.ImportSegment(exported)
+	assert.ErrorIs(t, err, ErrEncrypted, "import")
+	assert.NoError(t, kvs.PutPerm([32]byte{3}, []byte("secret value")), "put perm")
+	assert.NoError(t, kvs.Close(), "close")
+
+	assert.NoDirExists(t, filepath.Join(encrypted, SegmentsDirName), "no segments")
+	err = filepath.Walk(encrypted, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			raw, err := os.ReadFile(path)
+			assert.NoError(t, err, "read %s", path)
+			assert.False(t, bytes.Contains(raw, []byte("secret value")), "%s holds no values in the clear", path)
+		}
+		return err
+	})
+	assert.NoError(t, err, "walk")
+}
+
+func TestSegmentsConcurrent(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	kvs, err := NewKVShard(dir, &Options{ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1})
+	assert.NoError(t, err, "create KVShard")
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) { // Two writers to each major block
+			defer wg.Done()
+			fr := NewFastRandom([]byte{byte(g)})
+			for i := 0; i < 100; i++ {
+				key := fr.NextHash()
+				assert.NoError(t, kvs.PutPermIn(uint64(g%2+1), key, key[:]), "put perm in")
+			}
+		}(g)
+	}
+	for height := uint64(1); height <= 5; height++ {
+		assert.NoError(t, kvs.Commit(height), "commit")
+	}
+	wg.Wait()
+	for majorBlock := uint64(1); majorBlock <= 2; majorBlock++ {
+		info, err := kvs.SealSegment(majorBlock)
+		assert.NoError(t, err, "seal")
+		assert.Equal(t, uint64(200), info.Keys, "the keys of both writers")
+	}
+	assert.NoError(t, kvs.Close(), "close")
+}
+
+func TestSegmentsRollback(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1}
+	kvs, err := NewKVShard(filepath.Join(dir, "source"), opts)
+	assert.NoError(t, err, "create KVShard")
+	assert.NoError(t, kvs.PutPermIn(1, [32]byte{1}, []byte("one")), "put perm in")
+	assert.NoError(t, kvs.Commit(1), "commit")
+	assert.NoError(t, kvs.PutPermIn(1, [32]byte{2}, []byte("two")), "put perm in")
+	assert.NoError(t, kvs.Commit(2), "commit")
+	assert.NoError(t, kvs.Commit(3), "commit")
+	_, err = kvs.SealSegment(1)
+	assert.NoError(t, err, "seal")
+
+	err = kvs.RollbackTo(1)
+	assert.ErrorIs(t, err, ErrSealed, "the segment holds a write of height 2")
+	value, err := kvs.Get([32]byte{2})
+	assert.NoError(t, err, "the failed rollback changed nothing")
+	assert.Equal(t, []byte("two"), value, "value")
+	assert.Equal(t, uint64(3), kvs.LastCommittedHeight(), "height")
+	assert.NoError(t, kvs.RollbackTo(2), "rolling back to the last write of the segment")
+	assert.NoError(t, kvs.Close(), "close")
+
+	kvs, err = OpenKVShard(filepath.Join(dir, "source"), opts)
+	assert.NoError(t, err, "reopen")
+	assert.ErrorIs(t, kvs.RollbackTo(1), ErrSealed, "the seal height is kept in the manifest")
+	exported := filepath.Join(dir, "exported.seg")
+	assert.NoError(t, kvs.ExportSegment(1, exported), "export")
+	assert.NoError(t, kvs.Close(), "close")
+
+	peer, err := NewKVShard(filepath.Join(dir, "peer"), opts)
+	assert.NoError(t, err, "create peer")
+	assert.NoError(t, peer.Commit(1), "commit")
+	_, err = peer.ImportSegment(exported)
+	assert.NoError(t, err, "import")
+	assert.NoError(t, peer.Commit(2), "commit")
+	assert.NoError(t, peer.Commit(3), "commit")
+	assert.ErrorIs(t, peer.RollbackTo(1), ErrSealed, "the import was written at height 2")
+	assert.NoError(t, peer.RollbackTo(2), "rollback")
+	assert.NoError(t, peer.Close(), "close")
+}
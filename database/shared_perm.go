@@ -0,0 +1,109 @@
+package blockchainDB
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Shared PermKV
+//
+// PermKV values are immutable and gain nothing from sharding, while each
+// PermKV carries its own Bloom filter and HistoryFile.  A KVShard created with
+// SharedPerm keeps one PermKV in its root directory, passed to every shard
+// with NewKV2WithPerm; only the DynaKVs are sharded.  A key always goes to
+// the same shard, so the undo log and the tombstones of the shard work as
+// they do with a PermKV of its own.
+//
+// MigrateSharedPerm moves the PermKVs of an existing KVShard into one.
+
+const permTmpDirName = "perm_tmp" // PermKV under construction by MigrateSharedPerm or PurgePerm
+
+// MigrateSharedPerm
+// Move the keys in the PermKVs of every shard of the KVShard in the directory
+// into one PermKV shared by every shard.  The KVShard must not be open.
+//
+// The keys are copied into a new PermKV, which replaces the PermKVs of the
+// shards once the manifest records it.  An interrupted migration leaves the
+// KVShard as it was, or with old PermKVs still to delete; running it again
+// finishes it.
+func MigrateSharedPerm(directory string, opts *Options) (err error) {
+	opts = opts.withDefaults()
+	shardCnt, exists := kvShardCount(directory)
+	if !exists {
+		return fmt.Errorf("%w: no KVShard in %s", os.ErrNotExist, directory)
+	}
+	lock, err := lockDirectory(directory)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	manifest, err := ReadManifest(directory)
+	if os.IsNotExist(err) { // Written before the manifest existed
+		manifest, err = &Manifest{Version: ManifestVersion, ShardCnt: shardCnt}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	shardPerm := func(i int) string {
+		return filepath.Join(directory, fmt.Sprintf("Shard%04d", i), PermDirName)
+	}
+	if !manifest.SharedPerm {
+		permOpts := layerOptions(opts, true)
+		permOpts.Overwrite = true // Replace anything left by an interrupted migration
+		tmpDir := filepath.Join(directory, permTmpDirName)
+		perm, err := NewKV(tmpDir, permOpts)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < shardCnt; i++ {
+			if err = copyPerm(perm, shardPerm(i), opts); err != nil {
+				perm.Close()
+				return err
+			}
+		}
+		if err = perm.sync(); err != nil {
+			perm.Close()
+			return err
+		}
+		if err = perm.Close(); err != nil {
+			return err
+		}
+		permDir := filepath.Join(directory, PermDirName)
+		if err = os.RemoveAll(permDir); err != nil {
+			return err
+		}
+		if err = os.Rename(tmpDir, permDir); err != nil {
+			return err
+		}
+		manifest.SharedPerm = true
+		if err = manifest.Write(directory, SyncAlways); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < shardCnt; i++ {
+		if err = os.RemoveAll(shardPerm(i)); err != nil {
+			return err
+		}
+	}
+	opts.logf("moved the PermKVs of the shards of %s into one", directory)
+	return nil
+}
+
+// copyPerm
+// Put every key of the PermKV in the directory, if there is one, into perm
+func copyPerm(perm *KV, directory string, opts *Options) (err error) {
+	if !kvExists(directory) {
+		return nil
+	}
+	src, err := OpenKV(directory, layerOptions(opts, true))
+	if err != nil {
+		return err
+	}
+	if err = src.ForEach(perm.Put); err != nil {
+		src.Close()
+		return err
+	}
+	return src.Close()
+}
@@ -0,0 +1,167 @@
+package blockchainDB
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sharedPermKeys
+// Put perm keys, changed keys and a deleted perm key into the KVShard, and
+// commit them at height 1.  Returns what Get should return for each key, ""
+// if not found.
+func sharedPermKeys(t *testing.T, kvs *KVShard) map[[32]byte]string {
+	state := make(map[[32]byte]string)
+	fr := NewFastRandom([]byte{7})
+	for i := 0; i < 300; i++ { // Enough to push keys to the HistoryFile
+		key := fr.NextHash()
+		state[key] = fmt.Sprintf("perm %d", i)
+		assert.NoError(t, kvs.PutPerm(key, []byte(state[key])), "put perm")
+		switch i % 10 {
+		case 1:
+			state[key] = fmt.Sprintf("changed %d", i)
+			assert.NoError(t, kvs.Put(key, []byte(state[key])), "put")
+		case 2:
+			assert.NoError(t, kvs.Delete(key), "delete")
+			state[key] = ""
+		}
+	}
+	assert.NoError(t, kvs.Commit(1), "commit")
+	return state
+}
+
+func checkKeys(t *testing.T, kvs *KVShard, state map[[32]byte]string, what string) {
+	for key, want := range state {
+		value, err := kvs.Get(key)
+		if want == "" {
+			assert.Error(t, err, what)
+		} else if assert.NoError(t, err, what) {
+			assert.Equal(t, want, string(value), what)
+		}
+	}
+}
+
+func TestSharedPerm(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{SharedPerm: true, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+	assert.NotNil(t, kvs.Perm, "shared PermKV")
+	state := sharedPermKeys(t, kvs)
+	checkKeys(t, kvs, state, "shared perm")
+	for _, kv2 := range kvs.Shards {
+		assert.Same(t, kvs.Perm, kv2.PermKV, "every shard uses the shared PermKV")
+		assert.NoDirExists(t, filepath.Join(kv2.Directory, PermDirName), "no PermKV in a shard")
+	}
+
+	// A perm key added after a height is hidden by a rollback
+	key := [32]byte{1}
+	assert.NoError(t, kvs.PutPerm(key, []byte("perm")), "put perm")
+	assert.NoError(t, kvs.RollbackTo(1), "rollback")
+	_, err = kvs.Get(key)
+	assert.Error(t, err, "the perm key is hidden")
+	assert.NoError(t, kvs.Close(), "close")
+
+	// SharedPerm is kept in the manifest
+	kvs, err = OpenKVShard(dir, &Options{OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1})
+	assert.NoError(t, err, "open")
+	assert.NotNil(t, kvs.Perm, "shared PermKV")
+	checkKeys(t, kvs, state, "reopen")
+	assert.NoError(t, kvs.Close(), "close")
+
+	reader, err := OpenKVShardReadOnly(dir, opts)
+	assert.NoError(t, err, "open read-only")
+	checkKeys(t, reader, state, "read-only")
+	assert.NoError(t, reader.Close(), "close")
+}
+
+func TestMigrateSharedPerm(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+	state := sharedPermKeys(t, kvs)
+	assert.NoError(t, kvs.Close(), "close")
+
+	assert.NoError(t, MigrateSharedPerm(dir, opts), "migrate")
+	assert.NoError(t, MigrateSharedPerm(dir, opts), "a second migration does nothing")
+	for i := 0; i < 4; i++ {
+		assert.NoDirExists(t, filepath.Join(dir, fmt.Sprintf("Shard%04d", i), PermDirName), "old PermKVs are removed")
+	}
+
+	kvs, err = OpenKVShard(dir, opts)
+	assert.NoError(t, err, "open")
+	assert.NotNil(t, kvs.Perm, "shared PermKV")
+	checkKeys(t, kvs, state, "migrated")
+	assert.Equal(t, uint64(1), kvs.LastCommittedHeight())
+	assert.NoError(t, kvs.Close(), "close")
+
+	_, err = os.Stat(filepath.Join(dir, permTmpDirName))
+	assert.True(t, os.IsNotExist(err), "no tmp PermKV left behind")
+}
+
+func TestSharedPermConcurrent(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{SharedPerm: true, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+
+	// DynaKV reads and writes do not wait for the shared PermKV
+	kvs.permMutex.Lock()
+	done := make(chan error)
+	go func() {
+		key := [32]byte{1}
+		if err := kvs.PutDyna(key, []byte("dyna")); err != nil {
+			done <- err
+			return
+		}
+		_, err := kvs.GetDyna(key)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		assert.NoError(t, err, "dyna")
+	case <-time.After(10 * time.Second):
+		t.Fatal("a DynaKV write waited for the shared PermKV")
+	}
+	kvs.permMutex.Unlock()
+
+	// Writers to every shard share the PermKV
+	states := make([]map[[32]byte]string, 4)
+	var wg sync.WaitGroup
+	for g := range states {
+		states[g] = make(map[[32]byte]string)
+		wg.Add(1)
+		go func(state map[[32]byte]string, fr *FastRandom) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fr.NextHash()
+				state[key] = fmt.Sprintf("perm %d", i)
+				assert.NoError(t, kvs.PutPerm(key, []byte(state[key])), "put perm")
+				if i%3 == 0 {
+					state[key] = fmt.Sprintf("changed %d", i)
+					assert.NoError(t, kvs.Put(key, []byte(state[key])), "put")
+				}
+				value, err := kvs.Get(key)
+				assert.NoError(t, err, "get")
+				assert.Equal(t, state[key], string(value), "get")
+			}
+		}(states[g], NewFastRandom([]byte{byte(g + 10)}))
+	}
+	wg.Wait()
+	for _, state := range states {
+		checkKeys(t, kvs, state, "written concurrently")
+	}
+	assert.NoError(t, kvs.Close(), "close")
+}
@@ -0,0 +1,239 @@
+package blockchainDB
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Txn
+// A read-write transaction on a KVView.  A Txn reads the state of the KVView
+// when it began, plus its own writes.  Writes are buffered in the Txn until
+// Commit applies all of them at once, or Discard drops them.
+//
+// Transactions are optimistic.  Nothing is locked while a Txn runs, and Commit
+// fails with ErrConflict if any key the Txn read was written after the Txn
+// began.  Writes are applied to the KVView like any other write, so they reach
+// the KVShard once no view is active.
+//
+// Any number of transactions can run at once, but each Txn is meant to be used
+// by one goroutine.
+type Txn struct {
+	KVView *KVView               // The KVView the transaction writes to
+	view   *View                 // Snapshot of the KVView when the transaction began
+	reads  map[[32]byte]struct{} // Keys read from the snapshot
+	writes map[[32]byte]version  // Buffered writes; only value and deleted are used
+	done   bool                  // Set by Commit and Discard
+
+	undo       []undoEntry     // How to undo the writes made since the oldest savepoint
+	savepoints []savepointMark // The savepoints in place, oldest first
+	nextID     Savepoint       // ID of the next savepoint; IDs are never reused
+}
+
+// Savepoint
+// A marker in a transaction that its writes can be rolled back to.  Savepoints
+// nest: rolling back to or releasing a savepoint does the same to every
+// savepoint taken after it.
+type Savepoint int
+
+// savepointMark
+// A savepoint in place, and the length of the undo log when it was taken
+type savepointMark struct {
+	id   Savepoint
+	mark int
+}
+
+// undoEntry
+// The buffered write of a key before a write replaced it
+type undoEntry struct {
+	key     [32]byte
+	prev    version // The buffered write that was replaced
+	existed bool    // False if the key had no buffered write
+}
+
+// Begin
+// Start a transaction on the current state of the KVView
+func (s *KVView) Begin() *Txn {
+	s.mutex.Lock()
+	defer s.unlock()
+	txn := new(Txn)
+	txn.KVView = s
+	txn.view = s.newView()
+	txn.reads = make(map[[32]byte]struct{})
+	txn.writes = make(map[[32]byte]version)
+	return txn
+}
+
+// Get
+// Get the value of a key; the transaction's own writes first, then the state
+// of the KVView when the transaction began
+func (t *Txn) Get(key [32]byte) (value []byte, err error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+	if w, ok := t.writes[key]; ok {
+		if w.deleted {
+			return nil, errDeleted
+		}
+		return w.value, nil
+	}
+	t.reads[key] = struct{}{}
+	return t.view.Get(key)
+}
+
+// Put
+// Buffer a write of the key value pair
+func (t *Txn) Put(key [32]byte, value []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.write(key, version{value: append([]byte(nil), value...)}) // The caller is free to reuse value
+	return nil
+}
+
+// Delete
+// Buffer a delete of the key
+func (t *Txn) Delete(key [32]byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.write(key, version{deleted: true})
+	return nil
+}
+
+// write
+// Buffer a write.  If there is a savepoint, the write it replaces goes in the
+// undo log, so the cost of a savepoint is only paid by the writes after it.
+func (t *Txn) write(key [32]byte, w version) {
+	if len(t.savepoints) > 0 {
+		prev, existed := t.writes[key]
+		t.undo = append(t.undo, undoEntry{key: key, prev: prev, existed: existed})
+	}
+	t.writes[key] = w
+}
+
+// Savepoint
+// Mark the current state of the transaction's writes
+func (t *Txn) Savepoint() (Savepoint, error) {
+	if t.done {
+		return 0, ErrTxnDone
+	}
+	sp := t.nextID
+	t.nextID++
+	t.savepoints = append(t.savepoints, savepointMark{id: sp, mark: len(t.undo)})
+	return sp, nil
+}
+
+// findSavepoint
+// Returns the position of the savepoint in place with the ID; ErrSavepoint if
+// it was released or rolled back past
+func (t *Txn) findSavepoint(sp Savepoint) (int, error) {
+	i := sort.Search(len(t.savepoints), func(i int) bool { return t.savepoints[i].id >= sp })
+	if i == len(t.savepoints) || t.savepoints[i].id != sp {
+		return 0, fmt.Errorf("%w: %d", ErrSavepoint, sp)
+	}
+	return i, nil
+}
+
+// RollbackTo
+// Undo the writes made since the savepoint.  The savepoint stays in place, and
+// any savepoints taken after it are released.  Keys read since the savepoint
+// are still checked for conflicts by Commit.
+func (t *Txn) RollbackTo(sp Savepoint) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	i, err := t.findSavepoint(sp)
+	if err != nil {
+		return err
+	}
+	mark := t.savepoints[i].mark
+	for i := len(t.undo) - 1; i >= mark; i-- { // Undo the newest writes first
+		u := t.undo[i]
+		if u.existed {
+			t.writes[u.key] = u.prev
+		} else {
+			delete(t.writes, u.key)
+		}
+	}
+	clear(t.undo[mark:])
+	t.undo = t.undo[:mark]
+	t.savepoints = t.savepoints[:i+1]
+	return nil
+}
+
+// Release
+// Drop the savepoint, and any savepoints taken after it, keeping the writes
+func (t *Txn) Release(sp Savepoint) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	i, err := t.findSavepoint(sp)
+	if err != nil {
+		return err
+	}
+	t.savepoints = t.savepoints[:i]
+	if len(t.savepoints) == 0 { // Nothing is left to roll back to
+		clear(t.undo)
+		t.undo = t.undo[:0]
+	}
+	return nil
+}
+
+// Commit
+// Apply all the writes of the transaction to the KVView at once.  Fails with
+// ErrConflict, and applies nothing, if a key the transaction read was written
+// after the transaction began.
+func (t *Txn) Commit() (err error) {
+	if t.done {
+		return ErrTxnDone
+	}
+	s := t.KVView
+	s.mutex.Lock()
+	defer s.unlock()
+	defer func() {
+		if err2 := t.end(); err == nil {
+			err = err2
+		}
+	}()
+
+	// While the transaction's view is active, every write is kept as a version,
+	// so any write after the transaction began is newer than the view.
+	if s.viewIndex(t.view) < 0 {
+		return fmt.Errorf("%w: view %d", ErrViewExpired, t.view.ID)
+	}
+	for key := range t.reads {
+		if versions := s.Versions[key]; len(versions) > 0 && versions[len(versions)-1].seq > t.view.Seq {
+			return fmt.Errorf("%w: key %x", ErrConflict, key)
+		}
+	}
+	for key, w := range t.writes {
+		if err = s.write(key, w.value, w.deleted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discard
+// Drop all the writes of the transaction
+func (t *Txn) Discard() {
+	if t.done {
+		return
+	}
+	s := t.KVView
+	s.mutex.Lock()
+	defer s.unlock()
+	t.end()
+}
+
+// end
+// Finish the transaction and close its view; the caller holds the mutex
+func (t *Txn) end() error {
+	t.done = true
+	t.writes = nil
+	t.reads = nil
+	t.undo = nil
+	t.savepoints = nil
+	t.view.Closed = true
+	return t.KVView.expireViews() // Flushes the versions to the DB if this was the last view
+}
@@ -0,0 +1,181 @@
+package blockchainDB
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxn(t *testing.T) {
+	Directory, rm := MakeDir()
+	defer rm()
+	sdbv, err := NewKVView(Directory, &Options{ViewTimeout: time.Hour, ShardCnt: 8, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1})
+	assert.NoError(t, err, "failed to create KVView")
+
+	fr := NewFastRandom([]byte{1})
+	a, b, c := fr.NextHash(), fr.NextHash(), fr.NextHash()
+	assert.NoError(t, sdbv.Put(a, []byte("a")), "put")
+	assert.NoError(t, sdbv.Put(b, []byte("b")), "put")
+
+	// A transaction reads its own writes; nobody else does until it commits
+	txn := sdbv.Begin()
+	assert.NoError(t, txn.Put(a, []byte("a2")), "put")
+	assert.NoError(t, txn.Delete(b), "delete")
+	assert.NoError(t, txn.Put(c, []byte("c")), "put")
+	value, err := txn.Get(a)
+	assert.NoError(t, err, "get")
+	assert.Equal(t, []byte("a2"), value, "txn should read its own writes")
+	_, err = txn.Get(b)
+	assert.Error(t, err, "txn should see its own delete")
+	value, err = sdbv.Get(a)
+	assert.NoError(t, err, "get")
+	assert.Equal(t, []byte("a"), value, "writes are invisible before commit")
+
+	view := sdbv.NewView()
+	assert.NoError(t, txn.Commit(), "commit")
+	assert.True(t, errors.Is(txn.Put(a, nil), ErrTxnDone), "a committed txn is done")
+	value, err = sdbv.Get(a)
+	assert.NoError(t, err, "get")
+	assert.Equal(t, []byte("a2"), value, "writes are visible after commit")
+	_, err = sdbv.Get(b)
+	assert.Error(t, err, "delete is visible after commit")
+	value, err = view.Get(b)
+	assert.NoError(t, err, "get")
+	assert.Equal(t, []byte("b"), value, "a view from before the commit does not see it")
+	view.Closed = true
+
+	// Discard drops the writes
+	txn = sdbv.Begin()
+	assert.NoError(t, txn.Put(a, []byte("a3")), "put")
+	txn.Discard()
+	value, err = sdbv.Get(a)
+	assert.NoError(t, err, "get")
+	assert.Equal(t, []byte("a2"), value, "discarded writes are dropped")
+
+	// A transaction that read a key written after it began cannot commit
+	t1, t2 := sdbv.Begin(), sdbv.Begin()
+	_, err = t1.Get(a)
+	assert.NoError(t, err, "get")
+	assert.NoError(t, t1.Put(c, []byte("c1")), "put")
+	assert.NoError(t, t2.Put(a, []byte("a4")), "put")
+	assert.NoError(t, t2.Commit(), "commit")
+	assert.True(t, errors.Is(t1.Commit(), ErrConflict), "t1 read a, which t2 changed")
+	value, err = sdbv.Get(c)
+	assert.NoError(t, err, "get")
+	assert.Equal(t, []byte("c"), value, "a failed commit applies nothing")
+
+	// Writes outside of a transaction conflict too, but keys not read do not
+	t1, t2 = sdbv.Begin(), sdbv.Begin()
+	_, err = t1.Get(a)
+	assert.NoError(t, err, "get")
+	_, err = t2.Get(c)
+	assert.NoError(t, err, "get")
+	assert.NoError(t, sdbv.Put(c, []byte("c2")), "put")
+	assert.NoError(t, t1.Put(c, []byte("c3")), "put")
+	assert.NoError(t, t1.Commit(), "t1 did not read c")
+	assert.True(t, errors.Is(t2.Commit(), ErrConflict), "t2 read c")
+
+	// With no transaction open, everything has reached the DB
+	assert.Len(t, sdbv.Versions, 0, "versions should be flushed to the DB")
+	value, err = sdbv.DB.Get(c)
+	assert.NoError(t, err, "get")
+	assert.Equal(t, []byte("c3"), value)
+	_, err = sdbv.DB.Get(b)
+	assert.Error(t, err, "b was deleted")
+	assert.NoError(t, sdbv.Close(), "close")
+}
+
+func TestTxnSavepoint(t *testing.T) {
+	Directory, rm := MakeDir()
+	defer rm()
+	sdbv, err := NewKVView(Directory, &Options{ViewTimeout: time.Hour, ShardCnt: 8, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1})
+	assert.NoError(t, err, "failed to create KVView")
+
+	fr := NewFastRandom([]byte{2})
+	a, b, c := fr.NextHash(), fr.NextHash(), fr.NextHash()
+	assert.NoError(t, sdbv.Put(a, []byte("a")), "put")
+
+	get := func(txn *Txn, key [32]byte) string {
+		value, err := txn.Get(key)
+		if err != nil {
+			return ""
+		}
+		return string(value)
+	}
+
+	txn := sdbv.Begin()
+	assert.NoError(t, txn.Put(b, []byte("b1")), "put")
+	sp1, err := txn.Savepoint()
+	assert.NoError(t, err, "savepoint")
+	assert.NoError(t, txn.Put(a, []byte("a1")), "put")
+	assert.NoError(t, txn.Put(b, []byte("b2")), "put")
+	sp2, err := txn.Savepoint()
+	assert.NoError(t, err, "savepoint")
+	assert.NoError(t, txn.Delete(a), "delete")
+	assert.NoError(t, txn.Put(c, []byte("c1")), "put")
+
+	// Rolling back to sp2 undoes only the writes after it
+	assert.NoError(t, txn.RollbackTo(sp2), "rollback")
+	assert.Equal(t, "a1", get(txn, a))
+	assert.Equal(t, "b2", get(txn, b))
+	assert.Equal(t, "", get(txn, c))
+
+	// sp2 is still usable after a rollback to it
+	assert.NoError(t, txn.Put(c, []byte("c2")), "put")
+	assert.NoError(t, txn.RollbackTo(sp2), "rollback again")
+	assert.Equal(t, "", get(txn, c))
+
+	// Rolling back to sp1 releases sp2
+	assert.NoError(t, txn.RollbackTo(sp1), "rollback")
+	assert.Equal(t, "a", get(txn, a), "a falls back to the KVView")
+	assert.Equal(t, "b1", get(txn, b), "writes before sp1 are kept")
+	assert.True(t, errors.Is(txn.RollbackTo(sp2), ErrSavepoint), "sp2 was rolled back past")
+
+	// Release keeps the writes, but the savepoint is gone
+	assert.NoError(t, txn.Put(c, []byte("c3")), "put")
+	assert.NoError(t, txn.Release(sp1), "release")
+	assert.True(t, errors.Is(txn.RollbackTo(sp1), ErrSavepoint), "sp1 was released")
+	assert.Len(t, txn.undo, 0, "no savepoint is left, so no undo log is needed")
+
+	// A savepoint rolled back past or released stays gone; its ID is not reused
+	spA, err := txn.Savepoint()
+	assert.NoError(t, err, "savepoint")
+	spB, err := txn.Savepoint()
+	assert.NoError(t, err, "savepoint")
+	assert.NoError(t, txn.Put(c, []byte("c4")), "put")
+	assert.NoError(t, txn.RollbackTo(spA), "rollback")
+	spC, err := txn.Savepoint()
+	assert.NoError(t, err, "savepoint")
+	assert.True(t, errors.Is(txn.RollbackTo(spB), ErrSavepoint), "B was rolled back past, though C took its place")
+	assert.NoError(t, txn.Release(spA), "release")
+	spD, err := txn.Savepoint()
+	assert.NoError(t, err, "savepoint")
+	assert.True(t, errors.Is(txn.RollbackTo(spC), ErrSavepoint), "C was released, though D took its place")
+	assert.True(t, errors.Is(txn.Release(spA), ErrSavepoint), "A was released")
+	assert.NoError(t, txn.Release(spD), "release")
+	assert.Equal(t, "c3", get(txn, c), "the write after A was rolled back")
+
+	// Many savepoints, each rolling back one failed write
+	for i := 0; i < 500; i++ {
+		sp, err := txn.Savepoint()
+		assert.NoError(t, err, "savepoint")
+		assert.NoError(t, txn.Put(a, []byte{byte(i >> 8), byte(i)}), "put")
+		if i%2 == 1 {
+			assert.NoError(t, txn.RollbackTo(sp), "rollback")
+		}
+	}
+	assert.Equal(t, string([]byte{498 >> 8, 498 & 0xff}), get(txn, a))
+
+	assert.NoError(t, txn.Commit(), "commit")
+	_, err = txn.Savepoint()
+	assert.True(t, errors.Is(err, ErrTxnDone), "a committed txn is done")
+	value, err := sdbv.Get(b)
+	assert.NoError(t, err, "get")
+	assert.Equal(t, []byte("b1"), value)
+	value, err = sdbv.Get(c)
+	assert.NoError(t, err, "get")
+	assert.Equal(t, []byte("c3"), value)
+	assert.NoError(t, sdbv.Close(), "close")
+}
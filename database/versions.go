@@ -0,0 +1,290 @@
+package blockchainDB
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Height-versioned DynaKV
+//
+// A versioned KV2 keeps a third KV, VersKV, holding the versions of every key
+// written to it, sorted by height.  A version is the height of a write and the
+// DynaKV entry it left (a DBBKey, a tombstone, or cleared for a key added to
+// the PermKV), so the values themselves stay in the values files, which are
+// only appended to.  Each height has one version per key, the last write in
+// it; writes made after the Commit of height h are at height h+1.
+//
+// The versions of a key are kept in chunks of up to chunkVersions versions.
+// The value of the key in VersKV is the newest chunk, which starts with the
+// entry of the chunk before it in the values file of the VersKV.  A write
+// rewrites the newest chunk only, or starts a new one when it is full, so each
+// write adds a bounded number of bytes to the values file however long the
+// key's history is.
+//
+// GetAt reads the chunks of the key, newest first, until one has a version at
+// or below the height, finds the newest such version with a binary search,
+// and reads the value.  Old versions are dropped as the key is written, as
+// set by KeepHeights and KeepAfter; Prune drops them from the lists of keys
+// no longer written.
+
+const (
+	VersDirName     = "vers" // Directory of the VersKV in a versioned KV2
+	versionSize     = 24     // Height, then the Offset and Length of the DBBKey
+	chunkHeaderSize = 16     // Offset and Length of the DBBKey of the chunk before
+	chunkVersions   = 16     // Versions in a chunk before a new one is started
+)
+
+// versionList
+// The versions of one key, as stored in the VersKV
+type versionList []byte
+
+// height
+// Returns the height of version i
+func (l versionList) height(i int) uint64 {
+	return binary.BigEndian.Uint64(l[i*versionSize:])
+}
+
+// dbbKey
+// Returns the DynaKV entry of version i
+func (l versionList) dbbKey(i int) *DBBKey {
+	return &DBBKey{
+		Offset: binary.BigEndian.Uint64(l[i*versionSize+8:]),
+		Length: binary.BigEndian.Uint64(l[i*versionSize+16:]),
+	}
+}
+
+// len
+// Returns the number of versions in the list
+func (l versionList) len() int {
+	return len(l) / versionSize
+}
+
+// at
+// Returns the index of the newest version at or below the height, or -1
+func (l versionList) at(height uint64) int {
+	return sort.Search(l.len(), func(i int) bool { return l.height(i) > height }) - 1
+}
+
+// set
+// Set the version at the height to the DynaKV entry, replacing any version
+// at the same height
+func (l versionList) set(height uint64, dbbKey *DBBKey) versionList {
+	if n := l.len(); n == 0 || l.height(n-1) != height {
+		l = append(l, make([]byte, versionSize)...)
+	}
+	v := l[len(l)-versionSize:]
+	binary.BigEndian.PutUint64(v, height)
+	binary.BigEndian.PutUint64(v[8:], dbbKey.Offset)
+	binary.BigEndian.PutUint64(v[16:], dbbKey.Length)
+	return l
+}
+
+// versionChunk
+// A chunk of the versions of one key, as stored in the VersKV
+type versionChunk struct {
+	prev *DBBKey     // Entry of the chunk before, in the values file of the VersKV; nil if none
+	list versionList // The versions in the chunk, by height
+}
+
+// parseChunk
+// Returns the chunk stored as the value
+func parseChunk(value []byte) (chunk versionChunk, err error) {
+	if len(value) < chunkHeaderSize || (len(value)-chunkHeaderSize)%versionSize != 0 {
+		return chunk, fmt.Errorf("%w: a chunk of versions of %d bytes", ErrCorrupt, len(value))
+	}
+	prev := &DBBKey{Offset: binary.BigEndian.Uint64(value), Length: binary.BigEndian.Uint64(value[8:])}
+	if !prev.IsCleared() {
+		chunk.prev = prev
+	}
+	chunk.list = value[chunkHeaderSize:]
+	return chunk, nil
+}
+
+// bytes
+// Returns the chunk as it is stored in the VersKV
+func (c versionChunk) bytes() []byte {
+	prev := c.prev
+	if prev == nil {
+		prev = &DBBKey{Offset: clearedOffset}
+	}
+	value := make([]byte, chunkHeaderSize, chunkHeaderSize+len(c.list))
+	binary.BigEndian.PutUint64(value, prev.Offset)
+	binary.BigEndian.PutUint64(value[8:], prev.Length)
+	return append(value, c.list...)
+}
+
+// oldestHeight
+// Returns the oldest height GetAt can read: the oldest height the retention
+// keeps, unless Prune has dropped more
+func (k *KV2) oldestHeight() uint64 {
+	return max(k.keptHeight(), k.pruned)
+}
+
+// keptHeight
+// Returns the oldest height the retention keeps.  KeepHeights keeps the last
+// N committed heights, and KeepAfter keeps every height after H; if both are
+// set, a height is kept if either keeps it.
+func (k *KV2) keptHeight() uint64 {
+	keepHeights, keepAfter := k.opts.KeepHeights, k.opts.KeepAfter
+	oldest := uint64(0)
+	if keepHeights > 0 && k.height > keepHeights {
+		oldest = k.height - keepHeights + 1
+	}
+	if keepAfter > 0 && (keepHeights == 0 || keepAfter+1 < oldest) {
+		oldest = keepAfter + 1
+	}
+	return oldest
+}
+
+// putVersion
+// Record the DynaKV entry the key has now as its version at the current
+// height, and drop the versions of the key no longer needed
+func (k *KV2) putVersion(key [32]byte) error {
+	if k.VersKV == nil {
+		return nil
+	}
+	dbbKey, err := k.dynaEntry(key)
+	if err != nil {
+		return err
+	}
+	head, err := k.headChunk(key)
+	if err != nil {
+		return err
+	}
+	height := k.height + 1
+	if n := head.list.len(); n >= chunkVersions && head.list.height(n-1) != height {
+		entry, err := k.VersKV.kFile.Get(key) // The full chunk stays where it is
+		if err != nil {
+			return err
+		}
+		head = versionChunk{prev: entry}
+	}
+	head.list = head.list.set(height, dbbKey)
+	if i := head.list.at(k.oldestHeight()); i >= 0 { // Keep the version the oldest height reads, and nothing older
+		head.prev = nil
+		head.list = head.list[i*versionSize:]
+	}
+	return k.VersKV.Put(key, head.bytes())
+}
+
+// headChunk
+// Returns the newest chunk of the versions of the key; an empty chunk if it
+// has none
+func (k *KV2) headChunk(key [32]byte) (chunk versionChunk, err error) {
+	value, err := k.VersKV.Get(key)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			return chunk, err
+		}
+		return chunk, nil
+	}
+	return parseChunk(value)
+}
+
+// chunkAt
+// Returns the chunk of versions the entry points to in the VersKV
+func (k *KV2) chunkAt(entry *DBBKey) (chunk versionChunk, err error) {
+	value, err := k.VersKV.getValue(entry)
+	if err != nil {
+		return chunk, err
+	}
+	return parseChunk(value)
+}
+
+// chunks
+// Call fn with each chunk of the versions of the key, newest first, until fn
+// returns true or an error
+func (k *KV2) chunks(key [32]byte, fn func(chunk versionChunk) (stop bool, err error)) error {
+	chunk, err := k.headChunk(key)
+	for ; err == nil; chunk, err = k.chunkAt(chunk.prev) {
+		if stop, err := fn(chunk); stop || err != nil || chunk.prev == nil {
+			return err
+		}
+	}
+	return err
+}
+
+// trimVersions
+// Drop the versions of the key above the height, after a rollback
+func (k *KV2) trimVersions(key [32]byte, height uint64) error {
+	var entry *DBBKey // Entry of the chunk in the VersKV, if it is not the newest
+	var put func() error
+	err := k.chunks(key, func(chunk versionChunk) (bool, error) {
+		n := chunk.list.at(height) + 1
+		switch {
+		case n == chunk.list.len() && entry != nil: // An older chunk is the newest now
+			put = func() error { return k.VersKV.kFile.Put(key, entry) }
+		case n == chunk.list.len(): // Nothing above the height
+		case n > 0:
+			chunk.list = chunk.list[:n*versionSize]
+			put = func() error { return k.VersKV.Put(key, chunk.bytes()) }
+		case chunk.prev == nil: // Every version is above the height
+			put = func() error { return k.VersKV.kFile.Put(key, &DBBKey{Offset: clearedOffset}) }
+		default:
+			entry = chunk.prev
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil || put == nil {
+		return err
+	}
+	return put()
+}
+
+// GetAt
+// Get the value a key had at the given height: the value when the height was
+// committed, or for the height after the last commit, the current value.
+// Only a versioned KV2 can be read at a height, and only the heights kept by
+// KeepHeights and KeepAfter can be read.
+//
+// A key with no versions has not changed since the KV2 was versioned.
+func (k *KV2) GetAt(key [32]byte, height uint64) (value []byte, err error) {
+	if k.VersKV == nil {
+		return nil, fmt.Errorf("not a versioned KV2: %s", k.Directory)
+	}
+	if height < k.oldestHeight() {
+		return nil, fmt.Errorf("%w: %d", ErrPruned, height)
+	}
+	var dbbKey *DBBKey
+	versioned := false
+	err = k.chunks(key, func(chunk versionChunk) (bool, error) {
+		versioned = versioned || chunk.list.len() > 0
+		if i := chunk.list.at(height); i >= 0 {
+			dbbKey = chunk.list.dbbKey(i)
+			return true, nil
+		}
+		return false, nil
+	})
+	switch {
+	case err != nil:
+		return nil, err
+	case !versioned:
+		return k.Get(key) // The key never changed
+	case dbbKey == nil:
+		return nil, fmt.Errorf("%w: at height %d", ErrNotFound, height) // The key was added after the height
+	}
+	switch {
+	case dbbKey.IsDeleted():
+		return nil, errDeleted
+	case dbbKey.IsCleared():
+		return k.permGet(key)
+	}
+	return k.DynaKV.getValue(dbbKey)
+}
+
+// GetAt
+// Find the right shard, and get the value the key had at the given height
+func (k *KVShard) GetAt(key [32]byte, height uint64) (value []byte, err error) {
+	if height < k.pruned { // Shards may not have been pruned yet
+		return nil, fmt.Errorf("%w: %d", ErrPruned, height)
+	}
+	kv2, err := k.shard(key)
+	if err != nil {
+		return nil, err
+	}
+	defer k.unlockShard(kv2)
+	return kv2.GetAt(key, height)
+}
@@ -0,0 +1,220 @@
+package blockchainDB
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAt(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{Versioned: true, ShardCnt: 4, OffsetsCnt: 64, KeyLimit: 50, BufferSize: 4096, MaxCachedBlocks: 1, BloomSize: .1}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+
+	fr := NewFastRandom([]byte{5})
+	accounts := make([][32]byte, 50)
+	for i := range accounts {
+		accounts[i] = fr.NextHash()
+	}
+	perm := fr.NextHash()
+	assert.NoError(t, kvs.PutPerm(perm, []byte("perm")), "put perm")
+
+	// history[h][i] is the value of account i at height h; "" if not found
+	history := make(map[uint64][]string)
+	state := make([]string, len(accounts))
+	for height := uint64(1); height <= 10; height++ {
+		for i, account := range accounts {
+			switch {
+			case i%int(height+1) == 0: // Accounts change at different rates
+				value := fmt.Sprintf("%d at %d", i, height)
+				assert.NoError(t, kvs.Put(account, []byte("overwritten in the same height")), "put")
+				assert.NoError(t, kvs.Put(account, []byte(value)), "put")
+				state[i] = value
+			case i%7 == int(height): // And some are deleted
+				assert.NoError(t, kvs.Delete(account), "delete")
+				state[i] = ""
+			}
+		}
+		assert.NoError(t, kvs.Commit(height), "commit")
+		history[height] = append([]string(nil), state...)
+	}
+
+	check := func(kvs *KVShard, height uint64) {
+		for i, account := range accounts {
+			value, err := kvs.GetAt(account, height)
+			what := fmt.Sprintf("account %d at height %d", i, height)
+			if history[height][i] == "" {
+				assert.Error(t, err, what)
+			} else if assert.NoError(t, err, what) {
+				assert.Equal(t, history[height][i], string(value), what)
+			}
+		}
+		value, err := kvs.GetAt(perm, height)
+		assert.NoError(t, err, "perm keys are at every height")
+		assert.Equal(t, []byte("perm"), value)
+	}
+	for height := uint64(1); height <= 10; height++ {
+		check(kvs, height)
+	}
+	value, err := kvs.GetAt(accounts[0], 11)
+	assert.NoError(t, err, "the height after the last commit is the current state")
+	assert.Equal(t, "0 at 10", string(value))
+
+	// A rollback drops the versions of the heights rolled back
+	assert.NoError(t, kvs.RollbackTo(6), "rollback")
+	assert.NoError(t, kvs.Put(accounts[0], []byte("new 7")), "put")
+	assert.NoError(t, kvs.Commit(7), "commit")
+	history[7] = append([]string(nil), history[6]...)
+	history[7][0] = "new 7"
+	for height := uint64(1); height <= 7; height++ {
+		check(kvs, height)
+	}
+	assert.NoError(t, kvs.Close(), "close")
+
+	// Versioned is kept on disk; pruning keeps the last KeepHeights heights
+	pruned := *opts
+	pruned.Versioned = false
+	pruned.KeepHeights = 3
+	kvs, err = OpenKVShard(dir, &pruned)
+	assert.NoError(t, err, "open")
+	for height := uint64(8); height <= 12; height++ {
+		assert.NoError(t, kvs.Put(accounts[0], []byte(fmt.Sprint(height))), "put")
+		assert.NoError(t, kvs.Commit(height), "commit")
+	}
+	_, err = kvs.GetAt(accounts[0], 9)
+	assert.True(t, errors.Is(err, ErrPruned), "height 9 is pruned")
+	value, err = kvs.GetAt(accounts[0], 10)
+	assert.NoError(t, err, "height 10 is kept")
+	assert.Equal(t, "10", string(value))
+	for i := 1; i < len(accounts); i++ {
+		if history[7][i] != "" {
+			value, err = kvs.GetAt(accounts[i], 10)
+			assert.NoError(t, err, "an account not written lately keeps its version")
+			assert.Equal(t, history[7][i], string(value))
+			break
+		}
+	}
+	shard := kvs.Shards[kvs.Index(accounts[0])]
+	head, err := shard.headChunk(accounts[0])
+	assert.NoError(t, err, "versions")
+	assert.Equal(t, 4, head.list.len(), "heights 9 to 12; 9 was still kept when 12 was written")
+	assert.Nil(t, head.prev, "no older chunk is kept")
+	assert.NoError(t, kvs.Close(), "close")
+}
+
+func TestGetAtKeepAfter(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{Versioned: true, KeepAfter: 3, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1}
+	kv2, err := NewKV2(dir, opts)
+	assert.NoError(t, err, "create KV2")
+	key := [32]byte{1}
+	for height := uint64(1); height <= 6; height++ {
+		_, err = kv2.Put(key, []byte(fmt.Sprint(height)))
+		assert.NoError(t, err, "put")
+		assert.NoError(t, kv2.commit(height), "commit")
+	}
+	_, err = kv2.GetAt(key, 3)
+	assert.True(t, errors.Is(err, ErrPruned), "heights up to KeepAfter are pruned")
+	for height := uint64(4); height <= 6; height++ {
+		value, err := kv2.GetAt(key, height)
+		assert.NoError(t, err, "get at")
+		assert.Equal(t, fmt.Sprint(height), string(value))
+	}
+	assert.NoError(t, kv2.Close(), "close")
+
+	plain, err := NewKV2(dir+"/plain", &Options{OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1})
+	assert.NoError(t, err, "create KV2")
+	_, err = plain.GetAt(key, 1)
+	assert.Error(t, err, "a KV2 that is not versioned cannot be read at a height")
+	assert.NoError(t, plain.Close(), "close")
+}
+
+func TestVersionChunks(t *testing.T) {
+	dir, rm := MakeDir()
+	defer rm()
+
+	ring, err := NewKeyRing(1, testKey(1))
+	assert.NoError(t, err, "key ring")
+	opts := &Options{Keys: ring, Versioned: true, ShardCnt: 1, OffsetsCnt: 64, KeyLimit: 50, BloomSize: .1, Metrics: new(Metrics)}
+	kvs, err := NewKVShard(dir, opts)
+	assert.NoError(t, err, "create KVShard")
+	key := [32]byte{1}
+	const heights = 300
+	for height := uint64(1); height <= heights; height++ {
+		assert.NoError(t, kvs.Put(key, []byte(fmt.Sprint(height))), "put")
+		assert.NoError(t, kvs.Commit(height), "commit")
+	}
+	size, err := kvs.Shards[0].VersKV.vFile.Offset()
+	assert.NoError(t, err, "size")
+	assert.LessOrEqual(t, size, uint64(heights*(chunkHeaderSize+chunkVersions*versionSize+sealOverhead)), "each write adds at most a chunk")
+
+	check := func(kvs *KVShard, from, to uint64, what string) {
+		for height := from; height <= to; height++ {
+			value, err := kvs.GetAt(key, height)
+			if assert.NoError(t, err, "%s: height %d", what, height) {
+				assert.Equal(t, fmt.Sprint(height), string(value), what)
+			}
+		}
+	}
+	check(kvs, 1, heights, "written")
+
+	// Rolling back past the newest chunk makes an older one the newest
+	assert.NoError(t, kvs.RollbackTo(280), "rollback")
+	check(kvs, 1, 280, "rolled back")
+	_, err = kvs.GetAt(key, 0)
+	assert.ErrorIs(t, err, ErrNotFound, "before the first version")
+	for height := uint64(281); height <= 290; height++ {
+		assert.NoError(t, kvs.Put(key, []byte(fmt.Sprint(height))), "put")
+		assert.NoError(t, kvs.Commit(height), "commit")
+	}
+	check(kvs, 1, 290, "written again")
+
+	// Rotated, every chunk is sealed under the new key
+	assert.NoError(t, ring.Rotate(2, testKey(2)), "rotate")
+	_, err = kvs.AppendReencoded()
+	assert.NoError(t, err, "append reencoded")
+	assert.NoError(t, kvs.Close(), "close")
+	kvs, err = OpenKVShard(dir, opts)
+	assert.NoError(t, err, "open")
+	check(kvs, 1, 290, "rotated")
+	vers := kvs.Shards[0].VersKV
+	assert.NoError(t, kvs.Shards[0].chunks(key, func(chunk versionChunk) (bool, error) {
+		if chunk.prev != nil {
+			stored := make([]byte, chunk.prev.Size())
+			assert.NoError(t, vers.vFile.ReadAt(chunk.prev.Offset, stored), "read chunk")
+			assert.Equal(t, uint32(2), sealedWith(stored), "re-encrypted")
+		}
+		return false, nil
+	}), "chunks")
+
+	pruning, err := kvs.Prune(200)
+	assert.NoError(t, err, "prune")
+	_, err = pruning.Wait()
+	assert.NoError(t, err, "pruning")
+	check(kvs, 200, 290, "pruned")
+	head, err := kvs.Shards[0].headChunk(key)
+	assert.NoError(t, err, "versions")
+	chunks := 0
+	assert.NoError(t, kvs.Shards[0].chunks(key, func(chunk versionChunk) (bool, error) {
+		chunks++
+		return false, nil
+	}), "chunks")
+	assert.Equal(t, 6, chunks, "heights 200 to 290")
+	assert.Equal(t, 91-5*chunkVersions, head.list.len(), "the newest chunk")
+
+	// A chunk too short for its header, or with part of a version, is corrupt
+	assert.NoError(t, kvs.Shards[0].VersKV.Put(key, make([]byte, 8)), "put short chunk")
+	_, err = kvs.GetAt(key, 290)
+	assert.ErrorIs(t, err, ErrCorrupt, "short chunk")
+	assert.NoError(t, kvs.Shards[0].VersKV.Put(key, make([]byte, chunkHeaderSize+versionSize+1)), "put torn chunk")
+	_, err = kvs.GetAt(key, 290)
+	assert.ErrorIs(t, err, ErrCorrupt, "torn chunk")
+	assert.NoError(t, kvs.Close(), "close")
+}
@@ -2,13 +2,15 @@ package blockchainDB
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
 // View implementation
 // Simplifying assumptions of this implementation include:
 //   - Most DB accesses will not be done within the context of a view
-//   - Views will collect until all views timeout, then they can all be cleared
+//   - Writes made while any view is active are held in memory, so views
+//     are expected to be short lived
 //   - Using a view can reasonably timeout in 30 seconds.  Every access
 //     can reset the timeout, so a view can stay open as long as it is
 //     actively used
@@ -16,125 +18,273 @@ import (
 //     clear the views and flush data to disk
 //   - Currently rebuilding the DB after an unclean close of the DB is
 //     not supported
+//
+// Every write gets a sequence number.  A view records the sequence number of
+// the last write when it was created, and sees only the writes up to that
+// number.  While any view is active, writes go into Versions rather than the
+// DB, so the DB holds the state from before the oldest view was created.  When
+// the last view closes, the newest version of every key is written to the DB.
 
 // View Struct
 // Views allow one to grab a point in time in the database, and query values that were
 // in the DB at that time (writes after creating a view do not impact the view)
 type View struct {
-	ID         int                 // ID of a view
-	KeyValues  map[[32]byte][]byte // key value pairs
-	LastAccess time.Time           // time that the view was created
-	Closed     bool                // true if the View is closed
-	KVView     *KVView             // The KV database with views
+	ID         int       // ID of a view
+	Seq        uint64    // Sequence number of the last write the view can see
+	LastAccess time.Time // time that the view was last used
+	Closed     bool      // true if the View is closed
+	KVView     *KVView   // The KV database with views
 }
 
 func (v *View) Get(key [32]byte) (value []byte, err error) {
 	return v.KVView.ViewGet(v, key)
 }
 
+// Has
+// Returns the length of the value of the key, and true if the view sees the key
+func (v *View) Has(key [32]byte) (length uint64, ok bool, err error) {
+	return v.KVView.ViewHas(v, key)
+}
+
+// Close
+// Close the view.  If it was the last view, the writes held back for views
+// are written to the DB.
+func (v *View) Close() error {
+	s := v.KVView
+	s.mutex.Lock()
+	defer s.unlock()
+	v.Closed = true
+	return s.expireViews()
+}
+
+// version
+// The value a key was given by the write with the sequence number seq
+type version struct {
+	seq     uint64
+	value   []byte
+	deleted bool // The write deleted the key
+}
+
 // KVView
-// A wrapper around a sharded DB that implements Views.  Views are created in a stack.
-// More recent views lookup values in their cache, and then in the views that come
-// before.  Later views are ignored.
+// A wrapper around a sharded DB that implements Views.  Each view sees the DB as
+// it was when the view was created.  Writes made while views are active are kept
+// as versions in memory until the last view closes.
 type KVView struct {
-	DB          *KVShard      // The underlying DB
-	ViewID      int           // The next ViewID
-	ActiveViews []*View       // List of all active Views, newest first
-	Map         map[int]View  // Fast lookup of a view
-	Timeout     time.Duration // How long before views timeout; every access resets timeout
-	OffsetCnt   uint64        // KeyOffset number for the key files
-	KeyLimit    uint64        // KeyLimit sets when to move keys to History
-}
-
-func NewShardDBViews(
-	Directory string,
-	Timeout time.Duration,
-	Partition, ShardCnt,
-	BufferCnt,
-	OffsetCnt, KeyLimit uint64,
-	MaxCachedBlocks int) (sdbV *KVView, err error) {
+	mutex       sync.Mutex             // Views, Versions and the DB are used by one caller at a time
+	DB          *KVShard               // The underlying DB
+	ViewID      int                    // The next ViewID
+	Seq         uint64                 // Sequence number of the last write
+	ActiveViews []*View                // List of all active Views, oldest first
+	Versions    map[[32]byte][]version // Writes made while views are active, oldest first
+	Map         map[int]*View          // Active views by ID
+	Timeout     time.Duration          // How long before views timeout; every access resets timeout
+	OnExpire    func(view *View)       // If set, called for each view that times out
+
+	expired []*View // Views that timed out, waiting for OnExpire
+}
 
+// NewKVView
+// Create a new sharded DB with views.  Fails with ErrExists if the directory
+// already holds a database, unless opts.Overwrite is set.
+// opts.ViewTimeout sets how long an idle view stays valid.
+func NewKVView(Directory string, opts *Options) (sdbV *KVView, err error) {
+	opts = opts.withDefaults()
 	sdbV = new(KVView)
-	sdbV.Timeout = Timeout
-	sdbV.OffsetCnt = OffsetCnt
-	sdbV.KeyLimit = KeyLimit
-	if sdbV.DB, err = NewKVShard(Directory, sdbV.OffsetCnt, sdbV.KeyLimit, MaxCachedBlocks); err == nil {
+	sdbV.Timeout = opts.ViewTimeout
+	sdbV.Versions = make(map[[32]byte][]version)
+	sdbV.Map = make(map[int]*View)
+	if sdbV.DB, err = NewKVShard(Directory, opts); err == nil {
 		return sdbV, nil
 	}
 	return nil, err
 }
 
-func OpenShardDBViews(
-	Directory string,
-	Timeout time.Duration,
-	Partition,
-	BufferCnt int) (sdbV *KVView, err error) {
-
+// OpenKVView
+// Open a sharded DB with views.  If no database exists in the directory, a new
+// one is created.
+func OpenKVView(Directory string, opts *Options) (sdbV *KVView, err error) {
+	opts = opts.withDefaults()
 	sdbV = new(KVView)
-	sdbV.Timeout = Timeout
-	if sdbV.DB, err = OpenKVShard(Directory); err == nil {
+	sdbV.Timeout = opts.ViewTimeout
+	sdbV.Versions = make(map[[32]byte][]version)
+	sdbV.Map = make(map[int]*View)
+	if sdbV.DB, err = OpenKVShard(Directory, opts); err == nil {
 		return sdbV, nil
 	}
 	return nil, err
 }
 
-func (s *KVView) Close() {
+// Close
+// Close all the views, write any writes they held back to the DB, and close the DB
+func (s *KVView) Close() error {
+	s.mutex.Lock()
+	defer s.unlock()
+	for _, v := range s.ActiveViews {
+		v.Closed = true
+	}
 	s.ActiveViews = nil
-	s.Map = nil
-	s.DB.Close()
+	clear(s.Map)
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.DB.Close()
+}
+
+// unlock
+// Unlock the mutex, then tell OnExpire about the views that timed out.
+// OnExpire is called without the mutex held, so it is free to use the KVView.
+func (s *KVView) unlock() {
+	expired := s.expired
+	s.expired = nil
+	s.mutex.Unlock()
+	if s.OnExpire == nil {
+		return
+	}
+	for _, v := range expired {
+		s.OnExpire(v)
+	}
+}
+
+// Views
+// Returns a copy of each active view, oldest first
+func (s *KVView) Views() []View {
+	s.mutex.Lock()
+	defer s.unlock()
+	s.expireViews()
+	views := make([]View, len(s.ActiveViews))
+	for i, v := range s.ActiveViews {
+		views[i] = *v
+	}
+	return views
+}
+
+// GetView
+// Returns the active view with the given ID, or nil if there is none
+func (s *KVView) GetView(id int) *View {
+	s.mutex.Lock()
+	defer s.unlock()
+	s.expireViews()
+	return s.Map[id]
 }
 
 // Active Views
 // Returns true if a valid active view exists.  If old views
 // exist, but none are active, the active views are tossed.
 func (s *KVView) IsViewActive() bool {
-	// The first entry in the ActiveViews is the View Cache
-	// ActiveViews with a length less than two means no active views
-	if len(s.ActiveViews) < 2 {
-		return false
-	}
-
-	s.GetViewIndex(s.ActiveViews[1]) // This will clear ActiveViews if none are valid
-	return len(s.ActiveViews) > 0    // If any remain, then a View is Active
+	s.mutex.Lock()
+	defer s.unlock()
+	s.expireViews() // This will clear ActiveViews if none are valid
+	return len(s.ActiveViews) > 0
 }
 
+// Put
+// Put a key value pair.  If views are active, the write is kept as a version
+// the views cannot see; otherwise it goes to the DB.
 func (s *KVView) Put(key [32]byte, value []byte) error {
+	s.mutex.Lock()
+	defer s.unlock()
+	if err := s.expireViews(); err != nil {
+		return err
+	}
+	return s.write(key, value, false)
+}
 
+// Delete
+// Delete a key.  Views created before the delete still see the key.
+func (s *KVView) Delete(key [32]byte) error {
+	s.mutex.Lock()
+	defer s.unlock()
+	if err := s.expireViews(); err != nil {
+		return err
+	}
+	return s.write(key, nil, true)
+}
+
+// write
+// Write or delete a key, in the DB if no view is active, else as a version
+func (s *KVView) write(key [32]byte, value []byte, deleted bool) error {
 	// If not view is active, then write to the DB
-	if !s.IsViewActive() {
+	if len(s.ActiveViews) == 0 {
+		if deleted {
+			return s.DB.Delete(key)
+		}
 		return s.DB.Put(key, value)
 	}
 
-	s.ActiveViews[len(s.ActiveViews)-1].KeyValues[key] = value // Put key/value in last view
-	s.ActiveViews[0].KeyValues[key] = value                    // And put the key value in the cache
+	s.Seq++
+	value = append([]byte(nil), value...) // The caller is free to reuse value
+	s.Versions[key] = append(s.Versions[key], version{seq: s.Seq, value: value, deleted: deleted})
 	return nil
 }
 
+// Get
+// Get the current value of a key, including writes held back for views
 func (s *KVView) Get(key [32]byte) (value []byte, err error) {
+	s.mutex.Lock()
+	defer s.unlock()
+	if err = s.expireViews(); err != nil {
+		return nil, err
+	}
+	return s.read(key, s.Seq)
+}
 
-	// If no view is active, just get the DB value
-	if !s.IsViewActive() {
-		return s.DB.Get(key)
+// read
+// Get the value of a key as of the write with sequence number seq.  The
+// newest version at or before seq is the value; if there is none, the DB
+// holds it.
+func (s *KVView) read(key [32]byte, seq uint64) (value []byte, err error) {
+	versions := s.Versions[key]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].seq <= seq {
+			if versions[i].deleted {
+				return nil, errDeleted
+			}
+			return versions[i].value, nil
+		}
 	}
+	return s.DB.Get(key) // If no version is old enough, return whatever the DB has.
+}
 
-	// If a view is active, we need to check the view cache first
-	value, ok := s.ActiveViews[0].KeyValues[key]
-	if ok {
-		return value, nil
+// Has
+// Returns the length of the current value of the key, and true if the key
+// exists, including writes held back for views.  No value is read from disk.
+func (s *KVView) Has(key [32]byte) (length uint64, ok bool, err error) {
+	s.mutex.Lock()
+	defer s.unlock()
+	if err = s.expireViews(); err != nil {
+		return 0, false, err
 	}
+	return s.has(key, s.Seq)
+}
 
-	return s.DB.Get(key) // Nothing in the view cache? Pull from the DB
+// has
+// Returns the length of the value of a key as of the write with sequence
+// number seq, and true if the key exists then; see read
+func (s *KVView) has(key [32]byte, seq uint64) (length uint64, ok bool, err error) {
+	versions := s.Versions[key]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].seq <= seq {
+			if versions[i].deleted {
+				return 0, false, nil
+			}
+			return uint64(len(versions[i].value)), true, nil
+		}
+	}
+	return s.DB.Has(key)
 }
 
+// NewView
+// Create a view of the current state of the DB
 func (s *KVView) NewView() *View {
-	// If no view is active, we have to cache DB updates so
-	// create a "DB Update View" at s.ActiveViews[0]
-	if !s.IsViewActive() {
-		view := new(View)
-		view.ID = 0
-		view.KeyValues = make(map[[32]byte][]byte)
-		s.ActiveViews = append(s.ActiveViews, view)
-	}
+	s.mutex.Lock()
+	defer s.unlock()
+	return s.newView()
+}
+
+// newView
+// Create a view; the caller holds the mutex
+func (s *KVView) newView() *View {
+	s.expireViews()
 
 	// Create a view and added it to the ActiveViews slice. Add
 	// the newest views to the end of the list.
@@ -142,75 +292,120 @@ func (s *KVView) NewView() *View {
 	s.ViewID++
 	view.KVView = s
 	view.ID = s.ViewID
+	view.Seq = s.Seq
 	view.LastAccess = time.Now()
-	view.KeyValues = make(map[[32]byte][]byte)
 	s.ActiveViews = append(s.ActiveViews, view)
+	s.Map[view.ID] = view
 	return view
 }
 
 // GetViewIndex
-// Returns the view index for a view.  Returns 0 if view is closed.
+// Returns the index of a view in ActiveViews.  Returns -1 if view is closed.
 func (s *KVView) GetViewIndex(view *View) int {
-	if view.Closed || len(s.ActiveViews) == 0 {
-		return 0
-	}
+	s.mutex.Lock()
+	defer s.unlock()
+	return s.viewIndex(view)
+}
 
-	// Look for and mark all the views that have timed out
-	for _, v := range s.ActiveViews[1:] {
-		if v.Closed {
-			return 0
+// viewIndex
+// Returns the index of a view in ActiveViews; the caller holds the mutex
+func (s *KVView) viewIndex(view *View) int {
+	s.expireViews()
+	if view.Closed {
+		return -1
+	}
+	for i, v := range s.ActiveViews { // Look for the view in the Views that remain
+		if v.ID == view.ID {
+			return i
 		}
-		if dt := time.Since(view.LastAccess); dt > s.Timeout {
+	}
+	return -1
+}
+
+// expireViews
+// Close the views that have timed out and drop all closed views.  Versions
+// no view can see any longer are dropped, and once no view is left, the
+// versions are written to the DB.  Views only time out when the KVView is
+// used, so OnExpire is called by the next call after the timeout.
+func (s *KVView) expireViews() error {
+	active := s.ActiveViews[:0]
+	for _, v := range s.ActiveViews { // Look for and mark all the views that have timed out
+		if !v.Closed && time.Since(v.LastAccess) > s.Timeout {
 			v.Closed = true
+			s.expired = append(s.expired, v)
 		}
+		if v.Closed {
+			delete(s.Map, v.ID)
+		} else {
+			active = append(active, v)
+		}
+	}
+	if len(active) == len(s.ActiveViews) {
+		return nil
 	}
+	clear(s.ActiveViews[len(active):])
+	s.ActiveViews = active
 
-	// First clear ActiveViews if no active view exists
-	if len(s.ActiveViews) == 2 && s.ActiveViews[1].Closed { // Clear ActiveViews if none exist
-		s.ActiveViews = s.ActiveViews[:0]
-		return 0
+	if len(s.ActiveViews) == 0 {
+		return s.flush()
 	}
-	for s.ActiveViews[1].Closed { // While the oldest ActiveView is closed, delete it
-		n := len(s.ActiveViews)
-		if n <= 2 { // If Removing the last view, clear ActiveViews
-			s.ActiveViews = s.ActiveViews[:0] // No index exists for the View
-			return 0
+
+	// Only the newest version at or before the oldest view is still needed
+	oldest := s.ActiveViews[0].Seq
+	for key, versions := range s.Versions {
+		i := 0
+		for i+1 < len(versions) && versions[i+1].seq <= oldest {
+			i++
+		}
+		if i > 0 {
+			s.Versions[key] = append(versions[:0], versions[i:]...)
 		}
-		copy(s.ActiveViews[1:], s.ActiveViews[2:]) // Remove the closed View
-		s.ActiveViews = s.ActiveViews[:n-1]
 	}
+	return nil
+}
 
-	for i, v := range s.ActiveViews[1:] { // Look for the view in the Views that remain
-		if v.ID == view.ID {
-			return i + 1
+// flush
+// Write the newest version of every key to the DB
+func (s *KVView) flush() error {
+	for key, versions := range s.Versions {
+		newest := versions[len(versions)-1]
+		if newest.deleted {
+			if err := s.DB.Delete(key); err != nil {
+				return err
+			}
+		} else if err := s.DB.Put(key, newest.value); err != nil {
+			return err
 		}
+		delete(s.Versions, key)
 	}
-
-	return 0
+	return nil
 }
 
 // ViewGet
-// To a get of a key value pair using a view.  The view is searched first, and all
-// active views that were created before this view are searched in turn.  If no
-// key value pair is found in the view or older views, then return what the DB has
+// Get the value of a key as of the time the view was created.  The newest
+// version written before the view was created is returned.  If there is none,
+// then the DB holds the value the view sees.
 func (s *KVView) ViewGet(view *View, key [32]byte) (value []byte, err error) {
-	//
-	view.LastAccess = time.Now()
+	s.mutex.Lock()
+	defer s.unlock()
 	// Check if the view provided is active.  If not, return an error that the
 	// view has expired
-	viewIdx := s.GetViewIndex(view)
-	if viewIdx == 0 {
-		return nil, fmt.Errorf("view invalid")
+	if s.viewIndex(view) < 0 {
+		return nil, fmt.Errorf("%w: view %d", ErrViewExpired, view.ID)
 	}
+	view.LastAccess = time.Now()
+	return s.read(key, view.Seq)
+}
 
-	// Check the view and all the older views for a key value pair.  Note that even
-	// if an older view has expired, we still need its key value pair rather than
-	// the current key value pair
-	for viewIdx--; viewIdx > 0; viewIdx-- {
-		if v, ok := s.ActiveViews[viewIdx].KeyValues[key]; ok {
-			return v, nil
-		}
+// ViewHas
+// Returns the length of the value of a key as of the time the view was
+// created, and true if the key existed then
+func (s *KVView) ViewHas(view *View, key [32]byte) (length uint64, ok bool, err error) {
+	s.mutex.Lock()
+	defer s.unlock()
+	if s.viewIndex(view) < 0 {
+		return 0, false, fmt.Errorf("%w: view %d", ErrViewExpired, view.ID)
 	}
-
-	return s.DB.Get(key) // If no key value pair exists, return whatever the DB has.
+	view.LastAccess = time.Now()
+	return s.has(key, view.Seq)
 }
@@ -16,7 +16,7 @@ func TestViews(t *testing.T) {
 
 	Directory, rm := MakeDir()
 	defer rm()
-	sdbv, err := NewShardDBViews(Directory, Timeout, 1, 256, 1, 1024, 100_000, 50)
+	sdbv, err := NewKVView(Directory, &Options{ViewTimeout: Timeout, OffsetsCnt: 1024, KeyLimit: 100_000, MaxCachedBlocks: 50, BloomSize: .1})
 	assert.NoError(t, err, "failed to open ShardDBViews")
 
 	// Collect NumKeys number of key/values, and populate the DB
@@ -107,7 +107,7 @@ func TestView(t *testing.T) {
 
 	Directory, rm := MakeDir()
 	defer rm()
-	sdbv, err := NewShardDBViews(Directory, Timeout, 1, 256, 1, 1024, 100_000, 50)
+	sdbv, err := NewKVView(Directory, &Options{ViewTimeout: Timeout, OffsetsCnt: 1024, KeyLimit: 100_000, MaxCachedBlocks: 50, BloomSize: .1})
 	assert.NoError(t, err, "failed to open ShardDBViews")
 
 	Kr := NewFastRandom([]byte{1, 2, 3})
@@ -155,7 +155,6 @@ func TestView(t *testing.T) {
 		assert.Equal(t, value, v, "failed to get data")
 	}
 	assert.Equal(t, 1, len(sdbv.ActiveViews), "Should have one active view")
-	sdbv.Close()
 
 	// Check the DB; first half should have changed values, last half not changed
 	Kr.Reset()
@@ -163,7 +162,7 @@ func TestView(t *testing.T) {
 	for i := 0; i < NumKeys; i++ {
 		key := Kr.NextHash()
 		value := Vr.RandBuff(10, 10)
-		v, err := view.Get(key)
+		v, err := sdbv.Get(key)
 		assert.NoError(t, err, "get failed")
 		if i >= NumKeys/2 {
 			assert.Equal(t, value, v, "failed to get data")
@@ -171,13 +170,212 @@ func TestView(t *testing.T) {
 			assert.NotEqual(t, value, v, "failed to update value")
 		}
 	}
-	// Check the first half to be equal to the changed values
+	assert.NoError(t, sdbv.Close(), "close failed")
+	_, err = view.Get(Kr.NextHash())
+	assert.Error(t, err, "a view should not outlive its KVView")
+
+	// The changes made while the view was open were written to the DB
+	sdbv, err = OpenKVView(Directory, &Options{ViewTimeout: Timeout, OffsetsCnt: 1024, KeyLimit: 100_000, MaxCachedBlocks: 50, BloomSize: .1})
+	assert.NoError(t, err, "failed to open KVView")
 	Kr.Reset()
+	Vr.Reset()
+	for i := 0; i < NumKeys; i++ { // Skip the original values of the first half
+		Vr.RandBuff(10, 10)
+	}
 	for i := 0; i < NumKeys/2; i++ {
 		key := Kr.NextHash()
 		value := Vr.RandBuff(10, 10)
 		v, err := sdbv.Get(key)
-		assert.NoError(t, err, "put failed")
+		assert.NoError(t, err, "get failed")
 		assert.Equal(t, value, v, "failed to get data")
 	}
+	assert.NoError(t, sdbv.Close(), "close failed")
+}
+
+func TestViewOracle(t *testing.T) {
+	const NumKeys = 100 // Size of the pool of keys written
+	const NumOps = 5000 // Number of random operations
+
+	Directory, rm := MakeDir()
+	defer rm()
+	sdbv, err := NewKVView(Directory, &Options{ViewTimeout: time.Hour, ShardCnt: 8, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1})
+	assert.NoError(t, err, "failed to create KVView")
+
+	fr := NewFastRandom([]byte{5})
+	keys := make([][32]byte, NumKeys)
+	oracle := make(map[[32]byte][]byte) // The current state of the DB
+	for i := range keys {
+		keys[i] = fr.NextHash()
+		if i%2 == 0 {
+			oracle[keys[i]] = fr.RandBuff(10, 20)
+			assert.NoError(t, sdbv.Put(keys[i], oracle[keys[i]]), "put failed")
+		}
+	}
+
+	// Each view must see exactly the state of the oracle when the view was created
+	type snapshot struct {
+		view  *View
+		state map[[32]byte][]byte
+	}
+	var views []snapshot
+	check := func(s snapshot, key [32]byte) bool {
+		value, err := s.view.Get(key)
+		if expected, ok := s.state[key]; ok {
+			return assert.NoError(t, err, "view get failed") && assert.Equal(t, expected, value, "view saw a later write")
+		}
+		return assert.Error(t, err, "view saw a key written after it was created")
+	}
+
+	for i := 0; i < NumOps; i++ {
+		key := keys[fr.UintN(NumKeys)]
+		switch op := fr.UintN(100); {
+		case op < 50: // Write
+			value := fr.RandBuff(10, 20)
+			oracle[key] = value
+			assert.NoError(t, sdbv.Put(key, value), "put failed")
+		case op < 60: // Create a view
+			state := make(map[[32]byte][]byte, len(oracle))
+			for k, v := range oracle {
+				state[k] = v
+			}
+			views = append(views, snapshot{sdbv.NewView(), state})
+		case op < 90 && len(views) > 0: // Read through a view
+			if !check(views[fr.UintN(uint(len(views)))], key) {
+				return
+			}
+		case op < 95 && len(views) > 0: // Close a view
+			j := fr.UintN(uint(len(views)))
+			views[j].view.Closed = true
+			views = append(views[:j], views[j+1:]...)
+		default: // Read the current state
+			value, err := sdbv.Get(key)
+			if expected, ok := oracle[key]; ok {
+				assert.NoError(t, err, "get failed")
+				assert.Equal(t, expected, value, "get missed a write")
+			} else {
+				assert.Error(t, err, "get found a key never written")
+			}
+		}
+	}
+
+	// Every view still sees its snapshot of every key
+	for _, s := range views {
+		for _, key := range keys {
+			if !check(s, key) {
+				return
+			}
+		}
+	}
+
+	// Once the last view closes, the writes held for the views reach the DB
+	for _, s := range views {
+		s.view.Closed = true
+	}
+	assert.False(t, sdbv.IsViewActive(), "no view should be active")
+	assert.Len(t, sdbv.Versions, 0, "versions should be flushed to the DB")
+	for _, key := range keys {
+		value, err := sdbv.DB.Get(key)
+		if expected, ok := oracle[key]; ok {
+			assert.NoError(t, err, "get failed")
+			assert.Equal(t, expected, value, "the DB missed a write")
+		} else {
+			assert.Error(t, err, "the DB has a key never written")
+		}
+	}
+	assert.NoError(t, sdbv.Close(), "close failed")
+}
+
+func TestViewLifecycle(t *testing.T) {
+	Directory, rm := MakeDir()
+	defer rm()
+	sdbv, err := NewKVView(Directory, &Options{ViewTimeout: time.Hour, ShardCnt: 8, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1})
+	assert.NoError(t, err, "failed to create KVView")
+
+	var expired []int
+	sdbv.OnExpire = func(view *View) {
+		expired = append(expired, view.ID)
+		assert.Nil(t, sdbv.GetView(view.ID), "OnExpire can use the KVView; the view is gone from the registry")
+	}
+
+	key := [32]byte{1}
+	assert.NoError(t, sdbv.Put(key, []byte("v1")), "put")
+	v1, v2 := sdbv.NewView(), sdbv.NewView()
+	assert.NoError(t, sdbv.Put(key, []byte("v2")), "put")
+
+	views := sdbv.Views()
+	assert.Len(t, views, 2)
+	assert.Equal(t, v1.ID, views[0].ID, "oldest view first")
+	assert.Equal(t, v2.ID, views[1].ID)
+	assert.Same(t, v2, sdbv.GetView(v2.ID), "lookup by ID")
+
+	// An explicit Close takes the view out of the registry without OnExpire
+	assert.NoError(t, v1.Close(), "close view")
+	assert.Nil(t, sdbv.GetView(v1.ID), "a closed view is gone")
+	_, err = v1.Get(key)
+	assert.Error(t, err, "a closed view cannot be read")
+	assert.Len(t, sdbv.Views(), 1)
+	assert.Empty(t, expired, "Close is not an expiry")
+
+	// A timed out view is reported to OnExpire, and only once
+	v2.LastAccess = time.Now().Add(-2 * time.Hour)
+	assert.False(t, sdbv.IsViewActive(), "v2 timed out")
+	assert.Equal(t, []int{v2.ID}, expired)
+	assert.False(t, sdbv.IsViewActive())
+	assert.Equal(t, []int{v2.ID}, expired)
+
+	// Closing the last view flushes the writes held back for views
+	v3 := sdbv.NewView()
+	assert.NoError(t, sdbv.Put(key, []byte("v3")), "put")
+	assert.Len(t, sdbv.Versions, 1, "the write is held back for v3")
+	assert.NoError(t, v3.Close(), "close view")
+	assert.Len(t, sdbv.Versions, 0, "the last Close flushes")
+	value, err := sdbv.DB.Get(key)
+	assert.NoError(t, err, "get")
+	assert.Equal(t, []byte("v3"), value)
+	assert.NoError(t, sdbv.Close(), "close")
+}
+
+func TestKVViewHas(t *testing.T) {
+	Directory, rm := MakeDir()
+	defer rm()
+
+	opts := &Options{ViewTimeout: time.Hour, ShardCnt: 8, OffsetsCnt: 64, KeyLimit: 500, BloomSize: .1, Metrics: new(Metrics)}
+	sdbv, err := NewKVView(Directory, opts)
+	assert.NoError(t, err, "create KVView")
+
+	perm, dyna, deleted, added := [32]byte{1}, [32]byte{2}, [32]byte{3}, [32]byte{4}
+	assert.NoError(t, sdbv.Put(perm, []byte("perm")), "put")
+	assert.NoError(t, sdbv.Put(dyna, []byte("dyna")), "put")
+	assert.NoError(t, sdbv.Put(dyna, []byte("changed")), "put")
+	assert.NoError(t, sdbv.Put(deleted, []byte("deleted")), "put")
+	assert.NoError(t, sdbv.Delete(deleted), "delete")
+
+	has := func(has func([32]byte) (uint64, bool, error), key [32]byte, want int) {
+		length, ok, err := has(key)
+		assert.NoError(t, err, "has")
+		assert.Equal(t, want >= 0, ok, "key %x", key[:1])
+		if want >= 0 {
+			assert.Equal(t, uint64(want), length, "length of key %x", key[:1])
+		}
+	}
+	gets := opts.Metrics.Gets.Load()
+	has(sdbv.DB.Has, perm, 4)
+	has(sdbv.DB.Has, dyna, 7)
+	has(sdbv.DB.Has, deleted, -1)
+	has(sdbv.DB.Has, added, -1)
+
+	// A view does not see a key added after it was created
+	view := sdbv.NewView()
+	assert.NoError(t, sdbv.Put(added, []byte("added")), "put")
+	assert.NoError(t, sdbv.Delete(perm), "delete")
+	has(sdbv.Has, added, 5)
+	has(sdbv.Has, perm, -1)
+	has(view.Has, added, -1)
+	has(view.Has, perm, 4)
+	assert.Equal(t, gets, opts.Metrics.Gets.Load(), "no value was read")
+	assert.NoError(t, view.Close(), "close view")
+	_, _, err = view.Has(perm)
+	assert.Error(t, err, "the view is closed")
+	has(sdbv.DB.Has, added, 5)
+	assert.NoError(t, sdbv.Close(), "close")
 }